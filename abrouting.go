@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var abRules = flag.String("ab-routes", "", "Comma-separated list of header:Name=value=>dir or cookie:name=value=>dir rules serving matching requests from the same script under a directory of the CGI directory, e.g. header:X-Beta=1=>beta; value * matches any")
+
+// abRule serves requests carrying a header or cookie value from a variant
+// directory
+type abRule struct {
+	cookie bool
+	name   string
+	value  string
+	dir    string
+}
+
+// abRoutes holds the rules, evaluated in order
+var abRoutes []abRule
+
+// parseABRules parses the -ab-routes flag
+func parseABRules(spec string) ([]abRule, error) {
+	var rules []abRule
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		cond, dir, ok1 := strings.Cut(item, "=>")
+		source, match, ok2 := strings.Cut(cond, ":")
+		name, value, ok3 := strings.Cut(match, "=")
+		if !ok1 || !ok2 || !ok3 || name == "" || (source != "header" && source != "cookie") {
+			return nil, fmt.Errorf("invalid A/B route %q, expected header:Name=value=>dir or cookie:name=value=>dir", item)
+		}
+		if !isPathSafe(dir) {
+			return nil, fmt.Errorf("invalid A/B route directory %q", dir)
+		}
+		rules = append(rules, abRule{cookie: source == "cookie", name: name, value: value, dir: dir})
+	}
+	return rules, nil
+}
+
+// matches checks a request against the rule
+func (rule abRule) matches(r *http.Request) bool {
+	var value string
+	if rule.cookie {
+		c, err := r.Cookie(rule.name)
+		if err != nil {
+			return false
+		}
+		value = c.Value
+	} else {
+		values := r.Header.Values(rule.name)
+		if len(values) == 0 {
+			return false
+		}
+		value = values[0]
+	}
+	return rule.value == "*" || value == rule.value
+}
+
+// routeAB switches a request for a script in the CGI directory to its variant
+// under the directory of the first matching rule, if the variant exists. The
+// response varies on the headers and cookies that were considered.
+func routeAB(w http.ResponseWriter, r *http.Request, target cgiTarget) cgiTarget {
+	if len(abRoutes) == 0 || target.root != cgiRoot(r) {
+		return target
+	}
+	rel, err := filepath.Rel(filepath.Clean(target.root), filepath.Clean(target.scriptPath))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return target
+	}
+
+	for _, rule := range abRoutes {
+		if rule.cookie {
+			w.Header().Add("Vary", "Cookie")
+		} else {
+			w.Header().Add("Vary", http.CanonicalHeaderKey(rule.name))
+		}
+		if !rule.matches(r) {
+			continue
+		}
+		variant := filepath.Join(target.root, rule.dir, rel)
+		if _, err := statScript(variant); err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Error accessing A/B variant %s: %v", variant, err)
+			}
+			continue
+		}
+		target.scriptPath = variant
+		return target
+	}
+	return target
+}
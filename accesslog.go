@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	accessLogPath    = flag.String("access-log", "", "File to append an access log line to for every request, in combined log format followed by the duration, or - for the server log")
+	accessLogSample  = flag.Int("access-log-sample", 1, "Log only one in this many successful requests; errors are always logged")
+	accessLogInclude = flag.String("access-log-include", "", "Comma-separated list of URL path prefixes whose successful requests are logged, or empty for all")
+	accessLogExclude = flag.String("access-log-exclude", "", "Comma-separated list of URL path prefixes whose successful requests aren't logged, such as health checks")
+)
+
+// accessLogger writes the access log
+var accessLogger *log.Logger
+
+// accessLogCount counts the successful requests considered for sampling
+var accessLogCount atomic.Uint64
+
+// openAccessLog sets up the access log
+func openAccessLog(path string) error {
+	if path == "-" {
+		accessLogger = log.Default()
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	accessLogger = log.New(f, "", 0)
+	return nil
+}
+
+// accessRecorder notes the status and size of a response
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (rec *accessRecorder) WriteHeader(status int) {
+	if rec.status == 0 && !isInterim(status) {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *accessRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.size += int64(n)
+	return n, err
+}
+
+func (rec *accessRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := readFrom(rec.ResponseWriter, src)
+	rec.size += n
+	return n, err
+}
+
+func (rec *accessRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// hasPathPrefix tells whether a path starts with one of a comma-separated
+// list of prefixes
+func hasPathPrefix(path, prefixes string) bool {
+	for _, prefix := range strings.Split(prefixes, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" && strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// logsAccess tells whether a request is logged: errors always are, while
+// successful requests go through the path filters and sampling
+func logsAccess(path string, status int) bool {
+	if status >= 400 {
+		return true
+	}
+	if *accessLogInclude != "" && !hasPathPrefix(path, *accessLogInclude) {
+		return false
+	}
+	if hasPathPrefix(path, *accessLogExclude) {
+		return false
+	}
+	return *accessLogSample <= 1 || accessLogCount.Add(1)%uint64(*accessLogSample) == 0
+}
+
+// withAccessLog writes an access log line for every request
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if !logsAccess(r.URL.Path, status) {
+			return
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		user, _, _ := r.BasicAuth()
+		if user == "" {
+			user = "-"
+		}
+		accessLogger.Printf("%s - %s [%s] %q %d %d %q %q %s",
+			host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.RequestURI+" "+r.Proto, status, rec.size,
+			r.Referer(), r.UserAgent(), time.Since(start).Round(time.Microsecond))
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	adminPrefix     = flag.String("admin-prefix", "/_cgiserver/", "URL prefix of the admin endpoints")
+	adminToken      = flag.String("admin-token", "", "Bearer token required by the admin endpoints, which are disabled when neither it nor -admin-tokens is set")
+	adminTokensFile = flag.String("admin-tokens", "", "File of \"name token\" lines, each a bearer token accepted by the admin endpoints, audited under its name")
+	adminListen     = flag.String("admin-listen", "", "Address of a separate listener for the admin endpoints, which are then no longer served on the main one")
+)
+
+// adminEndpoints maps admin endpoint names, relative to -admin-prefix, to
+// their handlers
+var adminEndpoints = make(map[string]http.HandlerFunc)
+
+// adminTokens maps the tokens of the -admin-tokens file to their names
+var adminTokens map[string]string
+
+// loadAdminTokens reads a file of named admin tokens
+func loadAdminTokens(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected name token", path, line)
+		}
+		if _, dup := tokens[fields[1]]; dup {
+			return nil, fmt.Errorf("%s:%d: token of %s already used", path, line, fields[0])
+		}
+		tokens[fields[1]] = fields[0]
+	}
+	return tokens, scanner.Err()
+}
+
+// adminEnabled tells whether the admin endpoints are served
+func adminEnabled() bool {
+	return *adminToken != "" || len(adminTokens) > 0
+}
+
+// adminIdentity returns the name of the token a request authenticates with
+func adminIdentity(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+	if *adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) == 1 {
+		return "admin", true
+	}
+	var name string
+	for candidate, n := range adminTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			name = n
+		}
+	}
+	return name, name != ""
+}
+
+// adminHandler authenticates admin requests and dispatches them to the
+// endpoint named by the rest of the path
+func adminHandler() http.Handler {
+	return http.StripPrefix(*adminPrefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := adminIdentity(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			log.Printf("Rejected unauthorized admin request from %s: %s", r.RemoteAddr, r.URL.Path)
+			auditReject(r, auditAdminAuthFailed, "admin")
+			return
+		}
+
+		h, ok := adminEndpoints[r.URL.Path]
+		if !ok {
+			names := make([]string, 0, len(adminEndpoints))
+			for name := range adminEndpoints {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			http.Error(w, "Unknown admin endpoint, expected one of: "+strings.Join(names, ", "), http.StatusNotFound)
+			return
+		}
+		log.Printf("Admin request from %s as %s: %s %s", r.RemoteAddr, admin, r.Method, r.URL.Path)
+		auditAdmin(r, admin)
+		h(w, r)
+	}))
+}
+
+// startAdminListener serves the admin endpoints on their own listener
+func startAdminListener(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(*adminPrefix, adminHandler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: *readHeaderTimeout}
+	go func() {
+		if err := server.Serve(ln); err != nil {
+			log.Printf("Admin listener stopped: %v", err)
+		}
+	}()
+	log.Printf("Serving admin endpoints on http://%s%s", ln.Addr(), *adminPrefix)
+	return nil
+}
@@ -0,0 +1,691 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: adminpb/admin.proto
+
+package adminpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ListProcessesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListProcessesRequest) Reset() {
+	*x = ListProcessesRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListProcessesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListProcessesRequest) ProtoMessage() {}
+
+func (x *ListProcessesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListProcessesRequest.ProtoReflect.Descriptor instead.
+func (*ListProcessesRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{0}
+}
+
+type Process struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Pid           int32                  `protobuf:"varint,1,opt,name=pid,proto3" json:"pid,omitempty"`
+	Script        string                 `protobuf:"bytes,2,opt,name=script,proto3" json:"script,omitempty"`
+	RemoteAddr    string                 `protobuf:"bytes,3,opt,name=remote_addr,json=remoteAddr,proto3" json:"remote_addr,omitempty"`
+	Started       *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=started,proto3" json:"started,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Process) Reset() {
+	*x = Process{}
+	mi := &file_adminpb_admin_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Process) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Process) ProtoMessage() {}
+
+func (x *Process) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Process.ProtoReflect.Descriptor instead.
+func (*Process) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Process) GetPid() int32 {
+	if x != nil {
+		return x.Pid
+	}
+	return 0
+}
+
+func (x *Process) GetScript() string {
+	if x != nil {
+		return x.Script
+	}
+	return ""
+}
+
+func (x *Process) GetRemoteAddr() string {
+	if x != nil {
+		return x.RemoteAddr
+	}
+	return ""
+}
+
+func (x *Process) GetStarted() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Started
+	}
+	return nil
+}
+
+type ListProcessesResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Processes     []*Process             `protobuf:"bytes,1,rep,name=processes,proto3" json:"processes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListProcessesResponse) Reset() {
+	*x = ListProcessesResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListProcessesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListProcessesResponse) ProtoMessage() {}
+
+func (x *ListProcessesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListProcessesResponse.ProtoReflect.Descriptor instead.
+func (*ListProcessesResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ListProcessesResponse) GetProcesses() []*Process {
+	if x != nil {
+		return x.Processes
+	}
+	return nil
+}
+
+type DrainRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DrainRequest) Reset() {
+	*x = DrainRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DrainRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DrainRequest) ProtoMessage() {}
+
+func (x *DrainRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DrainRequest.ProtoReflect.Descriptor instead.
+func (*DrainRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{3}
+}
+
+type DrainResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Elapsed       *durationpb.Duration   `protobuf:"bytes,1,opt,name=elapsed,proto3" json:"elapsed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DrainResponse) Reset() {
+	*x = DrainResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DrainResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DrainResponse) ProtoMessage() {}
+
+func (x *DrainResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DrainResponse.ProtoReflect.Descriptor instead.
+func (*DrainResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *DrainResponse) GetElapsed() *durationpb.Duration {
+	if x != nil {
+		return x.Elapsed
+	}
+	return nil
+}
+
+type ReloadConfigRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReloadConfigRequest) Reset() {
+	*x = ReloadConfigRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReloadConfigRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReloadConfigRequest) ProtoMessage() {}
+
+func (x *ReloadConfigRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReloadConfigRequest.ProtoReflect.Descriptor instead.
+func (*ReloadConfigRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{5}
+}
+
+type ReloadConfigResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Reloaded      []string               `protobuf:"bytes,1,rep,name=reloaded,proto3" json:"reloaded,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReloadConfigResponse) Reset() {
+	*x = ReloadConfigResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReloadConfigResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReloadConfigResponse) ProtoMessage() {}
+
+func (x *ReloadConfigResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReloadConfigResponse.ProtoReflect.Descriptor instead.
+func (*ReloadConfigResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ReloadConfigResponse) GetReloaded() []string {
+	if x != nil {
+		return x.Reloaded
+	}
+	return nil
+}
+
+type SetScriptEnabledRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// URL path of the script, e.g. /cgi-bin/report.cgi
+	Script        string `protobuf:"bytes,1,opt,name=script,proto3" json:"script,omitempty"`
+	Enabled       bool   `protobuf:"varint,2,opt,name=enabled,proto3" json:"enabled,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetScriptEnabledRequest) Reset() {
+	*x = SetScriptEnabledRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetScriptEnabledRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetScriptEnabledRequest) ProtoMessage() {}
+
+func (x *SetScriptEnabledRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetScriptEnabledRequest.ProtoReflect.Descriptor instead.
+func (*SetScriptEnabledRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *SetScriptEnabledRequest) GetScript() string {
+	if x != nil {
+		return x.Script
+	}
+	return ""
+}
+
+func (x *SetScriptEnabledRequest) GetEnabled() bool {
+	if x != nil {
+		return x.Enabled
+	}
+	return false
+}
+
+type SetScriptEnabledResponse struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	DisabledScripts []string               `protobuf:"bytes,1,rep,name=disabled_scripts,json=disabledScripts,proto3" json:"disabled_scripts,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *SetScriptEnabledResponse) Reset() {
+	*x = SetScriptEnabledResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetScriptEnabledResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetScriptEnabledResponse) ProtoMessage() {}
+
+func (x *SetScriptEnabledResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetScriptEnabledResponse.ProtoReflect.Descriptor instead.
+func (*SetScriptEnabledResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *SetScriptEnabledResponse) GetDisabledScripts() []string {
+	if x != nil {
+		return x.DisabledScripts
+	}
+	return nil
+}
+
+type GetStatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatsRequest) Reset() {
+	*x = GetStatsRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatsRequest) ProtoMessage() {}
+
+func (x *GetStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatsRequest.ProtoReflect.Descriptor instead.
+func (*GetStatsRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{9}
+}
+
+type GetStatsResponse struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Version         string                 `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	Started         *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=started,proto3" json:"started,omitempty"`
+	Requests        int64                  `protobuf:"varint,3,opt,name=requests,proto3" json:"requests,omitempty"`
+	InFlight        int64                  `protobuf:"varint,4,opt,name=in_flight,json=inFlight,proto3" json:"in_flight,omitempty"`
+	Processes       int64                  `protobuf:"varint,5,opt,name=processes,proto3" json:"processes,omitempty"`
+	JobsQueued      int64                  `protobuf:"varint,6,opt,name=jobs_queued,json=jobsQueued,proto3" json:"jobs_queued,omitempty"`
+	JobsRunning     int64                  `protobuf:"varint,7,opt,name=jobs_running,json=jobsRunning,proto3" json:"jobs_running,omitempty"`
+	DisabledScripts []string               `protobuf:"bytes,8,rep,name=disabled_scripts,json=disabledScripts,proto3" json:"disabled_scripts,omitempty"`
+	Draining        bool                   `protobuf:"varint,9,opt,name=draining,proto3" json:"draining,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *GetStatsResponse) Reset() {
+	*x = GetStatsResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatsResponse) ProtoMessage() {}
+
+func (x *GetStatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatsResponse.ProtoReflect.Descriptor instead.
+func (*GetStatsResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *GetStatsResponse) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *GetStatsResponse) GetStarted() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Started
+	}
+	return nil
+}
+
+func (x *GetStatsResponse) GetRequests() int64 {
+	if x != nil {
+		return x.Requests
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetInFlight() int64 {
+	if x != nil {
+		return x.InFlight
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetProcesses() int64 {
+	if x != nil {
+		return x.Processes
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetJobsQueued() int64 {
+	if x != nil {
+		return x.JobsQueued
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetJobsRunning() int64 {
+	if x != nil {
+		return x.JobsRunning
+	}
+	return 0
+}
+
+func (x *GetStatsResponse) GetDisabledScripts() []string {
+	if x != nil {
+		return x.DisabledScripts
+	}
+	return nil
+}
+
+func (x *GetStatsResponse) GetDraining() bool {
+	if x != nil {
+		return x.Draining
+	}
+	return false
+}
+
+var File_adminpb_admin_proto protoreflect.FileDescriptor
+
+const file_adminpb_admin_proto_rawDesc = "" +
+	"\n" +
+	"\x13adminpb/admin.proto\x12\x12cgiserver.admin.v1\x1a\x1fgoogle/protobuf/timestamp.proto\x1a\x1egoogle/protobuf/duration.proto\"\x16\n" +
+	"\x14ListProcessesRequest\"\x8a\x01\n" +
+	"\aProcess\x12\x10\n" +
+	"\x03pid\x18\x01 \x01(\x05R\x03pid\x12\x16\n" +
+	"\x06script\x18\x02 \x01(\tR\x06script\x12\x1f\n" +
+	"\vremote_addr\x18\x03 \x01(\tR\n" +
+	"remoteAddr\x124\n" +
+	"\astarted\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\astarted\"R\n" +
+	"\x15ListProcessesResponse\x129\n" +
+	"\tprocesses\x18\x01 \x03(\v2\x1b.cgiserver.admin.v1.ProcessR\tprocesses\"\x0e\n" +
+	"\fDrainRequest\"D\n" +
+	"\rDrainResponse\x123\n" +
+	"\aelapsed\x18\x01 \x01(\v2\x19.google.protobuf.DurationR\aelapsed\"\x15\n" +
+	"\x13ReloadConfigRequest\"2\n" +
+	"\x14ReloadConfigResponse\x12\x1a\n" +
+	"\breloaded\x18\x01 \x03(\tR\breloaded\"K\n" +
+	"\x17SetScriptEnabledRequest\x12\x16\n" +
+	"\x06script\x18\x01 \x01(\tR\x06script\x12\x18\n" +
+	"\aenabled\x18\x02 \x01(\bR\aenabled\"E\n" +
+	"\x18SetScriptEnabledResponse\x12)\n" +
+	"\x10disabled_scripts\x18\x01 \x03(\tR\x0fdisabledScripts\"\x11\n" +
+	"\x0fGetStatsRequest\"\xc4\x02\n" +
+	"\x10GetStatsResponse\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\tR\aversion\x124\n" +
+	"\astarted\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\astarted\x12\x1a\n" +
+	"\brequests\x18\x03 \x01(\x03R\brequests\x12\x1b\n" +
+	"\tin_flight\x18\x04 \x01(\x03R\binFlight\x12\x1c\n" +
+	"\tprocesses\x18\x05 \x01(\x03R\tprocesses\x12\x1f\n" +
+	"\vjobs_queued\x18\x06 \x01(\x03R\n" +
+	"jobsQueued\x12!\n" +
+	"\fjobs_running\x18\a \x01(\x03R\vjobsRunning\x12)\n" +
+	"\x10disabled_scripts\x18\b \x03(\tR\x0fdisabledScripts\x12\x1a\n" +
+	"\bdraining\x18\t \x01(\bR\bdraining2\xe4\x03\n" +
+	"\x05Admin\x12d\n" +
+	"\rListProcesses\x12(.cgiserver.admin.v1.ListProcessesRequest\x1a).cgiserver.admin.v1.ListProcessesResponse\x12L\n" +
+	"\x05Drain\x12 .cgiserver.admin.v1.DrainRequest\x1a!.cgiserver.admin.v1.DrainResponse\x12a\n" +
+	"\fReloadConfig\x12'.cgiserver.admin.v1.ReloadConfigRequest\x1a(.cgiserver.admin.v1.ReloadConfigResponse\x12m\n" +
+	"\x10SetScriptEnabled\x12+.cgiserver.admin.v1.SetScriptEnabledRequest\x1a,.cgiserver.admin.v1.SetScriptEnabledResponse\x12U\n" +
+	"\bGetStats\x12#.cgiserver.admin.v1.GetStatsRequest\x1a$.cgiserver.admin.v1.GetStatsResponseB)Z'github.com/fazalmajid/cgiserver/adminpbb\x06proto3"
+
+var (
+	file_adminpb_admin_proto_rawDescOnce sync.Once
+	file_adminpb_admin_proto_rawDescData []byte
+)
+
+func file_adminpb_admin_proto_rawDescGZIP() []byte {
+	file_adminpb_admin_proto_rawDescOnce.Do(func() {
+		file_adminpb_admin_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_adminpb_admin_proto_rawDesc), len(file_adminpb_admin_proto_rawDesc)))
+	})
+	return file_adminpb_admin_proto_rawDescData
+}
+
+var file_adminpb_admin_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
+var file_adminpb_admin_proto_goTypes = []any{
+	(*ListProcessesRequest)(nil),     // 0: cgiserver.admin.v1.ListProcessesRequest
+	(*Process)(nil),                  // 1: cgiserver.admin.v1.Process
+	(*ListProcessesResponse)(nil),    // 2: cgiserver.admin.v1.ListProcessesResponse
+	(*DrainRequest)(nil),             // 3: cgiserver.admin.v1.DrainRequest
+	(*DrainResponse)(nil),            // 4: cgiserver.admin.v1.DrainResponse
+	(*ReloadConfigRequest)(nil),      // 5: cgiserver.admin.v1.ReloadConfigRequest
+	(*ReloadConfigResponse)(nil),     // 6: cgiserver.admin.v1.ReloadConfigResponse
+	(*SetScriptEnabledRequest)(nil),  // 7: cgiserver.admin.v1.SetScriptEnabledRequest
+	(*SetScriptEnabledResponse)(nil), // 8: cgiserver.admin.v1.SetScriptEnabledResponse
+	(*GetStatsRequest)(nil),          // 9: cgiserver.admin.v1.GetStatsRequest
+	(*GetStatsResponse)(nil),         // 10: cgiserver.admin.v1.GetStatsResponse
+	(*timestamppb.Timestamp)(nil),    // 11: google.protobuf.Timestamp
+	(*durationpb.Duration)(nil),      // 12: google.protobuf.Duration
+}
+var file_adminpb_admin_proto_depIdxs = []int32{
+	11, // 0: cgiserver.admin.v1.Process.started:type_name -> google.protobuf.Timestamp
+	1,  // 1: cgiserver.admin.v1.ListProcessesResponse.processes:type_name -> cgiserver.admin.v1.Process
+	12, // 2: cgiserver.admin.v1.DrainResponse.elapsed:type_name -> google.protobuf.Duration
+	11, // 3: cgiserver.admin.v1.GetStatsResponse.started:type_name -> google.protobuf.Timestamp
+	0,  // 4: cgiserver.admin.v1.Admin.ListProcesses:input_type -> cgiserver.admin.v1.ListProcessesRequest
+	3,  // 5: cgiserver.admin.v1.Admin.Drain:input_type -> cgiserver.admin.v1.DrainRequest
+	5,  // 6: cgiserver.admin.v1.Admin.ReloadConfig:input_type -> cgiserver.admin.v1.ReloadConfigRequest
+	7,  // 7: cgiserver.admin.v1.Admin.SetScriptEnabled:input_type -> cgiserver.admin.v1.SetScriptEnabledRequest
+	9,  // 8: cgiserver.admin.v1.Admin.GetStats:input_type -> cgiserver.admin.v1.GetStatsRequest
+	2,  // 9: cgiserver.admin.v1.Admin.ListProcesses:output_type -> cgiserver.admin.v1.ListProcessesResponse
+	4,  // 10: cgiserver.admin.v1.Admin.Drain:output_type -> cgiserver.admin.v1.DrainResponse
+	6,  // 11: cgiserver.admin.v1.Admin.ReloadConfig:output_type -> cgiserver.admin.v1.ReloadConfigResponse
+	8,  // 12: cgiserver.admin.v1.Admin.SetScriptEnabled:output_type -> cgiserver.admin.v1.SetScriptEnabledResponse
+	10, // 13: cgiserver.admin.v1.Admin.GetStats:output_type -> cgiserver.admin.v1.GetStatsResponse
+	9,  // [9:14] is the sub-list for method output_type
+	4,  // [4:9] is the sub-list for method input_type
+	4,  // [4:4] is the sub-list for extension type_name
+	4,  // [4:4] is the sub-list for extension extendee
+	0,  // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_adminpb_admin_proto_init() }
+func file_adminpb_admin_proto_init() {
+	if File_adminpb_admin_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_adminpb_admin_proto_rawDesc), len(file_adminpb_admin_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   11,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_adminpb_admin_proto_goTypes,
+		DependencyIndexes: file_adminpb_admin_proto_depIdxs,
+		MessageInfos:      file_adminpb_admin_proto_msgTypes,
+	}.Build()
+	File_adminpb_admin_proto = out.File
+	file_adminpb_admin_proto_goTypes = nil
+	file_adminpb_admin_proto_depIdxs = nil
+}
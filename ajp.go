@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ajpUpstreams = flag.String("ajp", "", "Comma-separated list of extension-or-prefix=address AJP13 upstreams, e.g. /cgi-bin/servlets/=127.0.0.1:8009")
+
+// AJP13 packet types and constants, see
+// https://tomcat.apache.org/connectors-doc/ajp/ajpv13a.html
+const (
+	ajpForwardRequest = 2
+	ajpSendBodyChunk  = 3
+	ajpSendHeaders    = 4
+	ajpEndResponse    = 5
+	ajpGetBodyChunk   = 6
+	ajpMaxPacket      = 8192
+	ajpMaxChunk       = ajpMaxPacket - 6
+	ajpAttrQuery      = 0x05
+	ajpAttrMethod     = 0x0d
+	ajpAttrEnd        = 0xff
+	ajpMethodStored   = 0xff
+)
+
+// ajpMethods are the method codes defined by the protocol
+var ajpMethods = map[string]byte{
+	"OPTIONS": 1, "GET": 2, "HEAD": 3, "POST": 4, "PUT": 5, "DELETE": 6,
+	"TRACE": 7, "PROPFIND": 8, "PROPPATCH": 9, "MKCOL": 10, "COPY": 11,
+	"MOVE": 12, "LOCK": 13, "UNLOCK": 14, "ACL": 15, "REPORT": 16,
+}
+
+// ajpResponseHeaders maps the coded response header names
+var ajpResponseHeaders = map[uint16]string{
+	0xa001: "Content-Type", 0xa002: "Content-Language", 0xa003: "Content-Length",
+	0xa004: "Date", 0xa005: "Last-Modified", 0xa006: "Location",
+	0xa007: "Set-Cookie", 0xa008: "Set-Cookie2", 0xa009: "Servlet-Engine",
+	0xa00a: "Status", 0xa00b: "WWW-Authenticate",
+}
+
+// ajpPacket builds the payload of a packet sent to the container
+type ajpPacket []byte
+
+func (p *ajpPacket) byte(b byte) {
+	*p = append(*p, b)
+}
+
+func (p *ajpPacket) int(n int) {
+	*p = binary.BigEndian.AppendUint16(*p, uint16(n))
+}
+
+func (p *ajpPacket) bool(b bool) {
+	if b {
+		p.byte(1)
+	} else {
+		p.byte(0)
+	}
+}
+
+func (p *ajpPacket) string(s string) {
+	p.int(len(s))
+	*p = append(*p, s...)
+	p.byte(0)
+}
+
+// writeTo sends the packet with its 0x1234 magic and length
+func (p ajpPacket) writeTo(w io.Writer) error {
+	if len(p) > ajpMaxPacket-4 {
+		return errors.New("AJP packet too large")
+	}
+	header := [4]byte{0x12, 0x34}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(p)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+// ajpReader decodes the fields of a packet received from the container
+type ajpReader struct {
+	data []byte
+	err  error
+}
+
+func (ar *ajpReader) byte() byte {
+	if len(ar.data) < 1 {
+		ar.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	b := ar.data[0]
+	ar.data = ar.data[1:]
+	return b
+}
+
+func (ar *ajpReader) int() int {
+	if len(ar.data) < 2 {
+		ar.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	n := int(binary.BigEndian.Uint16(ar.data))
+	ar.data = ar.data[2:]
+	return n
+}
+
+func (ar *ajpReader) bytes(n int) []byte {
+	if len(ar.data) < n {
+		ar.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := ar.data[:n]
+	ar.data = ar.data[n:]
+	return b
+}
+
+func (ar *ajpReader) string() string {
+	n := ar.int()
+	if n == 0xffff {
+		return ""
+	}
+	s := string(ar.bytes(n))
+	ar.byte()
+	return s
+}
+
+// readAJPPacket reads a packet from the container, which starts with "AB"
+func readAJPPacket(r *bufio.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 'A' || header[1] != 'B' {
+		return nil, fmt.Errorf("invalid AJP packet magic %x", header[:2])
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	_, err := io.ReadFull(r, payload)
+	return payload, err
+}
+
+// serveAJP forwards a request to a servlet container using AJP13. Only the
+// whitelisted headers present in the sanitized environment are forwarded.
+func serveAJP(conn net.Conn, w http.ResponseWriter, r *http.Request, scriptPath string, env []string) error {
+	body, length, err := sizedBody(r)
+	if err != nil {
+		return err
+	}
+
+	serverName, serverPort := r.Host, 80
+	if r.TLS != nil {
+		serverPort = 443
+	}
+	if host, port, err := net.SplitHostPort(r.Host); err == nil {
+		serverName = host
+		if n, err := strconv.Atoi(port); err == nil {
+			serverPort = n
+		}
+	}
+
+	var p ajpPacket
+	p.byte(ajpForwardRequest)
+	method, known := ajpMethods[r.Method]
+	if !known {
+		method = ajpMethodStored
+	}
+	p.byte(method)
+	p.string(r.Proto)
+	uri, _, _ := strings.Cut(r.RequestURI, "?")
+	p.string(uri)
+	remoteAddr, _ := lookupEnv(env, "REMOTE_ADDR")
+	p.string(remoteAddr)
+	p.string(remoteAddr)
+	p.string(serverName)
+	p.int(serverPort)
+	p.bool(r.TLS != nil)
+
+	// Headers are taken from the HTTP_ variables, as for CGI scripts
+	var headers [][2]string
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		if header, ok := strings.CutPrefix(name, "HTTP_"); ok && header != "CONTENT_LENGTH" {
+			headers = append(headers, [2]string{strings.ToLower(strings.ReplaceAll(header, "_", "-")), value})
+		}
+	}
+	headers = append(headers, [2]string{"content-length", strconv.FormatInt(length, 10)})
+	p.int(len(headers))
+	for _, h := range headers {
+		p.string(h[0])
+		p.string(h[1])
+	}
+
+	if query, _ := lookupEnv(env, "QUERY_STRING"); query != "" {
+		p.byte(ajpAttrQuery)
+		p.string(query)
+	}
+	if !known {
+		p.byte(ajpAttrMethod)
+		p.string(r.Method)
+	}
+	p.byte(ajpAttrEnd)
+
+	bw := bufio.NewWriter(conn)
+	if err := p.writeTo(bw); err != nil {
+		return err
+	}
+
+	// The first body chunk is sent unsolicited, the rest on demand
+	remaining := length
+	sendChunk := func(max int) error {
+		chunk := make([]byte, min(int64(max), remaining, ajpMaxChunk))
+		if _, err := io.ReadFull(body, chunk); err != nil {
+			return fmt.Errorf("error reading request body: %v", err)
+		}
+		remaining -= int64(len(chunk))
+		var bp ajpPacket
+		if len(chunk) > 0 {
+			bp.int(len(chunk))
+			bp = append(bp, chunk...)
+		}
+		if err := bp.writeTo(bw); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+	if length > 0 {
+		if err := sendChunk(ajpMaxChunk); err != nil {
+			return err
+		}
+	} else if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(conn)
+	headersSent := false
+	for {
+		payload, err := readAJPPacket(br)
+		if err != nil {
+			return fmt.Errorf("error reading AJP response: %v", err)
+		}
+		ar := &ajpReader{data: payload}
+
+		switch packetType := ar.byte(); packetType {
+		case ajpSendHeaders:
+			if headersSent {
+				return errors.New("AJP headers sent after the response started")
+			}
+			status := ar.int()
+			if status < 100 || status > 999 {
+				return fmt.Errorf("invalid AJP status %d", status)
+			}
+			ar.string()
+			n := ar.int()
+			header := make(http.Header)
+			for i := 0; i < n && ar.err == nil; i++ {
+				var name string
+				if len(ar.data) >= 2 && ar.data[0] == 0xa0 {
+					name = ajpResponseHeaders[uint16(ar.int())]
+				} else {
+					name = ar.string()
+				}
+				value := ar.string()
+				if name != "" {
+					header.Add(name, value)
+				}
+			}
+			if ar.err != nil {
+				return fmt.Errorf("invalid AJP headers: %v", ar.err)
+			}
+			// Connection headers are the server's, as for scripts, and the
+			// body is relayed as it comes, so the container's length isn't
+			// trusted either
+			dropped := map[string]bool{"Content-Length": true}
+			for _, value := range header.Values("Connection") {
+				for _, name := range strings.Split(value, ",") {
+					dropped[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+				}
+			}
+			for name, values := range header {
+				if hopByHopHeaders[name] || dropped[name] {
+					continue
+				}
+				for _, value := range values {
+					w.Header().Add(name, value)
+				}
+			}
+			w.WriteHeader(status)
+			headersSent = true
+		case ajpSendBodyChunk:
+			chunk := ar.bytes(ar.int())
+			if ar.err != nil {
+				return fmt.Errorf("invalid AJP body chunk: %v", ar.err)
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+			headersSent = true
+		case ajpGetBodyChunk:
+			if err := sendChunk(ar.int()); err != nil {
+				return err
+			}
+		case ajpEndResponse:
+			if !headersSent {
+				return errors.New("AJP response ended without headers")
+			}
+			return nil
+		default:
+			return fmt.Errorf("unexpected AJP packet type %d", packetType)
+		}
+	}
+}
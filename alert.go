@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	alertSMTP         = flag.String("alert-smtp", "", "SMTP server, as host:port, to email alerts through when scripts keep failing")
+	alertSMTPUser     = flag.String("alert-smtp-user", "", "User to authenticate to the SMTP server as, if it requires it")
+	alertSMTPPassword = flag.String("alert-smtp-password", "", "Password to authenticate to the SMTP server with")
+	alertFrom         = flag.String("alert-from", "cgiserver@localhost", "Sender address of alert emails")
+	alertTo           = flag.String("alert-to", "", "Comma-separated list of addresses alert emails are sent to")
+	alertErrorRate    = flag.Float64("alert-error-rate", 0.5, "Fraction of a script's requests failing with 5xx within the window that raises an alert")
+	alertMinRequests  = flag.Int("alert-min-requests", 10, "Minimum number of requests to a script within the window before its error rate is considered")
+	alertWindow       = flag.Duration("alert-window", 5*time.Minute, "Window over which script error rates are measured")
+	alertInterval     = flag.Duration("alert-interval", time.Hour, "Minimum time between alert emails; alerts raised in between are sent together in the next one")
+)
+
+// scriptFailures counts the requests and failures of a script in the
+// current window
+type scriptFailures struct {
+	start    time.Time
+	requests int
+	failures int
+	alerted  bool
+}
+
+// failureAlert is a script whose error rate exceeded the threshold
+type failureAlert struct {
+	script   string
+	start    time.Time
+	requests int
+	failures int
+}
+
+var (
+	failuresMu     sync.Mutex
+	failures       = make(map[string]*scriptFailures)
+	pendingAlerts  []failureAlert
+	alertsPending  = make(chan struct{}, 1)
+	alertStartOnce sync.Once
+)
+
+// alertsEnabled tells whether failure alerts are configured
+func alertsEnabled() bool {
+	return *alertSMTP != "" && *alertTo != ""
+}
+
+// recordOutcome counts a request to a script, raising an alert the first
+// time in a window that its error rate exceeds the threshold
+func recordOutcome(scriptPath string, failed bool) {
+	now := time.Now()
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+	s := failures[scriptPath]
+	if s == nil || now.Sub(s.start) > *alertWindow {
+		s = &scriptFailures{start: now}
+		failures[scriptPath] = s
+	}
+	s.requests++
+	if failed {
+		s.failures++
+	}
+	if s.alerted || s.requests < *alertMinRequests || float64(s.failures) < *alertErrorRate*float64(s.requests) {
+		return
+	}
+	s.alerted = true
+	pendingAlerts = append(pendingAlerts, failureAlert{scriptPath, s.start, s.requests, s.failures})
+	alertStartOnce.Do(func() { go sendAlerts() })
+	select {
+	case alertsPending <- struct{}{}:
+	default:
+	}
+}
+
+// sendAlerts emails the pending alerts as they are raised, waiting at least
+// the alert interval between emails
+func sendAlerts() {
+	for range alertsPending {
+		failuresMu.Lock()
+		alerts := pendingAlerts
+		pendingAlerts = nil
+		failuresMu.Unlock()
+
+		if err := sendAlertEmail(alerts); err != nil {
+			log.Printf("Failed to send alert email: %v", err)
+		}
+		time.Sleep(*alertInterval)
+	}
+}
+
+// sendAlertEmail sends a digest of alerts
+func sendAlertEmail(alerts []failureAlert) error {
+	if len(alerts) == 0 {
+		return nil
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].script < alerts[j].script })
+	hostname, _ := os.Hostname()
+	to := strings.Split(*alertTo, ",")
+	for i := range to {
+		to[i] = strings.TrimSpace(to[i])
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", *alertFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: [cgiserver %s] Failing scripts: %d\r\n", hostname, len(alerts))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Scripts on %s failing with 5xx for at least %.0f%% of their requests:\r\n\r\n", hostname, *alertErrorRate*100)
+	for _, a := range alerts {
+		fmt.Fprintf(&msg, "%s: %d of %d requests failed since %s\r\n", a.script, a.failures, a.requests, a.start.Format(time.RFC3339))
+	}
+
+	var auth smtp.Auth
+	if *alertSMTPUser != "" {
+		host, _, _ := net.SplitHostPort(*alertSMTP)
+		auth = smtp.PlainAuth("", *alertSMTPUser, *alertSMTPPassword, host)
+	}
+	return smtp.SendMail(*alertSMTP, auth, *alertFrom, to, msg.Bytes())
+}
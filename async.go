@@ -0,0 +1,680 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	jobsPrefix   = flag.String("jobs-prefix", "", "URL prefix, e.g. /jobs/, of the endpoint reporting on asynchronous scripts; enables the async setting")
+	jobsDir      = flag.String("jobs-dir", "", "Directory keeping asynchronous jobs, so queued ones survive restarts; jobs are only kept in memory otherwise")
+	jobTimeout   = flag.Duration("job-timeout", time.Hour, "Maximum time an asynchronous script may run in the background")
+	maxJobs      = flag.Int("max-jobs", 8, "Maximum number of asynchronous scripts of the default queue running at once")
+	maxQueued    = flag.Int("max-queued-jobs", 1000, "Maximum number of asynchronous scripts waiting to run; further requests get 503")
+	jobQueues    = flag.String("job-queues", "", "Comma-separated list of name=N job queues, each running at most N scripts at once")
+	jobMaxOutput = flag.Int64("job-max-output", 10<<20, "Maximum size of the response of an asynchronous script kept for retrieval")
+	jobRetention = flag.Duration("job-retention", time.Hour, "How long the response of an asynchronous script is kept after it completes")
+)
+
+var (
+	// errJobTooLarge is returned when a job response exceeds -job-max-output
+	errJobTooLarge = errors.New("job response too large")
+
+	// errJobCancelled is the cause of the cancellation of cancelled jobs
+	errJobCancelled = errors.New("job cancelled")
+)
+
+func init() {
+	adminEndpoints["jobs"] = handleJobsAdmin
+}
+
+// Scripts with the async setting are run in the background: their requests
+// are answered at once with 202 Accepted and a Location under -jobs-prefix.
+// GET <prefix><id> reports the state of the job as JSON, once it is done
+// GET <prefix><id>/result returns the response of the script, and DELETE
+// <prefix><id> cancels it. Job IDs are random, so knowing one is what gives
+// access to its job. The admin endpoint "jobs" lists all jobs, and cancels
+// them when POSTed ?cancel=<id>.
+//
+// Jobs wait in the queue named by the queue setting, "default" otherwise,
+// until one of its -job-queues slots is free. With -jobs-dir, jobs are saved
+// as <id>.json, <id>.body and <id>.result files, and those that were queued
+// or running when the server stopped are run again when it restarts. The
+// script timeout still applies, so scripts running for long usually need a
+// longer timeout setting as well.
+
+// defaultQueue is the queue of scripts without a queue setting
+const defaultQueue = "default"
+
+// Job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// asyncJobKey is the context key marking the requests run as a job
+type asyncJobKey struct{}
+
+// jobState is what clients are told about a job
+type jobState struct {
+	ID       string     `json:"id"`
+	Script   string     `json:"script"`
+	Queue    string     `json:"queue"`
+	State    string     `json:"state"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Status   int        `json:"status,omitempty"`
+	Result   string     `json:"result,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// jobTarget is the script a job runs, as saved with it
+type jobTarget struct {
+	Tree        string `json:"tree"`
+	Root        string `json:"root"`
+	ScriptPath  string `json:"script_path"`
+	ScriptName  string `json:"script_name"`
+	PathInfo    string `json:"path_info,omitempty"`
+	RedirectURL string `json:"redirect_url,omitempty"`
+}
+
+// jobRequest is the request a job runs the script for, as saved with it
+type jobRequest struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	RequestURI string      `json:"request_uri"`
+	Host       string      `json:"host"`
+	RemoteAddr string      `json:"remote_addr"`
+	TLS        bool        `json:"tls,omitempty"`
+	Header     http.Header `json:"header"`
+}
+
+// jobWebhook is the webhook a job's request was verified as
+type jobWebhook struct {
+	Event string `json:"event"`
+}
+
+// asyncJob is a script waiting to run, running, or having run in the
+// background
+type asyncJob struct {
+	jobState
+	Target       jobTarget   `json:"target"`
+	Request      jobRequest  `json:"request"`
+	ResultHeader http.Header `json:"result_header,omitempty"`
+	Webhook      *jobWebhook `json:"webhook,omitempty"`
+
+	body     []byte
+	response *jobResponse
+	cancel   context.CancelCauseFunc
+}
+
+// jobQueue runs its jobs in order, a limited number at once
+type jobQueue struct {
+	limit   int
+	running int
+	pending []*asyncJob
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = make(map[string]*asyncJob)
+	queues = make(map[string]*jobQueue)
+	queued int
+)
+
+// parseJobQueues parses the -job-queues list
+func parseJobQueues(spec string) error {
+	queues[defaultQueue] = &jobQueue{limit: *maxJobs}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, limitText, ok := strings.Cut(item, "=")
+		limit, err := strconv.Atoi(limitText)
+		if !ok || name == "" || err != nil || limit <= 0 {
+			return fmt.Errorf("invalid job queue %q, expected name=N", item)
+		}
+		queues[name] = &jobQueue{limit: limit}
+	}
+	return nil
+}
+
+// validQueue checks a queue setting names a configured queue
+func validQueue(name string) error {
+	if _, ok := queues[name]; !ok && *jobsPrefix != "" {
+		return fmt.Errorf("unknown job queue %q", name)
+	}
+	return nil
+}
+
+// setupJobs registers the jobs endpoint and restores the saved jobs
+func setupJobs() error {
+	if err := parseJobQueues(*jobQueues); err != nil {
+		return err
+	}
+	if *jobsPrefix == "" {
+		return nil
+	}
+	if !strings.HasSuffix(*jobsPrefix, "/") {
+		*jobsPrefix += "/"
+	}
+	http.HandleFunc(*jobsPrefix, handleJob)
+	if *jobsDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(*jobsDir, 0700); err != nil {
+		return err
+	}
+	return loadJobs()
+}
+
+// loadJobs restores the jobs saved in the jobs directory, queueing again
+// those that had not completed
+func loadJobs() error {
+	paths, err := filepath.Glob(filepath.Join(*jobsDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	var restored []*asyncJob
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		job := &asyncJob{}
+		if err := json.Unmarshal(data, job); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if job.State == jobCancelled && job.Finished == nil {
+			// The server stopped while the script was being killed
+			now := time.Now().UTC()
+			job.Finished = &now
+			job.save()
+		}
+		if job.Finished != nil {
+			expiry := time.Until(job.Finished.Add(*jobRetention))
+			if expiry <= 0 {
+				job.remove()
+				continue
+			}
+			jobs[job.ID] = job
+			time.AfterFunc(expiry, job.expire)
+			continue
+		}
+		if job.body, err = os.ReadFile(job.file(".body")); err != nil {
+			return err
+		}
+		if queues[job.Queue] == nil {
+			log.Printf("Job %s moved from unknown queue %s to %s", job.ID, job.Queue, defaultQueue)
+			job.Queue = defaultQueue
+		}
+		job.State = jobQueued
+		job.Started = nil
+		restored = append(restored, job)
+	}
+
+	// Queue the jobs in the order they were created
+	sort.Slice(restored, func(i, j int) bool { return restored[i].Created.Before(restored[j].Created) })
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, job := range restored {
+		jobs[job.ID] = job
+		queues[job.Queue].pending = append(queues[job.Queue].pending, job)
+		queued++
+	}
+	if len(restored) > 0 {
+		log.Printf("Restored %d queued jobs from %s", len(restored), *jobsDir)
+	}
+	dispatchJobs()
+	return nil
+}
+
+// jobResponse keeps the response of a job, up to the size limit
+type jobResponse struct {
+	*bufferedResponse
+	truncated bool
+}
+
+func (jr *jobResponse) WriteHeader(status int) {
+	// Early hints have no use once the job is done
+	if !isInterim(status) {
+		jr.bufferedResponse.WriteHeader(status)
+	}
+}
+
+func (jr *jobResponse) Write(p []byte) (int, error) {
+	if int64(jr.body.Len()+len(p)) > *jobMaxOutput {
+		jr.truncated = true
+		return 0, errJobTooLarge
+	}
+	return jr.bufferedResponse.Write(p)
+}
+
+// startJob queues the script of an asynchronous request to run in the
+// background, answering the client with the location of the job. It returns
+// false for requests that are to be run right away, including dry runs and
+// environment captures, which must not run the script. Webhook requests are
+// verified before they are queued, so their job is run with the event found.
+func startJob(w http.ResponseWriter, r *http.Request, target cgiTarget, queue string, webhook bool, event string) bool {
+	if *jobsPrefix == "" || r.Context().Value(asyncJobKey{}) != nil {
+		return false
+	}
+	if *dryRun || r.Context().Value(envCaptureKey{}) != nil {
+		return false
+	}
+
+	// The script reads the body after the client is gone
+	body, err := io.ReadAll(io.LimitReader(r.Body, *maxBodySize+1))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		log.Printf("Error reading body of job for %s: %v", target.scriptPath, err)
+		return true
+	}
+	if int64(len(body)) > *maxBodySize {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		auditReject(r, auditBodyTooLarge, target.scriptPath)
+		return true
+	}
+
+	if queue == "" {
+		queue = defaultQueue
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	job := &asyncJob{
+		jobState: jobState{
+			ID:      hex.EncodeToString(id),
+			Script:  target.scriptName,
+			Queue:   queue,
+			State:   jobQueued,
+			Created: time.Now().UTC(),
+		},
+		Target: jobTarget{
+			Tree:        cgiRoot(r),
+			Root:        target.root,
+			ScriptPath:  target.scriptPath,
+			ScriptName:  target.scriptName,
+			PathInfo:    target.pathInfo,
+			RedirectURL: target.redirectURL,
+		},
+		Request: jobRequest{
+			Method:     r.Method,
+			URL:        r.URL.String(),
+			RequestURI: originalRequestURI(r),
+			Host:       r.Host,
+			RemoteAddr: r.RemoteAddr,
+			TLS:        r.TLS != nil,
+			Header:     r.Header,
+		},
+		body: body,
+	}
+	if webhook {
+		job.Webhook = &jobWebhook{Event: event}
+	}
+	if *jobsDir != "" {
+		if err := os.WriteFile(job.file(".body"), body, 0600); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Printf("Cannot save job for %s: %v", target.scriptPath, err)
+			return true
+		}
+	}
+
+	jobsMu.Lock()
+	if queued >= *maxQueued {
+		jobsMu.Unlock()
+		job.remove()
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too many jobs queued", http.StatusServiceUnavailable)
+		log.Printf("Refused job for %s: %d jobs queued", target.scriptPath, queued)
+		return true
+	}
+	jobs[job.ID] = job
+	queues[queue].pending = append(queues[queue].pending, job)
+	queued++
+	job.save()
+	state := job.jobState
+	dispatchJobs()
+	jobsMu.Unlock()
+
+	w.Header().Set("Location", *jobsPrefix+state.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(state)
+	log.Printf("Queued job %s for %s on %s", state.ID, target.scriptPath, queue)
+	return true
+}
+
+// dispatchJobs starts the queued jobs that have a free slot in their queue.
+// It is called with jobsMu held.
+func dispatchJobs() {
+	for _, q := range queues {
+		for q.running < q.limit && len(q.pending) > 0 {
+			job := q.pending[0]
+			q.pending = q.pending[1:]
+			q.running++
+			queued--
+
+			now := time.Now().UTC()
+			job.State = jobRunning
+			job.Started = &now
+			ctx, cancel := context.WithCancelCause(context.WithValue(context.Background(), asyncJobKey{}, job.ID))
+			job.cancel = cancel
+			job.save()
+
+			// Running jobs count as in flight so draining waits for them
+			inFlight.Add(1)
+			go job.run(ctx)
+		}
+	}
+}
+
+// rebase moves a path under one directory to the same place under another
+func rebase(path, from, to string) string {
+	rel, err := filepath.Rel(from, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return filepath.Join(to, rel)
+}
+
+// run runs the script of a job and keeps its response
+func (job *asyncJob) run(ctx context.Context) {
+	defer inFlight.Add(-1)
+	defer job.cancel(nil)
+	ctx, stop := context.WithTimeout(ctx, *jobTimeout)
+	defer stop()
+
+	// The job runs against the active tree, which may have been swapped
+	// since it was queued
+	tree := acquireTree()
+	defer tree.release()
+	target := cgiTarget{
+		root:        rebase(job.Target.Root, job.Target.Tree, tree.dir),
+		scriptPath:  rebase(job.Target.ScriptPath, job.Target.Tree, tree.dir),
+		scriptName:  job.Target.ScriptName,
+		pathInfo:    job.Target.PathInfo,
+		redirectURL: job.Target.RedirectURL,
+	}
+	ctx = context.WithValue(ctx, treeKey{}, tree)
+	if job.Webhook != nil {
+		ctx = context.WithValue(ctx, verifiedWebhookKey{}, job.Webhook.Event)
+	}
+
+	response := &jobResponse{bufferedResponse: newBufferedResponse()}
+	r, err := job.Request.request(ctx, job.body)
+	if err != nil {
+		http.Error(response, "Invalid request", http.StatusBadRequest)
+	} else {
+		serveScript(response, r, target)
+	}
+	if response.status == 0 {
+		response.status = http.StatusOK
+	}
+	if *jobsDir != "" && !response.truncated {
+		if err := os.WriteFile(job.file(".result"), response.body.Bytes(), 0600); err != nil {
+			log.Printf("Cannot save result of job %s: %v", job.ID, err)
+		}
+	}
+
+	now := time.Now().UTC()
+	jobsMu.Lock()
+	queues[job.Queue].running--
+	job.Finished = &now
+	job.Status = response.status
+	job.body = nil
+	switch {
+	case job.State == jobCancelled:
+	case response.truncated:
+		job.State = jobFailed
+		job.Error = errJobTooLarge.Error()
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		job.State = jobFailed
+		job.Error = "job timed out"
+	default:
+		job.State = jobDone
+		job.Result = *jobsPrefix + job.ID + "/result"
+		job.ResultHeader = response.header
+		job.response = response
+	}
+	job.save()
+	state := job.jobState
+	dispatchJobs()
+	jobsMu.Unlock()
+	log.Printf("Job %s for %s %s: status %d in %s", state.ID, target.scriptPath, state.State, state.Status, now.Sub(*state.Started).Round(time.Millisecond))
+
+	time.AfterFunc(*jobRetention, job.expire)
+}
+
+// request recreates the request of a job
+func (jr *jobRequest) request(ctx context.Context, body []byte) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, jr.Method, jr.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.RequestURI = jr.RequestURI
+	r.Host = jr.Host
+	r.RemoteAddr = jr.RemoteAddr
+	r.Header = jr.Header
+	if jr.TLS {
+		r.TLS = &tls.ConnectionState{}
+	}
+	return r, nil
+}
+
+// cancelJob cancels a queued or running job
+func cancelJob(id string) (jobState, error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	job := jobs[id]
+	if job == nil {
+		return jobState{}, fmt.Errorf("job %s not found", id)
+	}
+	switch job.State {
+	case jobQueued:
+		q := queues[job.Queue]
+		for i, pending := range q.pending {
+			if pending == job {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				break
+			}
+		}
+		queued--
+		now := time.Now().UTC()
+		job.State = jobCancelled
+		job.Finished = &now
+		job.body = nil
+		job.save()
+		time.AfterFunc(*jobRetention, job.expire)
+	case jobRunning:
+		// The job records its end once the script is killed
+		job.State = jobCancelled
+		job.cancel(errJobCancelled)
+	default:
+		return job.jobState, fmt.Errorf("job %s is already %s", id, job.State)
+	}
+	log.Printf("Cancelled job %s for %s", job.ID, job.Target.ScriptPath)
+	return job.jobState, nil
+}
+
+// file returns the path of a file of a saved job
+func (job *asyncJob) file(suffix string) string {
+	return filepath.Join(*jobsDir, job.ID+suffix)
+}
+
+// save writes the state of a job to the jobs directory, if there is one.
+// It is called with jobsMu held.
+func (job *asyncJob) save() {
+	if *jobsDir == "" {
+		return
+	}
+	data, err := json.Marshal(job)
+	if err == nil {
+		tmp := job.file(".json.tmp")
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, job.file(".json"))
+		}
+	}
+	if err != nil {
+		log.Printf("Cannot save job %s: %v", job.ID, err)
+	}
+}
+
+// remove deletes the files of a saved job
+func (job *asyncJob) remove() {
+	if *jobsDir == "" {
+		return
+	}
+	for _, suffix := range []string{".json", ".body", ".result"} {
+		os.Remove(job.file(suffix))
+	}
+}
+
+// expire forgets a job once its retention is over
+func (job *asyncJob) expire() {
+	jobsMu.Lock()
+	delete(jobs, job.ID)
+	jobsMu.Unlock()
+	job.remove()
+}
+
+// handleJob reports the state of a job, returns its result or cancels it
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	id, result := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, *jobsPrefix), "/result")
+	switch {
+	case r.Method == http.MethodDelete && !result:
+		state, err := cancelJob(id)
+		if err != nil {
+			status := http.StatusConflict
+			if state.ID == "" {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+		return
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jobsMu.Lock()
+	job := jobs[id]
+	var state jobState
+	var header http.Header
+	var response *jobResponse
+	if job != nil {
+		state, header, response = job.jobState, job.ResultHeader, job.response
+	}
+	jobsMu.Unlock()
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !result {
+		w.Header().Set("Content-Type", "application/json")
+		if state.Finished == nil {
+			w.Header().Set("Retry-After", "5")
+		}
+		json.NewEncoder(w).Encode(state)
+		return
+	}
+	if state.Finished == nil {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, fmt.Sprintf("Job %s is still %s", id, state.State), http.StatusConflict)
+		return
+	}
+	if state.Result == "" {
+		http.Error(w, fmt.Sprintf("Job %s %s: %s", id, state.State, state.Error), http.StatusBadGateway)
+		return
+	}
+
+	// Results of jobs restored from disk are read back when requested
+	var body []byte
+	if response != nil {
+		body = response.body.Bytes()
+	} else {
+		var err error
+		if body, err = os.ReadFile(job.file(".result")); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Printf("Cannot read result of job %s: %v", id, err)
+			return
+		}
+	}
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(state.Status)
+	w.Write(body)
+}
+
+// handleJobsAdmin lists the jobs, optionally only those in a given state or
+// queue, or cancels one when POSTed ?cancel=<id>
+func handleJobsAdmin(w http.ResponseWriter, r *http.Request) {
+	if *jobsPrefix == "" {
+		http.Error(w, "Asynchronous jobs are not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		state, err := cancelJob(r.URL.Query().Get("cancel"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+		return
+	}
+
+	wantState, wantQueue := r.URL.Query().Get("state"), r.URL.Query().Get("queue")
+	type queueStatus struct {
+		Limit   int `json:"limit"`
+		Running int `json:"running"`
+		Queued  int `json:"queued"`
+	}
+	var list struct {
+		Queues map[string]queueStatus `json:"queues"`
+		Jobs   []jobState             `json:"jobs"`
+	}
+	list.Queues = make(map[string]queueStatus)
+	list.Jobs = []jobState{}
+	jobsMu.Lock()
+	for name, q := range queues {
+		list.Queues[name] = queueStatus{q.limit, q.running, len(q.pending)}
+	}
+	for _, job := range jobs {
+		if (wantState == "" || job.State == wantState) && (wantQueue == "" || job.Queue == wantQueue) {
+			list.Jobs = append(list.Jobs, job.jobState)
+		}
+	}
+	jobsMu.Unlock()
+	sort.Slice(list.Jobs, func(i, j int) bool { return list.Jobs[i].Created.Before(list.Jobs[j].Created) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
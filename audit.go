@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+var auditLogPath = flag.String("audit-log", "", "File to append a JSON line to for every request rejected for security reasons and every admin request, with the client address and a reason code, or - for the server log")
+
+// Reason codes of the audit log
+const (
+	auditUnsafePath      = "unsafe_path"
+	auditTraversal       = "traversal"
+	auditBadExtension    = "bad_extension"
+	auditNotExecutable   = "not_executable"
+	auditSymlink         = "symlink_denied"
+	auditSuexec          = "suexec_denied"
+	auditIntegrity       = "integrity_failed"
+	auditSignature       = "signature_failed"
+	auditWebhook         = "webhook_signature_failed"
+	auditAuthFailed      = "auth_failed"
+	auditAdminAuthFailed = "admin_auth_failed"
+	auditInvalidEnv      = "invalid_env"
+	auditCookiesTooLarge = "cookies_too_large"
+	auditBodyTooLarge    = "body_too_large"
+	auditUploadRejected  = "upload_rejected"
+	auditTooManyHeaders  = "too_many_headers"
+	auditURLTooLong      = "url_too_long"
+
+	// auditAdminAction records an authenticated admin request rather than a
+	// rejection
+	auditAdminAction = "admin_action"
+)
+
+// auditLogger writes the audit log, if one is configured
+var auditLogger *log.Logger
+
+// auditEvent is a line of the audit log
+type auditEvent struct {
+	Time         time.Time `json:"time"`
+	ClientIP     string    `json:"client_ip"`
+	ForwardedFor string    `json:"forwarded_for,omitempty"`
+	Method       string    `json:"method"`
+	Host         string    `json:"host"`
+	URI          string    `json:"uri"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+	Admin        string    `json:"admin,omitempty"`
+	Reason       string    `json:"reason"`
+	Detail       string    `json:"detail,omitempty"`
+}
+
+// openAuditLog sets up the audit log
+func openAuditLog(path string) error {
+	if path == "-" {
+		auditLogger = log.Default()
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	auditLogger = log.New(f, "", 0)
+	return nil
+}
+
+// auditReject records a rejected request in the audit log, and counts
+// traversal attempts for notifications
+func auditReject(r *http.Request, reason, detail string) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if reason == auditTraversal || reason == auditUnsafePath {
+		countEvent("traversal", ip, *notifyTraversal, r.RequestURI)
+	}
+	writeAuditEvent(r, ip, "", reason, detail)
+}
+
+// auditAdmin records an admin request in the audit log, with the name of the
+// token it was authenticated with
+func auditAdmin(r *http.Request, admin string) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	writeAuditEvent(r, ip, admin, auditAdminAction, r.Method+" "+r.URL.Path)
+}
+
+// writeAuditEvent writes a line to the audit log, if there is one
+func writeAuditEvent(r *http.Request, ip, admin, reason, detail string) {
+	if auditLogger == nil {
+		return
+	}
+	data, err := json.Marshal(auditEvent{
+		Time:         time.Now().UTC(),
+		ClientIP:     ip,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		Method:       r.Method,
+		Host:         r.Host,
+		URI:          r.RequestURI,
+		UserAgent:    r.UserAgent(),
+		Admin:        admin,
+		Reason:       reason,
+		Detail:       detail,
+	})
+	if err != nil {
+		log.Printf("Cannot write audit event: %v", err)
+		return
+	}
+	auditLogger.Print(string(data))
+}
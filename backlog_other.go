@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// setBacklog fails, as the backlog of a listening socket can't be changed
+func setBacklog(ln *net.TCPListener, backlog int) error {
+	return fmt.Errorf("not supported on %s", runtime.GOOS)
+}
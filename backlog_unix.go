@@ -0,0 +1,26 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setBacklog changes the backlog of a listening socket by calling listen
+// again, which Go doesn't let us do when it is created
+func setBacklog(ln *net.TCPListener, backlog int) error {
+	raw, err := ln.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	err = raw.Control(func(fd uintptr) {
+		listenErr = unix.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
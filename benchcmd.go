@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	commands["bench"] = benchCommand
+}
+
+// spawnStatsKey is the context key of the spawnStats of benchmark requests
+type spawnStatsKey struct{}
+
+// spawnStats accumulates the time spent starting scripts
+type spawnStats struct {
+	mu    sync.Mutex
+	total time.Duration
+	count int
+}
+
+// recordSpawn adds the time taken to start a script to the request's
+// spawnStats, if it has any
+func recordSpawn(ctx context.Context, d time.Duration) {
+	if stats, ok := ctx.Value(spawnStatsKey{}).(*spawnStats); ok {
+		stats.mu.Lock()
+		stats.total += d
+		stats.count++
+		stats.mu.Unlock()
+	}
+}
+
+// percentile returns the p-th percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+// benchCommand sends concurrent requests for a script through the server's
+// handlers, in process, and reports their latency and the script start time:
+//
+//	cgiserver [flags] bench [-n N] [-c C] [-method M] [-data D] [-header "Name: value"]... script|/path
+func benchCommand(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	requests := flags.Int("n", 100, "Number of requests")
+	concurrency := flags.Int("c", 4, "Number of requests run concurrently")
+	var rf requestFlags
+	rf.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: cgiserver [flags] bench [-n N] [-c C] [-method M] [-data D] [-header \"Name: value\"]... script|/path")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *requests < 1 || *concurrency < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	body, err := rf.body()
+	if err != nil {
+		return err
+	}
+	if _, err := rf.request(flags.Arg(0), body); err != nil {
+		return err
+	}
+	handler := setupServer()
+
+	stats := &spawnStats{}
+	ctx := context.WithValue(context.Background(), spawnStatsKey{}, stats)
+	latencies := make([]time.Duration, *requests)
+	statuses := make([]int, *requests)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range next {
+				r, _ := rf.request(flags.Arg(0), body)
+				resp := newBufferedResponse()
+				begin := time.Now()
+				handler.ServeHTTP(resp, r.WithContext(ctx))
+				latencies[n] = time.Since(begin)
+				statuses[n] = resp.status
+				if statuses[n] == 0 {
+					statuses[n] = http.StatusOK
+				}
+			}
+		}()
+	}
+	for n := 0; n < *requests; n++ {
+		next <- n
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	counts := make(map[int]int)
+	for _, status := range statuses {
+		counts[status]++
+	}
+	codes := make([]int, 0, len(counts))
+	for code := range counts {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	for i := range latencies {
+		latencies[i] = latencies[i].Round(time.Microsecond)
+	}
+
+	fmt.Printf("Requests:     %d, %d concurrent\n", *requests, *concurrency)
+	fmt.Printf("Elapsed:      %s (%.1f requests/s)\n", elapsed.Round(time.Millisecond), float64(*requests)/elapsed.Seconds())
+	for _, code := range codes {
+		fmt.Printf("Status %d:   %d\n", code, counts[code])
+	}
+	fmt.Printf("Latency:      min %s, p50 %s, p90 %s, p99 %s, max %s\n",
+		latencies[0], percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+	if stats.count > 0 {
+		fmt.Printf("Script start: %s average over %d spawns\n", (stats.total / time.Duration(stats.count)).Round(time.Microsecond), stats.count)
+	}
+	return nil
+}
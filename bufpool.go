@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the size of the buffers used to copy bodies
+const copyBufferSize = 32 << 10
+
+// maxPooledOutput is the capacity above which output buffers are dropped
+// rather than returned to the pool, so one large response doesn't pin memory
+const maxPooledOutput = 1 << 20
+
+// copyBuffers recycles the buffers used to copy request and response bodies
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// outputBuffers recycles the buffers holding script output
+var outputBuffers = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// copyBuffered is io.Copy with a pooled buffer
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// getOutputBuffer returns an empty buffer from the pool
+func getOutputBuffer() *bytes.Buffer {
+	return outputBuffers.Get().(*bytes.Buffer)
+}
+
+// putOutputBuffer returns a buffer to the pool once its content is no
+// longer referenced
+func putOutputBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledOutput {
+		return
+	}
+	buf.Reset()
+	outputBuffers.Put(buf)
+}
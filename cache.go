@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	cacheSize     = flag.Int64("cache-size", 0, "Maximum size in bytes of the response cache (0 disables caching)")
+	cacheMaxEntry = flag.Int64("cache-max-entry-size", 1<<20, "Maximum size in bytes of a single cached response")
+	cacheTTL      = flag.Duration("cache-ttl", 0, "Default TTL for cached responses when no rule matches (0 disables)")
+	cacheRules    = flag.String("cache-rules", "", "Comma-separated list of path-prefix=ttl cache rules, e.g. /cgi-bin/report.cgi=5m")
+	purgeToken    = flag.String("cache-purge-token", "", "Bearer token required for PURGE requests (empty disables purging)")
+)
+
+// cacheStore holds cached responses, either in memory or in a shared backend
+type cacheStore interface {
+	get(key string) *cachedResponse
+	put(entry *cachedResponse)
+	purge(host, uri string, prefix bool) int
+}
+
+// cacheRule associates a TTL with a URL path prefix
+type cacheRule struct {
+	prefix string
+	ttl    time.Duration
+}
+
+// cachedResponse is a complete CGI response held in the cache
+type cachedResponse struct {
+	key          string
+	host         string
+	uri          string
+	status       int
+	header       http.Header
+	body         []byte
+	stored       time.Time
+	expires      time.Time
+	etag         string
+	lastModified time.Time
+
+	// vary is set on the placeholder entry stored under the plain request
+	// key for responses with a Vary header; the response itself is stored
+	// under a variant key derived from the listed request headers
+	vary []string
+}
+
+// size approximates the memory used by a cached response
+func (c *cachedResponse) size() int64 {
+	n := int64(len(c.key) + len(c.body))
+	for k, values := range c.header {
+		for _, v := range values {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+// cachePolicy decides how long responses for a path may be cached
+type cachePolicy struct {
+	rules    []cacheRule
+	fallback time.Duration
+}
+
+// responseCache is a size-bounded in-memory LRU cache of CGI responses
+type responseCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// newResponseCache creates a cache holding at most maxSize bytes
+func newResponseCache(maxSize int64) *responseCache {
+	return &responseCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// parseCacheRules parses a comma-separated list of prefix=ttl rules
+func parseCacheRules(spec string) ([]cacheRule, error) {
+	var rules []cacheRule
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, ttl, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid cache rule %q, expected prefix=ttl", item)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(ttl))
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL in cache rule %q: %v", item, err)
+		}
+		rules = append(rules, cacheRule{prefix: strings.TrimSpace(prefix), ttl: d})
+	}
+	return rules, nil
+}
+
+// ttlFor returns the TTL of the longest matching rule for a path
+func (p cachePolicy) ttlFor(path string) time.Duration {
+	ttl, best := p.fallback, -1
+	for _, rule := range p.rules {
+		if strings.HasPrefix(path, rule.prefix) && len(rule.prefix) > best {
+			ttl, best = rule.ttl, len(rule.prefix)
+		}
+	}
+	return ttl
+}
+
+// cacheKey identifies a cacheable request
+func cacheKey(r *http.Request) string {
+	return r.Method + " " + r.Host + " " + r.URL.RequestURI()
+}
+
+// get returns a fresh cached response, evicting it if it has expired
+func (c *responseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cachedResponse)
+	if time.Now().After(entry.expires) {
+		c.removeElement(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+// put stores a response, evicting least recently used entries as needed
+func (c *responseCache) put(entry *cachedResponse) {
+	size := entry.size()
+	if size > *cacheMaxEntry || size > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[entry.key]; ok {
+		c.removeElement(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += size
+
+	for c.size > c.maxSize {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// purge removes the entries for a host whose URI matches exactly, or starts
+// with the given prefix, and returns the number of entries removed
+func (c *responseCache) purge(host, uri string, prefix bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, elem := range c.entries {
+		entry := elem.Value.(*cachedResponse)
+		if entry.host != host {
+			continue
+		}
+		if entry.uri == uri || (prefix && strings.HasPrefix(entry.uri, uri)) {
+			c.removeElement(elem)
+			n++
+		}
+	}
+	return n
+}
+
+// removeElement drops an entry; the caller must hold the lock
+func (c *responseCache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cachedResponse)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+// cacheRecorder passes a response through to the client while keeping a copy
+type cacheRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	over   bool
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.status == 0 && !isInterim(status) {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *cacheRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if !rec.over {
+		if int64(rec.body.Len()+len(p)) > *cacheMaxEntry {
+			rec.over = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+func (rec *cacheRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// withCache serves GET responses from the cache, and stores successful
+// responses for the TTL configured for their path or specified by the script.
+// Cached responses carry an ETag and answer conditional requests with 304.
+// Responses setting cookies are never stored, and requests sending cookies
+// only share responses that vary on Cookie or are marked public.
+func withCache(c cacheStore, policy cachePolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PURGE" {
+			handlePurge(c, w, r)
+			return
+		}
+		// Authenticated responses are private to the user, and captured
+		// environments never come from or go to the cache
+		if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" || r.Context().Value(envCaptureKey{}) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ttl := policy.ttlFor(r.URL.Path)
+
+		key := cacheKey(r)
+		cookies := r.Header.Get("Cookie") != ""
+		entry := c.get(key)
+		varyCookie := false
+		if entry != nil && entry.vary != nil {
+			varyCookie = slices.Contains(entry.vary, "Cookie")
+			entry = c.get(variantKey(key, entry.vary, r))
+		}
+		if entry != nil && cookies && !varyCookie && !isPublic(entry.header) {
+			// The response may depend on the session of the user
+			next.ServeHTTP(w, r)
+			return
+		}
+		if entry != nil {
+			for k, values := range entry.header {
+				w.Header()[k] = values
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+			if notModified(r, entry) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		rec := &cacheRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status != http.StatusOK || rec.over || isEventStream(w.Header()) {
+			return
+		}
+		// Cookies set for one user must not be replayed to others
+		if len(w.Header().Values("Set-Cookie")) > 0 {
+			return
+		}
+
+		// Scripts can override the configured TTL or opt out of caching
+		header := w.Header().Clone()
+		now := time.Now()
+		if scriptTTL, ok := scriptFreshness(header, now); ok {
+			ttl = scriptTTL
+		}
+		if ttl <= 0 {
+			return
+		}
+
+		// Responses that vary on request headers are stored per variant
+		vary, ok := parseVary(header)
+		if !ok {
+			return
+		}
+		if cookies && !slices.Contains(vary, "Cookie") && !isPublic(header) {
+			return
+		}
+		if len(vary) > 0 {
+			c.put(&cachedResponse{
+				key:     key,
+				host:    r.Host,
+				uri:     r.URL.RequestURI(),
+				stored:  now,
+				expires: now.Add(ttl),
+				vary:    vary,
+			})
+			key = variantKey(key, vary, r)
+		}
+
+		header.Del("X-Cache")
+		header.Del("Date")
+		body := bytes.Clone(rec.body.Bytes())
+		entry = &cachedResponse{
+			key:          key,
+			host:         r.Host,
+			uri:          r.URL.RequestURI(),
+			status:       rec.status,
+			header:       header,
+			body:         body,
+			stored:       now,
+			expires:      now.Add(ttl),
+			etag:         header.Get("ETag"),
+			lastModified: now,
+		}
+		if entry.etag == "" {
+			sum := sha256.Sum256(body)
+			entry.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+			header.Set("ETag", entry.etag)
+		}
+		if lm, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+			entry.lastModified = lm
+		} else {
+			header.Set("Last-Modified", now.UTC().Format(http.TimeFormat))
+		}
+		c.put(entry)
+	})
+}
+
+// handlePurge evicts cached entries for the request URL. A trailing * in the
+// path purges every entry whose URL starts with the preceding prefix.
+func handlePurge(c cacheStore, w http.ResponseWriter, r *http.Request) {
+	if *purgeToken == "" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(*purgeToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		log.Printf("Rejected unauthorized PURGE from %s: %s", r.RemoteAddr, r.URL.Path)
+		auditReject(r, auditAdminAuthFailed, "purge")
+		return
+	}
+
+	uri := r.URL.RequestURI()
+	prefix := false
+	if strings.HasSuffix(r.URL.Path, "*") && r.URL.RawQuery == "" {
+		uri = strings.TrimSuffix(r.URL.Path, "*")
+		prefix = true
+	}
+
+	n := c.purge(r.Host, uri, prefix)
+	log.Printf("Purged %d cache entries for %s%s", n, r.Host, r.URL.RequestURI())
+	fmt.Fprintf(w, "Purged %d entries\n", n)
+}
+
+// parseVary returns the canonical names of the request headers listed in the
+// Vary response header. It returns false for "Vary: *", which is uncacheable.
+func parseVary(header http.Header) ([]string, bool) {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" && !slices.Contains(names, http.CanonicalHeaderKey(name)) {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// variantKey derives the cache key of the variant selected by the request's
+// values for the headers a response varies on
+func variantKey(key string, vary []string, r *http.Request) string {
+	h := sha256.New()
+	for _, name := range vary {
+		fmt.Fprintf(h, "%s:%s\n", name, strings.Join(r.Header.Values(name), ","))
+	}
+	return key + "#" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// isPublic tells whether a script marked its response as public
+func isPublic(header http.Header) bool {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "public") {
+			return true
+		}
+	}
+	return false
+}
+
+// scriptFreshness derives a TTL from the Cache-Control and Expires headers
+// emitted by a script. It returns false if the script did not specify one.
+func scriptFreshness(header http.Header, now time.Time) (time.Duration, bool) {
+	if cc := header.Get("Cache-Control"); cc != "" {
+		maxAge, sMaxAge := -1, -1
+		for _, directive := range strings.Split(cc, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache", "private":
+				return 0, true
+			case "max-age":
+				if n, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+					maxAge = n
+				}
+			case "s-maxage":
+				if n, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+					sMaxAge = n
+				}
+			}
+		}
+		// s-maxage applies to shared caches such as this one
+		if sMaxAge >= 0 {
+			return time.Duration(sMaxAge) * time.Second, true
+		}
+		if maxAge >= 0 {
+			return time.Duration(maxAge) * time.Second, true
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// Invalid dates such as "0" mean already expired
+			return 0, true
+		}
+		return t.Sub(now), true
+	}
+
+	return 0, false
+}
+
+// notModified evaluates the request's conditional headers against a cached
+// response. If-None-Match takes precedence over If-Modified-Since.
+func notModified(r *http.Request, entry *cachedResponse) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(entry.etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err == nil && !entry.lastModified.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+
+	return false
+}
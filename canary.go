@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	canaryRules  = flag.String("canary", "", "Comma-separated list of script=alternate:percent rules sending a share of a script's traffic to another version, e.g. app.cgi=app_v2.cgi:5")
+	canarySticky = flag.String("canary-sticky", "ip", "How clients are assigned to canary versions: ip, or cookie")
+	canaryCookie = flag.String("canary-cookie", "cgiserver_canary", "Name of the cookie holding the client's canary assignment")
+)
+
+// canaryRule sends a percentage of the traffic for a script to an alternate
+type canaryRule struct {
+	alternate string
+	percent   float64
+}
+
+// canaries maps script paths, relative to the CGI directory, to their canary
+// rule
+var canaries map[string]canaryRule
+
+// parseCanaryRules parses the -canary flag, with scripts relative to the CGI
+// directory
+func parseCanaryRules(spec string) (map[string]canaryRule, error) {
+	rules := make(map[string]canaryRule)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		script, rest, ok1 := strings.Cut(item, "=")
+		alternate, weight, ok2 := strings.Cut(rest, ":")
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(weight, "%"), 64)
+		if !ok1 || !ok2 || err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid canary rule %q, expected script=alternate:percent", item)
+		}
+		if !isPathSafe(script) || !isPathSafe(alternate) {
+			return nil, fmt.Errorf("invalid canary scripts in %q", item)
+		}
+		rules[filepath.Clean(script)] = canaryRule{
+			alternate: filepath.Clean(alternate),
+			percent:   percent,
+		}
+	}
+	switch *canarySticky {
+	case "ip", "cookie":
+	default:
+		return nil, fmt.Errorf("unknown canary stickiness %q", *canarySticky)
+	}
+	return rules, nil
+}
+
+// canaryClient returns the key a client is assigned by, setting a cookie for
+// new clients when assignment is by cookie
+func canaryClient(w http.ResponseWriter, r *http.Request) string {
+	if *canarySticky == "cookie" {
+		if c, err := r.Cookie(*canaryCookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+		id := make([]byte, 16)
+		rand.Read(id)
+		value := hex.EncodeToString(id)
+		http.SetCookie(w, &http.Cookie{
+			Name:     *canaryCookie,
+			Value:    value,
+			Path:     "/",
+			MaxAge:   30 * 24 * 3600,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return value
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// routeCanary switches a request to the alternate version of its script when
+// the client falls within the canary percentage. A client always lands in the
+// same bucket for a given script. The response varies on the cookie clients
+// are assigned by, or on the client address, which caches can't key on.
+func routeCanary(w http.ResponseWriter, r *http.Request, target cgiTarget) cgiTarget {
+	if len(canaries) == 0 || target.root != cgiRoot(r) {
+		return target
+	}
+	rel, err := filepath.Rel(filepath.Clean(target.root), filepath.Clean(target.scriptPath))
+	if err != nil {
+		return target
+	}
+	rule, ok := canaries[rel]
+	if !ok || rule.percent == 0 {
+		return target
+	}
+	if *canarySticky == "cookie" {
+		w.Header().Add("Vary", "Cookie")
+	} else {
+		w.Header().Add("Vary", "*")
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(rel))
+	h.Write([]byte{0})
+	h.Write([]byte(canaryClient(w, r)))
+	if float64(h.Sum32()%10000) < rule.percent*100 {
+		log.Printf("Canary: %s served by %s", target.scriptPath, rule.alternate)
+		target.scriptPath = filepath.Join(target.root, rule.alternate)
+	}
+	return target
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// certReloader serves the certificate from a cert/key file pair, reloading
+// it when the files change or on SIGHUP, so certificates rotated by an
+// external agent are used by the next handshakes without a restart
+type certReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// newCertReloader loads a certificate and starts watching its files
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			cr.reloadLogged("SIGHUP")
+		}
+	}()
+	if err := cr.watch(); err != nil {
+		log.Printf("Cannot watch TLS certificate files, reload them with SIGHUP: %v", err)
+	}
+	return cr, nil
+}
+
+// reload loads the certificate, keeping the current one if that fails
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert.Store(&cert)
+	return nil
+}
+
+// reloadLogged reloads the certificate and logs the outcome
+func (cr *certReloader) reloadLogged(reason string) {
+	if err := cr.reload(); err != nil {
+		log.Printf("TLS certificate reload after %s failed, keeping the current one: %v", reason, err)
+		return
+	}
+	log.Printf("Reloaded TLS certificate %s after %s, valid until %s", cr.certFile, reason, cr.cert.Load().Leaf.NotAfter.Format(time.RFC3339))
+}
+
+// watch reloads the certificate when its files change. The directories are
+// watched, as agents usually replace the files by renaming new ones over
+// them. Changes are batched, since the certificate and key are rarely
+// replaced at exactly the same time.
+func (cr *certReloader) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := map[string]bool{filepath.Dir(cr.certFile): true, filepath.Dir(cr.keyFile): true}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		var pending <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if dirs[filepath.Dir(event.Name)] && !event.Has(fsnotify.Chmod) {
+					pending = time.After(time.Second)
+				}
+			case <-pending:
+				pending = nil
+				cr.reloadLogged("file change")
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("TLS certificate watcher error: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// getCertificate returns the current certificate for a handshake
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.cert.Load(), nil
+}
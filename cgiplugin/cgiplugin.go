@@ -0,0 +1,230 @@
+// Package cgiplugin defines the interfaces of cgiserver plugins, which run as
+// separate processes and talk to the server over hashicorp/go-plugin, so
+// extending the server doesn't require recompiling it.
+//
+// A plugin is a program serving one or more of the interfaces:
+//
+//	func main() {
+//		plugin.Serve(&plugin.ServeConfig{
+//			HandshakeConfig: cgiplugin.Handshake,
+//			Plugins: plugin.PluginSet{
+//				cgiplugin.RequestFilterName: &cgiplugin.RequestFilterPlugin{Impl: myFilter{}},
+//			},
+//		})
+//	}
+//
+// and is listed in the -plugins file of the server with the interface it is
+// used for.
+package cgiplugin
+
+import (
+	"net/rpc"
+
+	"github.com/hashicorp/go-plugin"
+)
+
+// Handshake is shared by the server and its plugins, so that plugins refuse
+// to run on their own and incompatible versions are detected
+var Handshake = plugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "CGISERVER_PLUGIN",
+	MagicCookieValue: "d3b07384d113edec49eaa6238ad5ff00",
+}
+
+// Names of the plugin interfaces, as used in the -plugins file
+const (
+	RequestFilterName  = "request-filter"
+	AuthProviderName   = "auth"
+	EnvMutatorName     = "env"
+	ResponseFilterName = "response-filter"
+)
+
+// Request describes a request to a script
+type Request struct {
+	Method     string
+	URL        string
+	Host       string
+	RemoteAddr string
+	Script     string
+	Header     map[string][]string
+}
+
+// Response is a complete response
+type Response struct {
+	Status int
+	Header map[string][]string
+	Body   []byte
+}
+
+// RequestFilter is consulted before a script runs. Returning a response
+// answers the request with it instead of running the script; returning nil
+// lets the request through.
+type RequestFilter interface {
+	FilterRequest(req Request) (*Response, error)
+}
+
+// AuthProvider authenticates requests to scripts, returning the user, passed
+// to the script as REMOTE_USER, and whether the request may proceed.
+// Refused requests are answered with 401.
+type AuthProvider interface {
+	Authenticate(req Request) (user string, ok bool, err error)
+}
+
+// EnvMutator edits the environment of a script, given as NAME=value
+// strings, just before it runs
+type EnvMutator interface {
+	MutateEnv(req Request, env []string) ([]string, error)
+}
+
+// ResponseFilter edits the response of a script before it is sent. The
+// response is buffered in full, so filtered scripts can't stream.
+type ResponseFilter interface {
+	FilterResponse(req Request, resp Response) (Response, error)
+}
+
+// RequestFilterPlugin serves or dispenses a RequestFilter
+type RequestFilterPlugin struct {
+	Impl RequestFilter
+}
+
+func (p *RequestFilterPlugin) Server(*plugin.MuxBroker) (interface{}, error) {
+	return &requestFilterServer{p.Impl}, nil
+}
+
+func (p *RequestFilterPlugin) Client(b *plugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &requestFilterClient{c}, nil
+}
+
+// FilterResult is the reply of FilterRequest
+type FilterResult struct {
+	Response *Response
+}
+
+type requestFilterServer struct{ impl RequestFilter }
+
+func (s *requestFilterServer) FilterRequest(req Request, result *FilterResult) error {
+	var err error
+	result.Response, err = s.impl.FilterRequest(req)
+	return err
+}
+
+type requestFilterClient struct{ client *rpc.Client }
+
+func (c *requestFilterClient) FilterRequest(req Request) (*Response, error) {
+	var result FilterResult
+	err := c.client.Call("Plugin.FilterRequest", req, &result)
+	return result.Response, err
+}
+
+// AuthProviderPlugin serves or dispenses an AuthProvider
+type AuthProviderPlugin struct {
+	Impl AuthProvider
+}
+
+func (p *AuthProviderPlugin) Server(*plugin.MuxBroker) (interface{}, error) {
+	return &authProviderServer{p.Impl}, nil
+}
+
+func (p *AuthProviderPlugin) Client(b *plugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &authProviderClient{c}, nil
+}
+
+// AuthResult is the reply of Authenticate
+type AuthResult struct {
+	User string
+	OK   bool
+}
+
+type authProviderServer struct{ impl AuthProvider }
+
+func (s *authProviderServer) Authenticate(req Request, result *AuthResult) error {
+	var err error
+	result.User, result.OK, err = s.impl.Authenticate(req)
+	return err
+}
+
+type authProviderClient struct{ client *rpc.Client }
+
+func (c *authProviderClient) Authenticate(req Request) (string, bool, error) {
+	var result AuthResult
+	err := c.client.Call("Plugin.Authenticate", req, &result)
+	return result.User, result.OK, err
+}
+
+// EnvMutatorPlugin serves or dispenses an EnvMutator
+type EnvMutatorPlugin struct {
+	Impl EnvMutator
+}
+
+func (p *EnvMutatorPlugin) Server(*plugin.MuxBroker) (interface{}, error) {
+	return &envMutatorServer{p.Impl}, nil
+}
+
+func (p *EnvMutatorPlugin) Client(b *plugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &envMutatorClient{c}, nil
+}
+
+// EnvArgs are the arguments of MutateEnv
+type EnvArgs struct {
+	Request Request
+	Env     []string
+}
+
+type envMutatorServer struct{ impl EnvMutator }
+
+func (s *envMutatorServer) MutateEnv(args EnvArgs, env *[]string) error {
+	var err error
+	*env, err = s.impl.MutateEnv(args.Request, args.Env)
+	return err
+}
+
+type envMutatorClient struct{ client *rpc.Client }
+
+func (c *envMutatorClient) MutateEnv(req Request, env []string) ([]string, error) {
+	var result []string
+	err := c.client.Call("Plugin.MutateEnv", EnvArgs{req, env}, &result)
+	return result, err
+}
+
+// ResponseFilterPlugin serves or dispenses a ResponseFilter
+type ResponseFilterPlugin struct {
+	Impl ResponseFilter
+}
+
+func (p *ResponseFilterPlugin) Server(*plugin.MuxBroker) (interface{}, error) {
+	return &responseFilterServer{p.Impl}, nil
+}
+
+func (p *ResponseFilterPlugin) Client(b *plugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &responseFilterClient{c}, nil
+}
+
+// ResponseArgs are the arguments of FilterResponse
+type ResponseArgs struct {
+	Request  Request
+	Response Response
+}
+
+type responseFilterServer struct{ impl ResponseFilter }
+
+func (s *responseFilterServer) FilterResponse(args ResponseArgs, resp *Response) error {
+	var err error
+	*resp, err = s.impl.FilterResponse(args.Request, args.Response)
+	return err
+}
+
+type responseFilterClient struct{ client *rpc.Client }
+
+func (c *responseFilterClient) FilterResponse(req Request, resp Response) (Response, error) {
+	var result Response
+	err := c.client.Call("Plugin.FilterResponse", ResponseArgs{req, resp}, &result)
+	return result, err
+}
+
+// PluginSet has every interface, for the server to dispense plugins from
+var PluginSet = plugin.PluginSet{
+	RequestFilterName:  &RequestFilterPlugin{},
+	AuthProviderName:   &AuthProviderPlugin{},
+	EnvMutatorName:     &EnvMutatorPlugin{},
+	ResponseFilterName: &ResponseFilterPlugin{},
+}
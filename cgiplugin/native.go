@@ -0,0 +1,21 @@
+package cgiplugin
+
+// Plugins can also be Go plugins, built with -buildmode=plugin and loaded
+// into the server with -go-plugins, for extensions that need to run in
+// process. A Go plugin exports either or both of:
+//
+//	// Middleware wraps the handler of every request, other than admin ones
+//	func Middleware(next http.Handler) http.Handler
+//
+//	// Routes registers handlers alongside the scripts
+//	func Routes(mux *http.ServeMux)
+//
+// Go plugins must be built with the same Go version and the same versions of
+// any package they share with the server, and need a server built with cgo
+// on Linux, FreeBSD or macOS.
+
+// Names of the symbols looked up in Go plugins
+const (
+	MiddlewareSymbol = "Middleware"
+	RoutesSymbol     = "Routes"
+)
@@ -22,29 +22,33 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
 )
 
 var (
-	port              = flag.Int("port", 8080, "Port to listen on")
+	port              = flag.Int("port", 8080, "Port to listen on (deprecated, use -listen)")
 	cgiDir            = flag.String("cgi-dir", "./cgi-bin", "Directory containing CGI scripts")
 	cgiPrefix         = flag.String("cgi-prefix", "/cgi-bin/", "URL prefix for CGI scripts")
 	maxEnvSize        = flag.Int("max-env-size", 4096, "Maximum size for environment variables")
 	scriptTimeout     = flag.Duration("script-timeout", 30*time.Second, "Timeout for CGI script execution")
 	allowedExtensions = flag.String("allowed-extensions", ".cgi", "Comma-separated list of allowed script extensions")
+	decompressBody    = flag.Bool("decompress-body", false, "Decompress gzip-encoded request bodies before passing them to scripts")
+	maxBodySize       = flag.Int64("max-decompressed-size", 10<<20, "Maximum size of a decompressed or buffered request body")
+	redirectStatus    = flag.String("redirect-status", "200", "Value of REDIRECT_STATUS for scripts, which php-cgi built with force-cgi-redirect requires, or empty to leave it unset")
 )
 
 // Define a whitelist of allowed HTTP headers to pass to CGI scripts
@@ -64,56 +68,696 @@ var allowedHeaders = map[string]bool{
 }
 
 func main() {
+	// Pre-forked helpers exec scripts on behalf of the server
+	if os.Getenv(spawnHelperEnv) == "1" {
+		runSpawnHelper()
+		return
+	}
+
 	flag.Parse()
+	if *showVersion {
+		printVersion()
+		return
+	}
 
-	// Create CGI handler
-	cgiHandler := http.StripPrefix(*cgiPrefix, http.HandlerFunc(handleCGI))
+	// Subcommands use the same configuration as the server
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Arg(0), flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "cgiserver %s: %v\n", flag.Arg(0), err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Setup routing
-	http.Handle(*cgiPrefix, cgiHandler)
+	// Under the Windows service manager, log to the event log from the start
+	asService := startedAsService()
+
+	if *pidFile != "" {
+		if err := writePidFile(*pidFile); err != nil {
+			log.Fatalf("Cannot write pidfile: %v", err)
+		}
+	}
+
+	handler := setupServer()
+
+	// Start the out-of-process plugins
+	if *pluginsFile != "" {
+		if err := loadPlugins(*pluginsFile); err != nil {
+			stopPlugins()
+			log.Fatalf("Failed to start plugins: %v", err)
+		}
+	}
+
+	// Serve the control plane
+	if *grpcSocket != "" {
+		if err := startGRPC(*grpcSocket); err != nil {
+			log.Fatalf("Cannot serve gRPC control plane: %v", err)
+		}
+	}
+	if *adminListen != "" {
+		if !adminEnabled() {
+			log.Fatalf("Invalid configuration: -admin-listen requires -admin-token or -admin-tokens")
+		}
+		if err := startAdminListener(*adminListen); err != nil {
+			log.Fatalf("Cannot listen for admin requests: %v", err)
+		}
+	}
+
+	// Run scripts on their schedule
+	if *scheduleFile != "" {
+		jobs, err := loadSchedule(*scheduleFile)
+		if err != nil {
+			log.Fatalf("Failed to load schedule: %v", err)
+		}
+		startScheduler(jobs, handler)
+		log.Printf("Loaded %d scheduled jobs from %s", len(jobs), *scheduleFile)
+	}
 
 	// Start server
-	addr := fmt.Sprintf(":%d", *port)
-	log.Printf("Starting secure CGI server on http://localhost%s", addr)
+	ln, err := listen()
+	if err != nil {
+		log.Fatalf("Cannot listen: %v", err)
+	}
+	scheme := "http"
+	server := newServer(handler)
+	drainServer = server
+	if tlsEnabled() {
+		if server.TLSConfig, err = newTLSConfig(); err != nil {
+			log.Fatalf("Cannot load TLS certificate: %v", err)
+		}
+		scheme = "https"
+		if *httpRedirect != "" {
+			if err := startRedirectListener(*httpRedirect); err != nil {
+				log.Fatalf("Cannot listen for HTTP redirects: %v", err)
+			}
+		}
+	} else if *httpRedirect != "" {
+		log.Fatalf("Invalid configuration: -http-redirect requires TLS")
+	}
+	log.Printf("Starting secure CGI server %s on %s://%s (listening on %s)", buildVersion(), scheme, serverHost(), ln.Addr())
 	log.Printf("CGI scripts directory: %s", *cgiDir)
 	log.Printf("CGI URL prefix: %s", *cgiPrefix)
 	log.Printf("Script timeout: %s", *scriptTimeout)
 
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if asService {
+		err := runService(server, ln)
+		stopPlugins()
+		if err != nil {
+			log.Fatalf("Service failed: %v", err)
+		}
+		return
+	}
+	go drainOnSignal()
+	if err := serve(server, ln); err != http.ErrServerClosed {
 		log.Fatalf("Server failed: %v", err)
 	}
+	waitDrained()
+	stopPlugins()
+	log.Printf("Server drained, exiting")
+}
+
+// setupServer applies the configuration and returns the handler serving all
+// requests
+func setupServer() http.Handler {
+	applySlowlorisDefaults()
+
+	// Select how scripts are started
+	switch *execBackend {
+	case "fork":
+	case "prefork":
+		spawnPool = newPreforkPool(*preforkSize)
+	default:
+		log.Fatalf("Unknown exec backend: %s", *execBackend)
+	}
+
+	// Periodically purge the script metadata cache
+	if *statCacheTTL > 0 {
+		go expireStatCache()
+	}
+
+	if err := validateSymlinkPolicy(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := validateInterpreters(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := parseSanitizeRules(*sanitizeRules); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := validateCookieOverflow(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := validateCSP(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if *envRulesFile != "" {
+		if err := reloadEnvRules(); err != nil {
+			log.Fatalf("Failed to load environment rules: %v", err)
+		}
+	}
+	if *strictCGI && *lenientCGI {
+		log.Fatalf("Invalid configuration: -strict-cgi and -lenient-cgi are mutually exclusive")
+	}
+	rules, err := parseCanaryRules(*canaryRules)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	canaries = rules
+	if abRoutes, err = parseABRules(*abRules); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if *notFoundScript != "" && !isPathSafe(*notFoundScript) {
+		log.Fatalf("Invalid configuration: unsafe not-found script %q", *notFoundScript)
+	}
+
+	currentTree = newCGITree(*cgiDir)
+
+	// Load the keys scripts must be signed with
+	if *signingKeys != "" {
+		keys, err := loadKeyring(*signingKeys)
+		if err != nil {
+			log.Fatalf("Cannot load signing keys: %v", err)
+		}
+		trustedKeys = keys
+	}
+
+	// Load the script integrity manifest
+	if *integrityManifest != "" {
+		hashes, err := loadIntegrityManifest(*integrityManifest, *cgiDir)
+		if err != nil {
+			log.Fatalf("Cannot load integrity manifest: %v", err)
+		}
+		pinHashes(hashes)
+		log.Printf("Loaded %d script hashes from %s", len(hashes), *integrityManifest)
+	}
+
+	// Watch the CGI directory for changes
+	if *watchCGIDir {
+		if err := startWatcher(*cgiDir); err != nil {
+			log.Fatalf("Cannot watch CGI directory: %v", err)
+		}
+	}
+
+	// Keep a git checkout of the CGI directory up to date
+	if *gitPullInterval > 0 || *gitWebhook != "" {
+		if err := startGitDeploy(); err != nil {
+			log.Fatalf("Cannot deploy CGI directory from git: %v", err)
+		}
+	}
+
+	// Configure upstream application servers
+	if err := configureUpstreams(); err != nil {
+		log.Fatalf("Invalid upstream configuration: %v", err)
+	}
+
+	// Create CGI handler
+	var cgiHandler http.Handler = http.StripPrefix(*cgiPrefix, http.HandlerFunc(handleCGI))
+
+	// Create front controllers, aliases and method routes
+	routes, err := parseFrontControllers(*frontControllers)
+	if err != nil {
+		log.Fatalf("Invalid front controllers: %v", err)
+	}
+	if err := parseAliases(*aliases, routes); err != nil {
+		log.Fatalf("Invalid aliases: %v", err)
+	}
+	if *methodRoutes != "" {
+		if err := loadMethodRoutes(*methodRoutes, routes); err != nil {
+			log.Fatalf("Failed to load method routes: %v", err)
+		}
+	}
+
+	// Wrap them in the response cache if enabled
+	if *cacheSize > 0 || *redisAddr != "" {
+		rules, err := parseCacheRules(*cacheRules)
+		if err != nil {
+			log.Fatalf("Invalid cache rules: %v", err)
+		}
+		var store cacheStore
+		if *redisAddr != "" {
+			store = newRedisCache(newRedisClient(*redisAddr, *redisPassword, *redisDB))
+			log.Printf("Response cache enabled: redis at %s", *redisAddr)
+		} else {
+			store = newResponseCache(*cacheSize)
+			log.Printf("Response cache enabled: %d bytes", *cacheSize)
+		}
+		policy := cachePolicy{rules: rules, fallback: *cacheTTL}
+		cgiHandler = withCache(store, policy, cgiHandler)
+		for prefix, h := range routes {
+			routes[prefix] = withCache(store, policy, h)
+		}
+	}
+
+	// Setup routing, sending unrouted requests to the not-found script
+	http.Handle(*cgiPrefix, cgiHandler)
+	if *staticDir != "" {
+		if !strings.HasPrefix(*staticPrefix, "/") || !strings.HasSuffix(*staticPrefix, "/") {
+			log.Fatalf("Invalid configuration: -static-prefix must start and end with /")
+		}
+		if err := registerMimeTypes(); err != nil {
+			log.Fatalf("Failed to load MIME types: %v", err)
+		}
+		if *staticCache != "" {
+			rules, err := loadStaticCacheRules(*staticCache)
+			if err != nil {
+				log.Fatalf("Failed to load static cache rules: %v", err)
+			}
+			staticCacheControl = rules
+		}
+		http.Handle(*staticPrefix, http.StripPrefix(*staticPrefix, http.HandlerFunc(handleStatic)))
+	}
+	if err := setupJobs(); err != nil {
+		log.Fatalf("Cannot set up jobs: %v", err)
+	}
+	for prefix, h := range routes {
+		http.Handle(prefix, h)
+	}
+	setupWellKnown(routes)
+	if *notFoundScript != "" && *cgiPrefix != "/" && routes["/"] == nil {
+		http.Handle("/", http.HandlerFunc(handleNotFound))
+	}
+
+	// Load the in-process plugins, which can add routes of their own
+	if *goPlugins != "" {
+		if err := loadGoPlugins(*goPlugins); err != nil {
+			log.Fatalf("Failed to load Go plugins: %v", err)
+		}
+	}
+
+	var handler http.Handler = withInFlight(withTree(withMiddlewares(http.DefaultServeMux)))
+	if *hooksFile != "" {
+		if err := reloadHooks(); err != nil {
+			log.Fatalf("Failed to load request hooks: %v", err)
+		}
+		handler = withHooks(handler)
+		log.Printf("Loaded request hooks from %s", *hooksFile)
+	}
+	// Environment captures go through the request-changing handlers only
+	envCaptureHandler = handler
+
+	// Admin requests don't run scripts, so they aren't pinned to a CGI
+	// directory, which would keep a swap from draining
+	if *adminTokensFile != "" {
+		tokens, err := loadAdminTokens(*adminTokensFile)
+		if err != nil {
+			log.Fatalf("Failed to load admin tokens: %v", err)
+		}
+		adminTokens = tokens
+	}
+	if adminEnabled() && *adminListen == "" {
+		mux := http.NewServeMux()
+		mux.Handle(*adminPrefix, adminHandler())
+		mux.Handle("/", handler)
+		handler = mux
+	}
+	if *rewriteRules != "" {
+		rules, err := loadRewriteRules(*rewriteRules)
+		if err != nil {
+			log.Fatalf("Failed to load rewrite rules: %v", err)
+		}
+		handler = withRewrites(rules, handler)
+		envCaptureHandler = withRewrites(rules, envCaptureHandler)
+		log.Printf("Loaded %d rewrite rules from %s", len(rules), *rewriteRules)
+	}
+	if *recordDir != "" {
+		if err := os.MkdirAll(*recordDir, 0700); err != nil {
+			log.Fatalf("Cannot create recording directory: %v", err)
+		}
+		handler = withRecording(handler)
+		log.Printf("Recording requests to %s", *recordDir)
+	}
+	if *traceDir != "" {
+		if err := os.MkdirAll(*traceDir, 0700); err != nil {
+			log.Fatalf("Cannot create trace directory: %v", err)
+		}
+		handler = withTracing(handler)
+		log.Printf("Tracing requests to %s", *traceDir)
+	}
+	if *headerRulesFile != "" {
+		rules, err := loadHeaderRules(*headerRulesFile)
+		if err != nil {
+			log.Fatalf("Failed to load header rules: %v", err)
+		}
+		handler = withHeaderRules(rules, handler)
+		log.Printf("Loaded %d header rules from %s", len(rules), *headerRulesFile)
+	}
+	if *requestHeaderRulesFile != "" {
+		rules, err := loadHeaderRules(*requestHeaderRulesFile)
+		if err != nil {
+			log.Fatalf("Failed to load request header rules: %v", err)
+		}
+		handler = withRequestHeaderRules(rules, handler)
+		envCaptureHandler = withRequestHeaderRules(rules, envCaptureHandler)
+		log.Printf("Loaded %d request header rules from %s", len(rules), *requestHeaderRulesFile)
+	}
+	handler = withHeaderLimits(withURLLimits(withRequestTimeout(withBodyIdleTimeout(handler))))
+	if *errorPagesDir != "" {
+		pages, err := loadErrorPages(*errorPagesDir)
+		if err != nil {
+			log.Fatalf("Failed to load error pages: %v", err)
+		}
+		errorPages = pages
+		handler = withErrorPages(handler)
+		log.Printf("Loaded error pages from %s", *errorPagesDir)
+	}
+	if *accessLogPath != "" {
+		if err := openAccessLog(*accessLogPath); err != nil {
+			log.Fatalf("Cannot open access log: %v", err)
+		}
+		handler = withAccessLog(handler)
+	}
+	if *auditLogPath != "" {
+		if err := openAuditLog(*auditLogPath); err != nil {
+			log.Fatalf("Cannot open audit log: %v", err)
+		}
+	}
+	return withServerHeader(handler)
 }
 
 func handleCGI(w http.ResponseWriter, r *http.Request) {
+	serveFromDir(w, r, *cgiPrefix, cgiRoot(r))
+}
+
+// serveFromDir runs the script named by the request path, with its URL prefix
+// already stripped, from a script directory
+func serveFromDir(w http.ResponseWriter, r *http.Request, prefix, root string) {
 	// Validate the path to prevent directory traversal
 	if !isPathSafe(r.URL.Path) {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		log.Printf("Rejected unsafe path: %s", r.URL.Path)
+		auditReject(r, auditUnsafePath, r.URL.Path)
 		return
 	}
 
 	// Extract script path from request
-	scriptPath := filepath.Join(*cgiDir, r.URL.Path)
+	scriptPath := filepath.Join(root, r.URL.Path)
 
-	// Ensure the script doesn't escape the CGI directory
+	// Ensure the script doesn't escape the script directory
 	absScriptPath, err := filepath.Abs(scriptPath)
-	absCGIDir, err2 := filepath.Abs(*cgiDir)
+	absRoot, err2 := filepath.Abs(root)
 
-	if err != nil || err2 != nil || !strings.HasPrefix(absScriptPath, absCGIDir) {
+	if err != nil || err2 != nil || !strings.HasPrefix(absScriptPath, absRoot) {
 		http.Error(w, "Invalid script path", http.StatusForbidden)
 		log.Printf("Directory traversal attempt detected: %s", scriptPath)
+		auditReject(r, auditTraversal, scriptPath)
+		return
+	}
+
+	serveScript(w, r, cgiTarget{
+		root:       root,
+		scriptPath: scriptPath,
+		scriptName: prefix + r.URL.Path,
+		pathInfo:   r.URL.Path,
+	})
+}
+
+// cgiTarget is the script selected to handle a request
+type cgiTarget struct {
+	root       string // script directory, whose security checks apply
+	scriptPath string // path of the script on disk
+	scriptName string // URL path of the script, used for SCRIPT_NAME
+	pathInfo   string // remainder of the URL path, used for PATH_INFO
+
+	// redirectURL is the original path when the not-found script is run
+	redirectURL string
+}
+
+// serveScript runs the script selected for a request
+func serveScript(w http.ResponseWriter, r *http.Request, target cgiTarget) {
+	target = routeAB(w, r, target)
+	target = routeCanary(w, r, target)
+	scriptPath := target.scriptPath
+	if scriptDisabled(target.scriptName) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Script disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Dispatch to an upstream application server if one is configured for
+	// this path, otherwise check the script can be run locally
+	execute := executeCGIWithTimeout
+	backend := "cgi"
+	if up := findUpstream(target.scriptName); up != nil {
+		execute = up.execute
+		backend = up.name
+	} else if fallback, ok := notFoundTarget(r, target); ok {
+		serveScript(w, r, fallback)
+		return
+	} else if !checkScript(w, r, target.root, scriptPath) {
+		return
+	} else if usesWorkers(target.scriptName) {
+		execute = executeWithWorker
+		backend = "worker"
+	}
+
+	// Count failures for alerts
+	if alertsEnabled() {
+		rec := &accessRecorder{ResponseWriter: w}
+		w = rec
+		defer func() { recordOutcome(scriptPath, rec.status >= 500) }()
+	}
+
+	// Let the plugins turn the request away
+	if len(requestFilters) > 0 && !filterRequest(w, r, pluginRequest(r, scriptPath)) {
+		return
+	}
+
+	// Apply the per-directory configuration
+	cfg, err := loadScriptConfig(target.root, scriptPath)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Configuration error for %s: %v", scriptPath, err)
+		return
+	}
+	if !cfg.allowsMethod(r.Method) {
+		w.Header().Set("Allow", strings.Join(cfg.methods, ", "))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := cfg.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", cfg.authRealm))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		log.Printf("Authentication failed for %s from %s", scriptPath, r.RemoteAddr)
+		auditReject(r, auditAuthFailed, scriptPath)
 		return
 	}
+	authType := "Basic"
+	if len(authProviders) > 0 {
+		pluginUser, provider, err := pluginAuthenticate(pluginRequest(r, scriptPath))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			log.Printf("Authentication failed for %s from %s: %v", scriptPath, r.RemoteAddr, err)
+			auditReject(r, auditAuthFailed, provider)
+			return
+		}
+		if pluginUser != "" {
+			user, authType = pluginUser, provider
+		}
+	}
 
+	// Check webhook signatures against the body as sent
+	webhookEvent, verified := r.Context().Value(verifiedWebhookKey{}).(string)
+	if cfg.webhookProvider != "" && !verified {
+		webhookEvent, err = verifyWebhook(r, cfg.webhookProvider, cfg.webhookSecret)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			log.Printf("Webhook verification failed for %s from %s: %v", scriptPath, r.RemoteAddr, err)
+			auditReject(r, auditWebhook, scriptPath)
+			return
+		}
+	}
+
+	// Answer right away and run asynchronous scripts in the background
+	if cfg.async && startJob(w, r, target, cfg.queue, cfg.webhookProvider != "", webhookEvent) {
+		return
+	}
+
+	// Decompress the request body if the client sent it compressed
+	if *decompressBody {
+		if err := decompressRequestBody(r); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			log.Printf("Request body decompression error: %v", err)
+			return
+		}
+	}
+
+	// Check uploads as they are read. Closing the body stops the parser
+	// of a guarded one, however much of it the script read
+	guardMultipart(r)
+	defer r.Body.Close()
+
+	// Read the whole body before starting the script
+	if *spoolBodies {
+		cleanup, err := spoolRequestBody(r)
+		var rejected *uploadRejectedError
+		if err == errBodyTooLarge {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			log.Printf("Refused request body over %d bytes for %s", *spoolMaxSize, scriptPath)
+			auditReject(r, auditBodyTooLarge, scriptPath)
+			return
+		} else if errors.As(err, &rejected) {
+			http.Error(w, "Upload not allowed", http.StatusRequestEntityTooLarge)
+			log.Printf("Refused upload for %s: %v", scriptPath, err)
+			auditReject(r, auditUploadRejected, err.Error())
+			return
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			http.Error(w, "Request body timed out", http.StatusRequestTimeout)
+			log.Printf("Timed out reading request body for %s from %s", scriptPath, r.RemoteAddr)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			log.Printf("Request body spooling error: %v", err)
+			return
+		}
+		defer cleanup()
+	}
+
+	// Create a custom environment for the CGI script with sanitized variables
+	env, err := createSanitizedEnvironment(r, target, cfg.trusted)
+	if err == errCookiesTooLarge {
+		http.Error(w, "Cookies too large", http.StatusRequestHeaderFieldsTooLarge)
+		log.Printf("Refused request from %s with cookies over %d bytes", r.RemoteAddr, *maxCookieSize)
+		auditReject(r, auditCookiesTooLarge, scriptPath)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid request data", http.StatusBadRequest)
+		log.Printf("Environment sanitization error: %v", err)
+		auditReject(r, auditInvalidEnv, err.Error())
+		return
+	}
+
+	// Add the variables set by the configuration, which is trusted
+	if user != "" {
+		env = append(env, "AUTH_TYPE="+authType, "REMOTE_USER="+user)
+	}
+	if cfg.webhookProvider != "" {
+		env = append(env, "WEBHOOK_PROVIDER="+cfg.webhookProvider)
+		// The event type comes from the sender, so is sanitized
+		if event, err := sanitizeVar("WEBHOOK_EVENT", webhookEvent, cfg.trusted); err == nil && event != "" {
+			env = append(env, "WEBHOOK_EVENT="+event)
+		}
+	}
+	env = append(env, localeEnv()...)
+	env = append(env, cfg.env...)
+	env = append(env, hookEnv(r)...)
+	var cspHeader string
+	if *cspPolicy != "" {
+		var nonce string
+		nonce, cspHeader = newCSPNonce()
+		env = append(env, "CSP_NONCE="+nonce)
+	}
+	if len(envMutators) > 0 {
+		if env, err = mutateEnv(pluginRequest(r, scriptPath), env); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Printf("Environment plugin failed for %s: %v", scriptPath, err)
+			return
+		}
+	}
+	recordEnvironment(r, env)
+	traceEnvironment(r, env)
+
+	// Enforce the script's concurrency limit
+	release, ok := acquireScriptSlot(scriptPath, cfg.concurrency)
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many concurrent requests", http.StatusServiceUnavailable)
+		log.Printf("Concurrency limit of %d reached for %s", cfg.concurrency, scriptPath)
+		return
+	}
+	defer release()
+
+	// Buffer the response for the plugins filtering it
+	if len(responseFilters) > 0 {
+		fw := &filteredWriter{bufferedResponse: newBufferedResponse(), w: w, req: pluginRequest(r, scriptPath)}
+		w = fw
+		defer fw.flush()
+	}
+
+	// Scripts that don't set a Content-Type get the configured default
+	if cfg.contentType != "" {
+		w.Header().Set("Content-Type", cfg.contentType)
+	}
+	if cspHeader != "" {
+		w.Header().Set("Content-Security-Policy", cspHeader)
+	}
+
+	// Describe the script instead of running it when dry-running, or when
+	// only its environment is wanted
+	if *dryRun {
+		execute = dryRunExecutor(backend, cfg)
+	}
+	if r.Context().Value(envCaptureKey{}) != nil {
+		execute = printEnvironment
+	}
+
+	// Append the script's stderr output and exit status to server errors
+	// when debugging
+	if debugging(r, cfg) {
+		info := requestDebugInfo(r.Context())
+		if info == nil {
+			info = &debugInfo{}
+			r = r.WithContext(context.WithValue(r.Context(), debugKey{}, info))
+		}
+		dw := &debugWriter{ResponseWriter: w, info: info}
+		w = dw
+		defer dw.report()
+	}
+
+	// Create a context with timeout for script execution
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.timeout)
+	defer cancel()
+
+	// Execute the CGI script with our own implementation that enforces timeouts
+	if err := execute(ctx, w, r, scriptPath, env); err != nil {
+		var invalid *invalidOutputError
+		var rejected *uploadRejectedError
+		var copyErr *bodyCopyError
+		if errors.As(err, &copyErr) {
+			http.Error(w, copyErr.message(), copyErr.status)
+			log.Printf("Stopped script %s: %v", scriptPath, err)
+		} else if r.Context().Err() == context.DeadlineExceeded {
+			http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+			log.Printf("Request timed out after %s: %s", *requestTimeout, scriptPath)
+			countEvent("timeout", scriptPath, *notifyTimeouts, "request timeout")
+		} else if ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, "Script execution timed out", http.StatusGatewayTimeout)
+			log.Printf("Script timed out after %s: %s", cfg.timeout, scriptPath)
+			countEvent("timeout", scriptPath, *notifyTimeouts, "script timeout "+cfg.timeout.String())
+		} else if errors.As(err, &invalid) {
+			http.Error(w, "Bad gateway", http.StatusBadGateway)
+			log.Printf("Script %s: %v", scriptPath, err)
+		} else if errors.As(err, &rejected) {
+			http.Error(w, "Upload not allowed", http.StatusRequestEntityTooLarge)
+			log.Printf("Refused upload for %s: %v", scriptPath, err)
+			auditReject(r, auditUploadRejected, err.Error())
+		} else {
+			http.Error(w, "Error executing script", http.StatusInternalServerError)
+			log.Printf("Error executing script %s: %v", scriptPath, err)
+		}
+	}
+}
+
+// checkScript verifies that a script may be executed, and reports an error to
+// the client if not
+func checkScript(w http.ResponseWriter, r *http.Request, root, scriptPath string) bool {
 	// Check file extension against whitelist
 	if !hasAllowedExtension(scriptPath) {
 		http.Error(w, "Script type not allowed", http.StatusForbidden)
 		log.Printf("Rejected script with disallowed extension: %s", scriptPath)
-		return
+		auditReject(r, auditBadExtension, scriptPath)
+		return false
+	}
+
+	// Scripts indexed by the watcher are known to be valid
+	if isIndexedScript(scriptPath) {
+		return checkScriptPolicy(w, r, root, scriptPath)
 	}
 
 	// Check if file exists and is executable
-	info, err := os.Stat(scriptPath)
+	info, err := statScript(scriptPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			http.Error(w, "Script not found", http.StatusNotFound)
@@ -121,125 +765,214 @@ func handleCGI(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			log.Printf("Error accessing script %s: %v", scriptPath, err)
 		}
-		return
+		return false
 	}
 
 	// Check if it's a regular file
 	if !info.Mode().IsRegular() {
 		http.Error(w, "Not a valid script", http.StatusForbidden)
-		return
+		return false
 	}
 
 	// Check if it's executable (on Unix systems)
-	if info.Mode()&0111 == 0 {
+	if !isExecutable(scriptPath, info) {
 		http.Error(w, "Script is not executable", http.StatusForbidden)
 		log.Printf("Warning: Script %s is not executable", scriptPath)
-		return
+		auditReject(r, auditNotExecutable, scriptPath)
+		return false
 	}
 
-	// Create a custom environment for the CGI script with sanitized variables
-	env, err := createSanitizedEnvironment(r)
-	if err != nil {
-		http.Error(w, "Invalid request data", http.StatusBadRequest)
-		log.Printf("Environment sanitization error: %v", err)
-		return
+	return checkScriptPolicy(w, r, root, scriptPath)
+}
+
+// checkScriptPolicy applies the optional security checks to a valid script
+func checkScriptPolicy(w http.ResponseWriter, r *http.Request, root, scriptPath string) bool {
+	// Enforce the symlink policy
+	if !checkSymlinks(w, r, root, scriptPath) {
+		return false
 	}
 
-	// Create a context with timeout for script execution
-	ctx, cancel := context.WithTimeout(r.Context(), *scriptTimeout)
-	defer cancel()
+	// Enforce suexec-style permission rules
+	if !checkSuexec(w, r, scriptPath) {
+		return false
+	}
 
-	// Execute the CGI script with our own implementation that enforces timeouts
-	if err := executeCGIWithTimeout(ctx, w, r, scriptPath, env); err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			http.Error(w, "Script execution timed out", http.StatusGatewayTimeout)
-			log.Printf("Script timed out after %s: %s", *scriptTimeout, scriptPath)
-		} else {
-			http.Error(w, "Error executing script", http.StatusInternalServerError)
-			log.Printf("Error executing script %s: %v", scriptPath, err)
-		}
+	// Verify the script against the integrity manifest
+	if !checkIntegrity(w, r, scriptPath) {
+		return false
 	}
+
+	// Verify the script's signature
+	return checkSignature(w, r, scriptPath)
 }
 
-// executeCGIWithTimeout runs a CGI script with a hard timeout
-func executeCGIWithTimeout(ctx context.Context, w http.ResponseWriter, r *http.Request, scriptPath string, env []string) error {
-	// Determine the interpreter based on file extension
-	args := []string{}
+// scriptProcess is a started CGI script and its standard streams
+type scriptProcess struct {
+	pid    int
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+	wait   func() error
+}
 
-	// bypass exec.LookPath() and force using the executable in the cgi-bin dir
-	executable := "./" + filepath.Base(scriptPath)
+// startScript forks and executes a CGI script
+func startScript(ctx context.Context, scriptPath string, env []string) (*scriptProcess, error) {
 	// Create the command with the provided environment
-	cmd := exec.CommandContext(ctx, executable, args...)
+	cmd := scriptCommand(ctx, scriptPath)
 	cmd.Env = env
-	cmd.Dir = filepath.Dir(scriptPath)
 
 	// Set up process group for easier termination
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid: true, // Create a new process group
-	}
+	setProcessGroup(cmd)
 
 	// Set up pipes for stdin, stdout, stderr
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return fmt.Errorf("failed to create stdin pipe: %v", err)
+		return nil, fmt.Errorf("failed to create stdin pipe: %v", err)
 	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return fmt.Errorf("failed to create stdout pipe: %v", err)
+		return nil, fmt.Errorf("failed to create stdout pipe: %v", err)
 	}
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return fmt.Errorf("failed to create stderr pipe: %v", err)
+		return nil, fmt.Errorf("failed to create stderr pipe: %v", err)
 	}
 
 	// Start the command
 	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start script: %v", err)
+		return nil, fmt.Errorf("failed to start script: %v", err)
+	}
+
+	return &scriptProcess{
+		pid:    cmd.Process.Pid,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+		wait:   cmd.Wait,
+	}, nil
+}
+
+// executeCGIWithTimeout runs a CGI script with a hard timeout
+func executeCGIWithTimeout(ctx context.Context, w http.ResponseWriter, r *http.Request, scriptPath string, env []string) error {
+	// Start the script with the selected backend
+	var proc *scriptProcess
+	var err error
+	spawnStart := time.Now()
+	if spawnPool != nil {
+		proc, err = spawnPool.start(scriptPath, env)
+	} else {
+		proc, err = startScript(ctx, scriptPath, env)
+	}
+	if err != nil {
+		return err
 	}
+	recordSpawn(ctx, time.Since(spawnStart))
+	stdin, stdout, stderr := proc.stdin, proc.stdout, proc.stderr
 
-	// Store the process ID for potential forceful termination
-	pid := cmd.Process.Pid
-	pgid, _ := syscall.Getpgid(pid)
+	// Keep track of the process group for potential forceful termination
+	group := newProcessGroup(proc.pid)
+	untrack := trackProcess(proc.pid, scriptPath, r)
 
-	// Set up a goroutine to handle forceful termination on timeout
+	// Set up a goroutine to handle forceful termination on timeout, or
+	// when the job running the script is cancelled
 	go func() {
 		<-ctx.Done()
-		if ctx.Err() == context.DeadlineExceeded {
-			log.Printf("Force killing process group %d (PID %d)", pgid, pid)
-			// Send SIGKILL to the entire process group
-			syscall.Kill(-pgid, syscall.SIGKILL)
+		if ctx.Err() == context.DeadlineExceeded || context.Cause(ctx) == errJobCancelled {
+			log.Printf("Force killing %s (PID %d)", group, proc.pid)
+			// Kill the entire process group
+			group.kill()
 		}
 	}()
 
 	// Copy request body to script's stdin if needed
 	if r.Body != nil {
-		_, err := io.Copy(stdin, r.Body)
-		if err != nil {
-			log.Printf("Error copying request body: %v", err)
+		if err := copyRequestBody(w, stdin, r, group); err != nil {
+			// Stop the script before it acts on a truncated body
+			group.kill()
+			stdin.Close()
+			go func() {
+				io.Copy(io.Discard, stderr)
+				io.Copy(io.Discard, stdout)
+				proc.wait()
+				untrack()
+				group.close()
+			}()
+			return err
 		}
 	}
 	stdin.Close()
 
 	// Process script output
+	stderrDone := make(chan struct{})
 	go func() {
 		// Read stderr and log it
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			log.Printf("CGI stderr: %s", scanner.Text())
-		}
+		stderrLog := newStderrLog("CGI stderr")
+		stderrLog.debug = requestDebugInfo(ctx)
+		stderrLog.copyFrom(stderr)
+		close(stderrDone)
 	}()
 
 	// Parse CGI response
-	return parseCGIResponse(stdout, w)
+	var output io.Reader = stdout
+	if t := requestTrace(ctx); t != nil {
+		output = io.TeeReader(stdout, &t.output)
+	}
+	err = relayCGIResponse(&killedReader{output, ctx}, w)
+	stdout.Close()
+
+	// Reap the script once its output has been consumed, waiting for it
+	// when debugging to report its exit status
+	reap := func() error {
+		<-stderrDone
+		defer group.close()
+		defer untrack()
+		return proc.wait()
+	}
+	if info := requestDebugInfo(ctx); info != nil {
+		info.setExit(reap())
+	} else {
+		go reap()
+	}
+	return err
+}
+
+// killedReader reports the end of the output of a script killed when its
+// context ended as an error, rather than relaying it as a complete response
+type killedReader struct {
+	io.Reader
+	ctx context.Context
+}
+
+func (k *killedReader) Read(p []byte) (int, error) {
+	n, err := k.Reader.Read(p)
+	if err == io.EOF && k.ctx.Err() == context.DeadlineExceeded {
+		err = k.ctx.Err()
+	}
+	return n, err
+}
+
+// hopByHopHeaders only concern a single connection, which the server manages
+// itself, and are not relayed from script output
+var hopByHopHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
 }
 
-// parseCGIResponse processes the CGI script's output and sends it to the client
-func parseCGIResponse(stdout io.Reader, w http.ResponseWriter) error {
+// parseCGIResponse processes the CGI script's output and sends it to the
+// client. whole tells whether stdout holds the body too, rather than only the
+// header block.
+func parseCGIResponse(stdout io.Reader, w http.ResponseWriter, whole bool) error {
 	// Read the complete output
-	var output bytes.Buffer
-	_, err := io.Copy(&output, stdout)
+	output := getOutputBuffer()
+	defer putOutputBuffer(output)
+	_, err := output.ReadFrom(stdout)
 	if err != nil {
 		return fmt.Errorf("error reading script output: %v", err)
 	}
@@ -263,6 +996,15 @@ func parseCGIResponse(stdout io.Reader, w http.ResponseWriter) error {
 			break
 		}
 
+		// Application servers such as uWSGI send an HTTP status line
+		if proto, status, ok := strings.Cut(line, " "); ok && strings.HasPrefix(proto, "HTTP/") {
+			code, _, _ := strings.Cut(status, " ")
+			if n, err := strconv.Atoi(code); err == nil {
+				statusCode = n
+			}
+			continue
+		}
+
 		parts := strings.SplitN(line, ":", 2)
 		if len(parts) != 2 {
 			continue
@@ -272,7 +1014,9 @@ func parseCGIResponse(stdout io.Reader, w http.ResponseWriter) error {
 		value := strings.TrimSpace(parts[1])
 
 		// Handle special Status header
-		if strings.EqualFold(key, "Status") {
+		if strings.EqualFold(key, noBufferingHeader) {
+			continue
+		} else if strings.EqualFold(key, "Status") {
 			statusParts := strings.SplitN(value, " ", 2)
 			if len(statusParts) > 0 {
 				if code, err := strconv.Atoi(statusParts[0]); err == nil {
@@ -298,21 +1042,77 @@ func parseCGIResponse(stdout io.Reader, w http.ResponseWriter) error {
 		bodyStart += 4
 	}
 
-	// Set response status
-	w.WriteHeader(statusCode)
+	// Headers named by Connection are hop-by-hop too
+	dropped := make(map[string]bool)
+	for key, value := range headers {
+		if http.CanonicalHeaderKey(key) == "Connection" {
+			for _, name := range strings.Split(value, ",") {
+				dropped[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+			}
+		}
+	}
 
-	// Set response headers
+	// Set response headers, which must precede the status line
+	body := data[bodyStart:]
 	for key, value := range headers {
-		if !strings.EqualFold(key, "Status") {
-			w.Header().Set(key, value)
+		name := http.CanonicalHeaderKey(key)
+		if name == "Status" || hopByHopHeaders[name] || dropped[name] {
+			continue
+		}
+		// A wrong length would truncate the response or desynchronize the
+		// connection, the server computes the right one
+		if name == "Content-Length" && whole && value != strconv.Itoa(len(body)) {
+			log.Printf("Dropped Content-Length %q from script output with a %d byte body", value, len(body))
+			continue
+		}
+		// Keep what the server varies on, such as A/B and canary routing
+		if name == "Vary" {
+			w.Header().Add(key, value)
+			continue
 		}
+		w.Header().Set(key, value)
 	}
 
+	// Set response status
+	w.WriteHeader(statusCode)
+
 	// Write the body
-	_, err = w.Write(data[bodyStart:])
+	_, err = w.Write(body)
 	return err
 }
 
+// decompressRequestBody replaces a gzip-encoded request body with its
+// decompressed content and adjusts the Content-Length accordingly
+func decompressRequestBody(r *http.Request) error {
+	encoding := strings.TrimSpace(r.Header.Get("Content-Encoding"))
+	if r.Body == nil || !(strings.EqualFold(encoding, "gzip") || strings.EqualFold(encoding, "x-gzip")) {
+		return nil
+	}
+
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return fmt.Errorf("invalid gzip body: %v", err)
+	}
+	defer zr.Close()
+
+	// Read one byte past the limit to detect oversized bodies
+	var body bytes.Buffer
+	n, err := io.Copy(&body, io.LimitReader(zr, *maxBodySize+1))
+	if err != nil {
+		return fmt.Errorf("error decompressing body: %v", err)
+	}
+	if n > *maxBodySize {
+		return fmt.Errorf("decompressed body exceeds maximum allowed size %v", *maxBodySize)
+	}
+	r.Body.Close()
+
+	r.Body = io.NopCloser(&body)
+	r.ContentLength = n
+	r.Header.Del("Content-Encoding")
+	r.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+	return nil
+}
+
 // isPathSafe checks if a path is safe (no directory traversal)
 func isPathSafe(p string) bool {
 	// see: https://dzx.cz/2021-04-02/go_path_traversal/
@@ -335,10 +1135,10 @@ func hasAllowedExtension(path string) bool {
 }
 
 // createSanitizedEnvironment builds a safe environment for CGI scripts
-func createSanitizedEnvironment(r *http.Request) ([]string, error) {
-	env := []string{
-		"GATEWAY_INTERFACE=CGI/1.1",
-		"SERVER_SOFTWARE=Go-CGI-Server/1.0",
+func createSanitizedEnvironment(r *http.Request, target cgiTarget, trusted bool) ([]string, error) {
+	env := []string{"GATEWAY_INTERFACE=CGI/1.1"}
+	if software := softwareName(); software != "" {
+		env = append(env, "SERVER_SOFTWARE="+software)
 	}
 
 	// Add basic CGI variables with sanitization
@@ -346,32 +1146,55 @@ func createSanitizedEnvironment(r *http.Request) ([]string, error) {
 	if clientIp == "" {
 		clientIp = r.RemoteAddr
 	}
+	_, remotePort, _ := net.SplitHostPort(r.RemoteAddr)
+	// The address and port the request was actually received on
+	var serverAddr, serverPort string
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		serverAddr, serverPort, _ = net.SplitHostPort(addr.String())
+	}
+	scriptFilename, err := filepath.Abs(target.scriptPath)
+	if err != nil {
+		return nil, err
+	}
 	cgiVars := map[string]string{
 		"SERVER_NAME":     r.Host,
 		"SERVER_PROTOCOL": r.Proto,
-		"SERVER_PORT":     r.URL.Port(),
+		"SERVER_ADDR":     serverAddr,
+		"SERVER_PORT":     serverPort,
 		"REQUEST_METHOD":  r.Method,
-		"PATH_INFO":       r.URL.Path,
-		"SCRIPT_NAME":     *cgiPrefix + r.URL.Path,
+		"PATH_INFO":       target.pathInfo,
+		"SCRIPT_NAME":     target.scriptName,
+		"SCRIPT_FILENAME": scriptFilename,
+		"REQUEST_URI":     originalRequestURI(r),
 		"QUERY_STRING":    r.URL.RawQuery,
 		"REMOTE_ADDR":     clientIp,
+		"REMOTE_PORT":     remotePort,
 		"CONTENT_LENGTH":  r.Header.Get("Content-Length"),
 		"CONTENT_TYPE":    r.Header.Get("Content-Type"),
 	}
+	if r.TLS != nil {
+		cgiVars["HTTPS"] = "on"
+	}
+	if *redirectStatus != "" {
+		cgiVars["REDIRECT_STATUS"] = *redirectStatus
+	}
+	if target.redirectURL != "" {
+		cgiVars["REDIRECT_URL"] = target.redirectURL
+		cgiVars["REDIRECT_STATUS"] = "404"
+	}
 
+	present := make(map[string]bool)
 	for name, value := range cgiVars {
 		// Check size limit
 		if len(value) > *maxEnvSize {
 			return nil, fmt.Errorf("environment variable %v exceeds maximum allowed size %v", name, *maxEnvSize)
 		}
-
-		var sanitized string
-		var err error
-		if name == "QUERY_STRING" {
-			sanitized, err = value, nil
-		} else {
-			sanitized, err = sanitizeEnv(value)
+		if err := checkEnvRule(name, value); err != nil {
+			return nil, err
 		}
+		present[name] = value != ""
+
+		sanitized, err := sanitizeVar(name, value, trusted)
 		if err != nil {
 			return nil, err
 		}
@@ -382,19 +1205,35 @@ func createSanitizedEnvironment(r *http.Request) ([]string, error) {
 	for header, values := range r.Header {
 		headerName := strings.ToUpper(strings.Replace(header, "-", "_", -1))
 
-		// Skip headers not in the whitelist
-		if !allowedHeaders[headerName] {
+		// Skip headers not in the whitelist or set by header rules
+		if !allowedHeaders[headerName] && !ruleHeader(r, headerName) {
 			continue
 		}
 
+		// Cookies are merged into one variable
+		if headerName == "COOKIE" {
+			cookies, err := requestCookies(r)
+			if err != nil {
+				return nil, err
+			}
+			values = []string{cookies}
+		}
+
 		for _, value := range values {
-			sanitized, err := sanitizeEnv(value)
+			if err := checkEnvRule("HTTP_"+headerName, value); err != nil {
+				return nil, err
+			}
+			present["HTTP_"+headerName] = present["HTTP_"+headerName] || value != ""
+			sanitized, err := sanitizeVar("HTTP_"+headerName, value, trusted)
 			if err != nil {
 				return nil, err
 			}
 			env = append(env, fmt.Sprintf("HTTP_%s=%s", headerName, sanitized))
 		}
 	}
+	if err := checkRequiredEnv(present); err != nil {
+		return nil, err
+	}
 
 	return env, nil
 }
@@ -403,17 +1242,11 @@ func createSanitizedEnvironment(r *http.Request) ([]string, error) {
 // and enforces size limits
 func sanitizeEnv(input string) (string, error) {
 	// Remove NULL bytes and other control characters
-	result := strings.Map(func(r rune) rune {
-		if r < 32 || r == 127 {
-			return -1 // drop the character
-		}
-		return r
-	}, input)
+	result := stripControl(input)
 
 	// Remove potentially dangerous shell metacharacters
 	result = strings.Map(func(r rune) rune {
-		// Common shell metacharacters: ; & | ` $ > < ! ( ) { } [ ] \ ^
-		if strings.ContainsRune(";|&`$><()[]{}^!\"\\", r) {
+		if strings.ContainsRune(shellMetacharacters, r) {
 			return ' ' // replace with space
 		}
 		return r
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// commands maps subcommand names to their implementations, which receive the
+// arguments following the name
+var commands = make(map[string]func(args []string) error)
+
+// runCommand runs a subcommand
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command, expected one of: %s", strings.Join(names, ", "))
+	}
+	return cmd(args)
+}
+
+// headerFlags collects repeated -header "Name: value" flags
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	if name, _, ok := strings.Cut(value, ":"); !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("invalid header %q, expected Name: value", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// requestFlags describes a request given on the command line
+type requestFlags struct {
+	method     string
+	data       string
+	headers    headerFlags
+	remoteAddr string
+}
+
+// register adds the request flags to a flag set
+func (rf *requestFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&rf.method, "method", "", "Request method (default GET, or POST with -data)")
+	fs.StringVar(&rf.data, "data", "", "Request body, or @file to read it from a file, or @- from standard input")
+	fs.Var(&rf.headers, "header", "Request header as \"Name: value\" (may be repeated)")
+	fs.StringVar(&rf.remoteAddr, "remote-addr", "127.0.0.1:50000", "Client address of the request")
+}
+
+// build creates the request for a target, which is either a URL, a URL path
+// with an optional query string, or a script relative to the CGI directory
+func (rf *requestFlags) build(target string) (*http.Request, error) {
+	body, err := rf.body()
+	if err != nil {
+		return nil, err
+	}
+	return rf.request(target, body)
+}
+
+// body returns the request body given by -data
+func (rf *requestFlags) body() ([]byte, error) {
+	switch {
+	case rf.data == "@-":
+		return io.ReadAll(os.Stdin)
+	case strings.HasPrefix(rf.data, "@"):
+		return os.ReadFile(rf.data[1:])
+	}
+	return []byte(rf.data), nil
+}
+
+// request creates a request for a target with the given body
+func (rf *requestFlags) request(target string, body []byte) (*http.Request, error) {
+	method := rf.method
+	if method == "" {
+		method = http.MethodGet
+		if rf.data != "" {
+			method = http.MethodPost
+		}
+	}
+	host := serverHost()
+	if u, err := url.Parse(target); err == nil && u.Scheme != "" && u.Host != "" {
+		host, target = u.Host, u.RequestURI()
+	}
+	if !strings.HasPrefix(target, "/") {
+		target = *cgiPrefix + target
+	}
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := http.NewRequest(strings.ToUpper(method), u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Host = host
+	r.RequestURI = u.RequestURI()
+	r.RemoteAddr = rf.remoteAddr
+	for _, header := range rf.headers {
+		name, value, _ := strings.Cut(header, ":")
+		r.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if rf.data != "" && r.Header.Get("Content-Length") == "" {
+		r.Header.Set("Content-Length", fmt.Sprint(len(body)))
+	}
+	return r, nil
+}
+
+// bufferedResponse is a ResponseWriter keeping the whole response in memory
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (br *bufferedResponse) Header() http.Header {
+	return br.header
+}
+
+func (br *bufferedResponse) WriteHeader(status int) {
+	if br.status == 0 {
+		br.status = status
+	}
+}
+
+func (br *bufferedResponse) Write(p []byte) (int, error) {
+	if br.status == 0 {
+		br.status = http.StatusOK
+	}
+	return br.body.Write(p)
+}
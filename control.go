@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The control operations are available both as admin endpoints and over the
+// gRPC control plane:
+//
+//	GET  processes                       CGI scripts running
+//	POST reload                          reread the configuration files
+//	GET  disabled                        scripts disabled
+//	POST disabled?script=/cgi-bin/x.cgi  disable a script, or enable it
+//	     &enabled=true                   again
+//	GET  stats                           activity of the server
+//
+// along with drain, which predates them.
+
+func init() {
+	adminEndpoints["processes"] = handleProcesses
+	adminEndpoints["reload"] = handleReload
+	adminEndpoints["disabled"] = handleDisabled
+	adminEndpoints["stats"] = handleStats
+}
+
+// serverStarted is when the server started, for its stats
+var serverStarted = time.Now()
+
+// runningProcess is a CGI script being run
+type runningProcess struct {
+	PID        int       `json:"pid"`
+	Script     string    `json:"script"`
+	RemoteAddr string    `json:"remote_addr"`
+	Started    time.Time `json:"started"`
+}
+
+// serverStats describes the activity of the server
+type serverStats struct {
+	Version         string    `json:"version"`
+	Started         time.Time `json:"started"`
+	Requests        int64     `json:"requests"`
+	InFlight        int64     `json:"in_flight"`
+	Processes       int       `json:"processes"`
+	JobsQueued      int       `json:"jobs_queued"`
+	JobsRunning     int       `json:"jobs_running"`
+	DisabledScripts []string  `json:"disabled_scripts"`
+	Draining        bool      `json:"draining"`
+}
+
+var (
+	processesMu sync.Mutex
+	processes   = make(map[int]runningProcess)
+
+	// disabledScripts are the URL paths of the scripts answering 503
+	disabledMu      sync.RWMutex
+	disabledScripts = make(map[string]bool)
+)
+
+// trackProcess lists a script as running until the returned function is
+// called
+func trackProcess(pid int, scriptPath string, r *http.Request) func() {
+	processesMu.Lock()
+	processes[pid] = runningProcess{pid, scriptPath, r.RemoteAddr, time.Now()}
+	processesMu.Unlock()
+	return func() {
+		processesMu.Lock()
+		delete(processes, pid)
+		processesMu.Unlock()
+	}
+}
+
+// processList returns the running scripts, oldest first
+func processList() []runningProcess {
+	processesMu.Lock()
+	list := make([]runningProcess, 0, len(processes))
+	for _, p := range processes {
+		list = append(list, p)
+	}
+	processesMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// reloadConfig rereads the configuration files, returning their names
+func reloadConfig() ([]string, error) {
+	// Per-directory and sidecar files are reread when they change, but
+	// dropping them makes sure edits within the same second are seen
+	dirConfigMu.Lock()
+	clear(dirConfigCache)
+	dirConfigMu.Unlock()
+	scriptMetaMu.Lock()
+	clear(scriptMetaCache)
+	scriptMetaMu.Unlock()
+	statCacheMu.Lock()
+	clear(statCache)
+	statCacheMu.Unlock()
+	reloaded := []string{dirConfigName, scriptMetaSuffix}
+
+	if *envRulesFile != "" {
+		if err := reloadEnvRules(); err != nil {
+			return nil, err
+		}
+		reloaded = append(reloaded, *envRulesFile)
+	}
+	if *hooksFile != "" {
+		if err := reloadHooks(); err != nil {
+			return nil, err
+		}
+		reloaded = append(reloaded, *hooksFile)
+	}
+	log.Printf("Reloaded configuration: %v", reloaded)
+	return reloaded, nil
+}
+
+// scriptDisabled tells whether a script was disabled
+func scriptDisabled(scriptName string) bool {
+	disabledMu.RLock()
+	defer disabledMu.RUnlock()
+	return disabledScripts[scriptName]
+}
+
+// setScriptEnabled disables or enables a script, returning the scripts now
+// disabled
+func setScriptEnabled(scriptName string, enabled bool) []string {
+	disabledMu.Lock()
+	if enabled {
+		delete(disabledScripts, scriptName)
+	} else {
+		disabledScripts[scriptName] = true
+	}
+	disabledMu.Unlock()
+	log.Printf("Script %s enabled: %v", scriptName, enabled)
+	return disabledList()
+}
+
+// disabledList returns the disabled scripts in order
+func disabledList() []string {
+	disabledMu.RLock()
+	defer disabledMu.RUnlock()
+	list := make([]string, 0, len(disabledScripts))
+	for script := range disabledScripts {
+		list = append(list, script)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// currentStats returns the activity of the server
+func currentStats() serverStats {
+	stats := serverStats{
+		Version:         buildVersion(),
+		Started:         serverStarted,
+		Requests:        requestsServed.Load(),
+		InFlight:        inFlight.Load(),
+		DisabledScripts: disabledList(),
+		Draining:        draining.Load(),
+	}
+	processesMu.Lock()
+	stats.Processes = len(processes)
+	processesMu.Unlock()
+	jobsMu.Lock()
+	stats.JobsQueued = queued
+	for _, q := range queues {
+		stats.JobsRunning += q.running
+	}
+	jobsMu.Unlock()
+	return stats
+}
+
+// writeJSON sends a value as a JSON response
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleProcesses lists the running scripts
+func handleProcesses(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, processList())
+}
+
+// handleReload rereads the configuration files
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reloaded, err := reloadConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, map[string][]string{"reloaded": reloaded})
+}
+
+// handleDisabled lists the disabled scripts, or disables or enables one
+func handleDisabled(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		writeJSON(w, map[string][]string{"disabled_scripts": disabledList()})
+	case http.MethodPost:
+		script := r.URL.Query().Get("script")
+		if script == "" {
+			http.Error(w, "script is required", http.StatusBadRequest)
+			return
+		}
+		enabled, _ := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		writeJSON(w, map[string][]string{"disabled_scripts": setScriptEnabled(script, enabled)})
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleStats reports the activity of the server
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, currentStats())
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var (
+	maxCookieSize  = flag.Int("max-cookie-size", 0, "Maximum total size of the cookies passed to scripts in HTTP_COOKIE, or 0 for no limit")
+	cookieOverflow = flag.String("cookie-overflow", "reject", "What to do with cookies over -max-cookie-size: reject the request with 431, or truncate to the cookies that fit")
+)
+
+// errCookiesTooLarge is returned for requests whose cookies exceed the limit
+var errCookiesTooLarge = errors.New("cookies too large")
+
+// validateCookieOverflow checks the -cookie-overflow flag
+func validateCookieOverflow() error {
+	if *cookieOverflow != "reject" && *cookieOverflow != "truncate" {
+		return fmt.Errorf("invalid -cookie-overflow %q, expected reject or truncate", *cookieOverflow)
+	}
+	return nil
+}
+
+// requestCookies returns the cookies of a request as a single header value,
+// since HTTP/2 clients send each cookie in its own header, applying the size
+// limit
+func requestCookies(r *http.Request) (string, error) {
+	cookies := strings.Join(r.Header.Values("Cookie"), "; ")
+	if *maxCookieSize <= 0 || len(cookies) <= *maxCookieSize {
+		return cookies, nil
+	}
+	if *cookieOverflow == "reject" {
+		return "", errCookiesTooLarge
+	}
+
+	// Keep the whole cookies that fit, the one straddling the limit ends
+	// at the last separator up to just past it
+	kept := cookies[:*maxCookieSize+1]
+	if i := strings.LastIndex(kept, ";"); i >= 0 {
+		kept = kept[:i]
+	} else {
+		kept = ""
+	}
+	log.Printf("Truncated %d bytes of cookies from %s to %d", len(cookies), r.RemoteAddr, len(kept))
+	return strings.TrimSpace(kept), nil
+}
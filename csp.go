@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var cspPolicy = flag.String("csp", "", "Content-Security-Policy sent with script responses, where {nonce} is replaced by a nonce made for every request and passed to the script as CSP_NONCE, e.g. \"script-src 'nonce-{nonce}' 'strict-dynamic'\"")
+
+// Scripts use the nonce in the tags of their inline scripts and styles:
+//
+//	<script nonce="$CSP_NONCE">...</script>
+//
+// Scripts sending their own Content-Security-Policy header replace the
+// configured one. Cached responses keep the nonce they were made with, so
+// scripts using the nonce shouldn't be cached.
+
+// cspPlaceholder is replaced by the nonce in the policy
+const cspPlaceholder = "{nonce}"
+
+// validateCSP checks the policy uses the nonce
+func validateCSP() error {
+	if *cspPolicy != "" && !strings.Contains(*cspPolicy, cspPlaceholder) {
+		return fmt.Errorf("-csp policy %q does not use %s", *cspPolicy, cspPlaceholder)
+	}
+	return nil
+}
+
+// newCSPNonce returns a random nonce, and the policy using it
+func newCSPNonce() (nonce, policy string) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce = base64.StdEncoding.EncodeToString(b)
+	return nonce, strings.ReplaceAll(*cspPolicy, cspPlaceholder, nonce)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"net/http"
+)
+
+var debugToken = flag.String("debug-token", "", "Secret that requests may send in the X-CGI-Debug header to get the script's stderr output and exit status appended to 5xx responses")
+
+// debugHeader carries the debug token of requests
+const debugHeader = "X-CGI-Debug"
+
+// maxDebugStderr is the most stderr output kept for a debugged request
+const maxDebugStderr = 64 << 10
+
+// debugKey is the context key of the debug information of a request
+type debugKey struct{}
+
+// debugInfo collects what a script left behind, to show it to developers
+type debugInfo struct {
+	stderr bytes.Buffer
+	exit   string
+}
+
+// debugging tells whether a request's failures should be reported in detail,
+// because its script is configured for debugging or the client sent the
+// debug token
+func debugging(r *http.Request, cfg *scriptConfig) bool {
+	if cfg.debug {
+		return true
+	}
+	token := r.Header.Get(debugHeader)
+	return *debugToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(*debugToken)) == 1
+}
+
+// requestDebugInfo returns the debug information collected for a request, or
+// nil if it is not debugged
+func requestDebugInfo(ctx context.Context) *debugInfo {
+	info, _ := ctx.Value(debugKey{}).(*debugInfo)
+	return info
+}
+
+// capture keeps a line of stderr output
+func (d *debugInfo) capture(line string) {
+	if d.stderr.Len() < maxDebugStderr {
+		d.stderr.WriteString(line + "\n")
+	}
+}
+
+// setExit records how the script ended
+func (d *debugInfo) setExit(err error) {
+	if err == nil {
+		d.exit = "exit status 0"
+	} else {
+		d.exit = err.Error()
+	}
+}
+
+// debugWriter tracks the status of a debugged response, dropping the
+// Content-Length of server errors so the debug information can follow them
+type debugWriter struct {
+	http.ResponseWriter
+	info   *debugInfo
+	status int
+}
+
+func (d *debugWriter) WriteHeader(code int) {
+	if d.status == 0 && code >= 200 {
+		d.status = code
+		if code >= 500 {
+			d.Header().Del("Content-Length")
+		}
+	}
+	d.ResponseWriter.WriteHeader(code)
+}
+
+func (d *debugWriter) Write(p []byte) (int, error) {
+	if d.status == 0 {
+		d.status = http.StatusOK
+	}
+	return d.ResponseWriter.Write(p)
+}
+
+func (d *debugWriter) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
+
+// report appends the debug information to server errors
+func (d *debugWriter) report() {
+	if d.status < 500 {
+		return
+	}
+	exit := d.info.exit
+	if exit == "" {
+		exit = "exit status unknown"
+	}
+	fmt.Fprintf(d.ResponseWriter, "\n--- stderr ---\n%s--- %s ---\n", d.info.stderr.Bytes(), exit)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// cgiTree is a generation of the CGI directory. Requests use the tree that
+// was active when they arrived until they complete, so swapping in a new
+// tree never changes the scripts under a request that is already running.
+type cgiTree struct {
+	dir      string
+	requests int
+	retired  bool
+	drained  chan struct{}
+}
+
+var (
+	treeMu      sync.Mutex
+	currentTree *cgiTree
+)
+
+// treeKey is the context key of the tree used by a request
+type treeKey struct{}
+
+func init() {
+	adminEndpoints["swap"] = handleSwap
+}
+
+// newCGITree creates a tree for a directory
+func newCGITree(dir string) *cgiTree {
+	return &cgiTree{dir: dir, drained: make(chan struct{})}
+}
+
+// acquireTree returns the active tree, counting the caller as one of its
+// requests until it calls release
+func acquireTree() *cgiTree {
+	treeMu.Lock()
+	defer treeMu.Unlock()
+	currentTree.requests++
+	return currentTree
+}
+
+// release ends a request against the tree
+func (t *cgiTree) release() {
+	treeMu.Lock()
+	defer treeMu.Unlock()
+	t.requests--
+	if t.retired && t.requests == 0 {
+		close(t.drained)
+	}
+}
+
+// withTree pins each request to the active CGI directory
+func withTree(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tree := acquireTree()
+		defer tree.release()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), treeKey{}, tree)))
+	})
+}
+
+// cgiRoot returns the CGI directory a request runs against
+func cgiRoot(r *http.Request) string {
+	if tree, ok := r.Context().Value(treeKey{}).(*cgiTree); ok {
+		return tree.dir
+	}
+	return activeCGIDir()
+}
+
+// activeCGIDir returns the directory of the active tree
+func activeCGIDir() string {
+	treeMu.Lock()
+	defer treeMu.Unlock()
+	return currentTree.dir
+}
+
+// swapTree makes a directory the active CGI directory and returns the tree it
+// replaces, which is drained once its last request completes
+func swapTree(dir string) (*cgiTree, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	dir = filepath.Clean(dir)
+
+	// Pin the new tree's scripts before any request can reach them
+	if *integrityManifest != "" {
+		hashes, err := loadIntegrityManifest(*integrityManifest, dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load integrity manifest: %v", err)
+		}
+		pinHashes(hashes)
+	}
+
+	treeMu.Lock()
+	old := currentTree
+	if dir == old.dir {
+		treeMu.Unlock()
+		return nil, fmt.Errorf("%s is already the active CGI directory", dir)
+	}
+	currentTree = newCGITree(dir)
+	old.retired = true
+	if old.requests == 0 {
+		close(old.drained)
+	}
+	treeMu.Unlock()
+
+	if *watchCGIDir {
+		if err := startWatcher(dir); err != nil {
+			log.Printf("Failed to watch %s: %v", dir, err)
+		}
+	}
+	log.Printf("Switched CGI directory from %s to %s", old.dir, dir)
+
+	go func() {
+		<-old.drained
+		unpinHashes(old.dir)
+		stopWorkerPools(old.dir)
+		log.Printf("Drained CGI directory %s", old.dir)
+	}()
+	return old, nil
+}
+
+// handleSwap switches the CGI directory to the "dir" form value, or to the
+// current target of -cgi-dir when it is a symlink that was repointed at a new
+// release, and responds once requests against the old directory are drained
+func handleSwap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dir := r.FormValue("dir")
+	if dir == "" {
+		resolved, err := filepath.EvalSymlinks(*cgiDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dir = resolved
+	}
+
+	old, err := swapTree(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Printf("CGI directory swap to %s failed: %v", dir, err)
+		return
+	}
+
+	select {
+	case <-old.drained:
+		fmt.Fprintf(w, "Switched to %s, %s drained\n", dir, old.dir)
+	case <-r.Context().Done():
+	}
+}
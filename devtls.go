@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	devTLS      = flag.Bool("dev-tls", false, "Serve HTTPS with a generated self-signed certificate for localhost, for development and testing")
+	devTLSCache = flag.String("dev-tls-cache", "", "Directory keeping the -dev-tls certificate across restarts, so browsers only need to accept it once; it is generated in memory otherwise")
+)
+
+// devCertificate returns the self-signed development certificate, reusing
+// the cached one while it is valid
+func devCertificate() (tls.Certificate, error) {
+	var certFile, keyFile string
+	if *devTLSCache != "" {
+		certFile = filepath.Join(*devTLSCache, "dev-cert.pem")
+		keyFile = filepath.Join(*devTLSCache, "dev-key.pem")
+		if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil && time.Now().Before(cert.Leaf.NotAfter) {
+			log.Printf("Using development certificate from %s", certFile)
+			return cert, nil
+		}
+	}
+
+	certPEM, keyPEM, err := generateDevCertificate()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if *devTLSCache != "" {
+		if err := os.MkdirAll(*devTLSCache, 0700); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+		log.Printf("Generated development certificate %s", certFile)
+	} else {
+		log.Printf("Generated in-memory development certificate")
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// generateDevCertificate creates a self-signed certificate valid for a year
+// for localhost, the loopback addresses and this host's name
+func generateDevCertificate() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		names = append(names, hostname)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"cgiserver development"}, CommonName: "localhost"},
+		DNSNames:              names,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
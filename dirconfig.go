@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dirConfigName is the per-directory configuration file, which applies to
+// scripts in its directory and below, like Apache's .htaccess. Each line is
+// "key = value":
+//
+//	timeout = 10s                  script timeout
+//	methods = GET, POST            allowed request methods
+//	auth-realm = Staff only        require HTTP basic authentication
+//	auth-user = alice:<sha256>     user and hex SHA-256 of their password
+//	env = NAME=value               extra environment variable
+//	trusted = true                 pass variables without shell metacharacter
+//	                               sanitization, for scripts that don't shell out
+//	debug = true                   append stderr output and exit status to 5xx
+//	                               responses, for staging servers
+//	webhook = github:<secret>      verify webhook signatures before running
+//	                               scripts, see webhook.go
+//	async = true                   run scripts in the background, see async.go
+//	queue = reports                job queue of asynchronous scripts
+//
+// auth-user and env may be repeated. Settings in subdirectories override or,
+// for auth-user and env, add to those of parent directories.
+const dirConfigName = ".cgiserver"
+
+// scriptConfig holds the settings that apply to a script
+type scriptConfig struct {
+	timeout     time.Duration
+	methods     []string
+	authRealm   string
+	authUsers   map[string]string
+	env         []string
+	concurrency int
+	contentType string
+	trusted     bool
+	debug       bool
+
+	webhookProvider string
+	webhookSecret   string
+	async           bool
+	queue           string
+}
+
+// dirConfigEntry caches a parsed configuration file
+type dirConfigEntry struct {
+	modTime time.Time
+	size    int64
+	lines   [][2]string
+}
+
+var (
+	dirConfigMu    sync.Mutex
+	dirConfigCache = make(map[string]dirConfigEntry)
+)
+
+// readDirConfig returns the key/value pairs of a configuration file, reusing
+// the parsed content until the file changes
+func readDirConfig(configPath string) ([][2]string, error) {
+	info, err := os.Stat(configPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dirConfigMu.Lock()
+	entry, ok := dirConfigCache[configPath]
+	dirConfigMu.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.lines, nil
+	}
+
+	f, err := os.Open(configPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines [][2]string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", configPath, n)
+		}
+		lines = append(lines, [2]string{strings.TrimSpace(key), strings.TrimSpace(value)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	dirConfigMu.Lock()
+	dirConfigCache[configPath] = dirConfigEntry{modTime: info.ModTime(), size: info.Size(), lines: lines}
+	dirConfigMu.Unlock()
+	return lines, nil
+}
+
+// apply merges settings into a configuration
+func (cfg *scriptConfig) apply(source string, lines [][2]string) error {
+	for _, kv := range lines {
+		key, value := kv[0], kv[1]
+		switch key {
+		case "timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("%s: invalid timeout %q", source, value)
+			}
+			cfg.timeout = d
+		case "methods":
+			cfg.methods = nil
+			for _, m := range strings.Split(value, ",") {
+				if m = strings.ToUpper(strings.TrimSpace(m)); m != "" {
+					cfg.methods = append(cfg.methods, m)
+				}
+			}
+		case "auth-realm":
+			cfg.authRealm = value
+		case "auth-user":
+			user, sum, ok := strings.Cut(value, ":")
+			if _, err := hex.DecodeString(sum); !ok || err != nil || len(sum) != sha256.Size*2 {
+				return fmt.Errorf("%s: invalid auth-user, expected user:sha256", source)
+			}
+			if cfg.authUsers == nil {
+				cfg.authUsers = make(map[string]string)
+			}
+			cfg.authUsers[user] = strings.ToLower(sum)
+		case "env":
+			if name, _, ok := strings.Cut(value, "="); !ok || name == "" {
+				return fmt.Errorf("%s: invalid env %q, expected NAME=value", source, value)
+			}
+			cfg.env = append(cfg.env, value)
+		case "trusted":
+			trusted, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid trusted %q, expected true or false", source, value)
+			}
+			cfg.trusted = trusted
+		case "debug":
+			debug, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid debug %q, expected true or false", source, value)
+			}
+			cfg.debug = debug
+		case "webhook":
+			provider, secret, err := parseWebhook(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", source, err)
+			}
+			cfg.webhookProvider, cfg.webhookSecret = provider, secret
+		case "async":
+			async, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid async %q, expected true or false", source, value)
+			}
+			cfg.async = async
+		case "queue":
+			if err := validQueue(value); err != nil {
+				return fmt.Errorf("%s: %v", source, err)
+			}
+			cfg.queue = value
+		default:
+			return fmt.Errorf("%s: unknown setting %q", source, key)
+		}
+	}
+	return nil
+}
+
+// loadScriptConfig merges the configuration files from the script directory
+// root down to the script's directory, then the script's sidecar file
+func loadScriptConfig(dir, scriptPath string) (*scriptConfig, error) {
+	cfg := &scriptConfig{timeout: *scriptTimeout}
+
+	root := filepath.Clean(dir)
+	rel, err := filepath.Rel(root, filepath.Dir(scriptPath))
+	if err != nil {
+		return nil, err
+	}
+	dirs := []string{root}
+	if rel != "." {
+		for _, component := range strings.Split(rel, string(filepath.Separator)) {
+			dirs = append(dirs, filepath.Join(dirs[len(dirs)-1], component))
+		}
+	}
+
+	for _, dir := range dirs {
+		configPath := filepath.Join(dir, dirConfigName)
+		lines, err := readDirConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.apply(configPath, lines); err != nil {
+			return nil, err
+		}
+	}
+
+	meta, err := readScriptMeta(scriptPath)
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil {
+		if err := cfg.applyMeta(scriptPath+scriptMetaSuffix, meta); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// allowsMethod checks the request method against the configured methods
+func (cfg *scriptConfig) allowsMethod(method string) bool {
+	return len(cfg.methods) == 0 || slices.Contains(cfg.methods, method)
+}
+
+// authenticate checks HTTP basic credentials when authentication is
+// required, and returns the authenticated user
+func (cfg *scriptConfig) authenticate(r *http.Request) (string, bool) {
+	if cfg.authRealm == "" {
+		return "", true
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	expected, known := cfg.authUsers[user]
+	sum := sha256.Sum256([]byte(password))
+	actual := hex.EncodeToString(sum[:])
+	if !known {
+		// Compare anyway so unknown users take as long as known ones
+		expected = strings.Repeat("0", len(actual))
+	}
+	return user, subtle.ConstantTimeCompare([]byte(actual), []byte(expected)) == 1 && known
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	// inFlight counts the requests being served, other than admin ones
+	inFlight atomic.Int64
+
+	// requestsServed counts the requests received, other than admin ones
+	requestsServed atomic.Int64
+	draining       atomic.Bool
+
+	// drainServer is the server stopped by the drain endpoint
+	drainServer *http.Server
+	drainOnce   sync.Once
+	drainDone   = make(chan struct{})
+)
+
+func init() {
+	adminEndpoints["drain"] = handleDrain
+}
+
+// withInFlight counts the requests in progress
+func withInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsServed.Add(1)
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startDrain stops the server from accepting connections, and closes the
+// existing ones as they become idle
+func startDrain() {
+	drainOnce.Do(func() {
+		draining.Store(true)
+		log.Printf("Draining: no longer accepting connections, %d requests in flight", inFlight.Load())
+		go func() {
+			drainServer.Shutdown(context.Background())
+			close(drainDone)
+		}()
+	})
+}
+
+// drainOnSignal starts a drain when the server is interrupted or terminated,
+// so it exits once the requests in flight complete, after stopping the
+// plugins. A second signal stops it at once.
+func drainOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	s := <-sig
+	signal.Stop(sig)
+	log.Printf("Received %s", s)
+	startDrain()
+}
+
+// waitDrained waits until a drain started with startDrain has closed every
+// connection
+func waitDrained() {
+	<-drainDone
+}
+
+// handleDrain is the "drain" admin endpoint. A POST stops accepting
+// connections and answers once every request in flight has completed, at
+// which point the server can be stopped without failing any request; the
+// server exits on its own once the remaining idle connections are closed.
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if drainServer == nil {
+		http.Error(w, "Draining is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	elapsed, err := drainRequests(r.Context())
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "Drained, all requests completed in %s\n", elapsed)
+}
+
+// drainRequests starts draining and waits until every request in flight has
+// completed, or the context ends
+func drainRequests(ctx context.Context) (time.Duration, error) {
+	startDrain()
+	start := time.Now()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for inFlight.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	elapsed := time.Since(start).Round(time.Millisecond)
+	log.Printf("Drained all requests in %s", elapsed)
+	return elapsed, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var dryRun = flag.Bool("dry-run", false, "Route, validate and log requests without running scripts, responding with a description of what would have run")
+
+// dryRunExecutor returns an executor that logs and describes the script a
+// request would have run, with the backend and configuration selected for it
+func dryRunExecutor(backend string, cfg *scriptConfig) func(context.Context, http.ResponseWriter, *http.Request, string, []string) error {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request, scriptPath string, env []string) error {
+		sorted := append([]string(nil), env...)
+		sort.Strings(sorted)
+		log.Printf("Dry run: %s %s would run %s via %s with environment: %s",
+			r.Method, r.RequestURI, scriptPath, backend, strings.Join(sorted, " "))
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Dry run, the script was not executed\n\n")
+		fmt.Fprintf(w, "Script:  %s\n", scriptPath)
+		fmt.Fprintf(w, "Backend: %s\n", backend)
+		fmt.Fprintf(w, "Timeout: %s\n", cfg.timeout)
+		if cfg.concurrency > 0 {
+			fmt.Fprintf(w, "Concurrency: %d\n", cfg.concurrency)
+		}
+		fmt.Fprintf(w, "\nEnvironment:\n")
+		for _, v := range sorted {
+			fmt.Fprintf(w, "  %s\n", v)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A script can send 103 Early Hints, letting browsers preload resources
+// while it is still computing the response, by starting its output with a
+// header block holding "Status: 103" and the hints, ended by a blank line:
+//
+//	Status: 103 Early Hints
+//	Link: </style.css>; rel=preload; as=style
+//
+//	Content-Type: text/html
+//
+//	<html>...
+//
+// The final header block and body follow as usual. Several hint blocks may
+// be sent.
+
+// isInterim tells whether a status is that of an interim response such as
+// 103 Early Hints, which precedes the final status. Wrappers recording the
+// status of a response skip these.
+func isInterim(status int) bool {
+	return status < 200
+}
+
+// isEarlyHints checks whether a header block is an early hints block
+func isEarlyHints(header http.Header) bool {
+	code, _, _ := strings.Cut(header.Get("Status"), " ")
+	n, err := strconv.Atoi(code)
+	return err == nil && n == http.StatusEarlyHints
+}
+
+// sendEarlyHints relays the Link headers of an early hints block as a 103
+// interim response. They are not carried over to the final response, which
+// has its own headers.
+func sendEarlyHints(w http.ResponseWriter, header http.Header) {
+	links := header.Values("Link")
+	if len(links) == 0 {
+		return
+	}
+	for _, link := range links {
+		w.Header().Add("Link", link)
+	}
+	w.WriteHeader(http.StatusEarlyHints)
+	w.Header().Del("Link")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+func init() {
+	commands["env"] = envCommand
+	adminEndpoints["debug/cgi-env"] = handleEnvDebug
+}
+
+// envCaptureHandler serves the requests of the debug endpoint: the handlers
+// of setupServer that change requests, without those logging them
+var envCaptureHandler http.Handler
+
+// envCaptureKey marks requests whose script is replaced by printEnvironment,
+// with the format of the environment, text or json
+type envCaptureKey struct{}
+
+// printEnvironment responds with the environment a script would have been
+// run with, one variable per line or as a JSON object, instead of running it
+func printEnvironment(ctx context.Context, w http.ResponseWriter, r *http.Request, scriptPath string, env []string) error {
+	if format, _ := r.Context().Value(envCaptureKey{}).(string); format == "json" {
+		vars := make(map[string]string, len(env))
+		for _, v := range env {
+			name, value, _ := strings.Cut(v, "=")
+			vars[name] = value
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(vars)
+	}
+	sorted := append([]string(nil), env...)
+	sort.Strings(sorted)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := fmt.Fprintln(w, strings.Join(sorted, "\n"))
+	return err
+}
+
+// handleEnvDebug responds with the environment that the script at the URL
+// given by the url parameter would get for the current request, as JSON:
+//
+//	GET /_cgiserver/debug/cgi-env?url=/cgi-bin/report.cgi%3Fyear%3D2024
+//
+// The request's method, headers and body stand for those of the request to
+// the script, except the Authorization header carrying the admin token. It is
+// rewritten and changed by header rules and hooks as the script's would be.
+func handleEnvDebug(w http.ResponseWriter, r *http.Request) {
+	target, err := url.ParseRequestURI(r.URL.Query().Get("url"))
+	if err != nil {
+		http.Error(w, "Expected the URL path of a script in the url parameter", http.StatusBadRequest)
+		return
+	}
+	r = r.Clone(context.WithValue(r.Context(), envCaptureKey{}, "json"))
+	r.URL = target
+	r.RequestURI = target.RequestURI()
+	r.Header.Del("Authorization")
+	envCaptureHandler.ServeHTTP(w, r)
+}
+
+// envCommand prints the sanitized environment the server would pass to the
+// script handling a request given on the command line:
+//
+//	cgiserver env [-method M] [-data D] [-header "Name: value"]... url|/path|script
+func envCommand(args []string) error {
+	flags := flag.NewFlagSet("env", flag.ExitOnError)
+	var rf requestFlags
+	rf.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: cgiserver [flags] env [-method M] [-data D] [-header \"Name: value\"]... url|/path|script")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	r, err := rf.build(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(context.WithValue(r.Context(), envCaptureKey{}, "text"))
+	handler := setupServer()
+	resp := newBufferedResponse()
+	handler.ServeHTTP(resp, r)
+	if resp.status != 0 && resp.status != http.StatusOK {
+		return fmt.Errorf("request refused with %d %s: %s", resp.status, http.StatusText(resp.status), strings.TrimSpace(resp.body.String()))
+	}
+	_, err = os.Stdout.Write(resp.body.Bytes())
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var envRulesFile = flag.String("env-rules", "", "File of validation rules for CGI variables, such as a pattern CONTENT_TYPE must match; requests breaking them are refused with 400")
+
+// Environment rules are read one per line as "NAME option...", where NAME is
+// a CGI variable like CONTENT_TYPE or HTTP_AUTHORIZATION, and options are:
+//
+//	required     the variable must be present and not empty
+//	max=N        the value may be at most N bytes long
+//	match=REGEX  the value must match the regular expression as a whole
+//
+// Rules are checked against the values received, before sanitization, and
+// an empty value only has to satisfy required. Patterns cannot contain
+// spaces, use \s instead. For example:
+//
+//	CONTENT_TYPE        match=[\w.+-]+/[\w.+-]+(;.*)?
+//	HTTP_AUTHORIZATION  max=4096 match=(Basic|Bearer)\s[A-Za-z0-9+/=._~-]+
+//	HTTP_X_API_KEY      required match=[0-9a-f]{32}
+
+// envRule is a parsed environment rule
+type envRule struct {
+	required bool
+	maxLen   int
+	pattern  *regexp.Regexp
+}
+
+// envRules are the rules in effect, by variable name
+var (
+	envRulesMu sync.RWMutex
+	envRules   map[string]envRule
+)
+
+// loadEnvRules reads an environment rules file
+func loadEnvRules(path string) (map[string]envRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := make(map[string]envRule)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected NAME option...", path, line)
+		}
+		rule := rules[fields[0]]
+		for _, option := range fields[1:] {
+			key, value, _ := strings.Cut(option, "=")
+			switch key {
+			case "required":
+				rule.required = true
+			case "max":
+				n, err := strconv.Atoi(value)
+				if err != nil || n <= 0 {
+					return nil, fmt.Errorf("%s:%d: invalid maximum length %q", path, line, value)
+				}
+				rule.maxLen = n
+			case "match":
+				pattern, err := regexp.Compile("^(?:" + value + ")$")
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+				}
+				rule.pattern = pattern
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown option %q", path, line, option)
+			}
+		}
+		rules[fields[0]] = rule
+	}
+	return rules, scanner.Err()
+}
+
+// checkEnvRule validates a variable against its rule, if it has one
+func checkEnvRule(name, value string) error {
+	envRulesMu.RLock()
+	rule, ok := envRules[name]
+	envRulesMu.RUnlock()
+	if !ok || value == "" {
+		return nil
+	}
+	if rule.maxLen > 0 && len(value) > rule.maxLen {
+		return fmt.Errorf("environment variable %s exceeds %d bytes", name, rule.maxLen)
+	}
+	if rule.pattern != nil && !rule.pattern.MatchString(value) {
+		return fmt.Errorf("environment variable %s does not match %s", name, rule.pattern)
+	}
+	return nil
+}
+
+// checkRequiredEnv makes sure every required variable was set
+func checkRequiredEnv(present map[string]bool) error {
+	envRulesMu.RLock()
+	defer envRulesMu.RUnlock()
+	for name, rule := range envRules {
+		if rule.required && !present[name] {
+			return fmt.Errorf("required environment variable %s is missing", name)
+		}
+	}
+	return nil
+}
+
+// reloadEnvRules replaces the rules in effect with those of the rules file
+func reloadEnvRules() error {
+	rules, err := loadEnvRules(*envRulesFile)
+	if err != nil {
+		return err
+	}
+	envRulesMu.Lock()
+	envRules = rules
+	envRulesMu.Unlock()
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errorPagesDir = flag.String("error-pages", "", "Directory of html/template files the server's own error responses are made from, named 404.html, 4xx.html or error.html")
+
+// The template used for an error is the first of <status>.html, 4xx.html or
+// 5xx.html, and error.html that exists. Templates receive:
+//
+//	.Status      status code, e.g. 404
+//	.StatusText  its text, e.g. Not Found
+//	.Message     the message of the error
+//	.RequestID   the X-Request-Id of the request, or one made up for it
+//	.Path        the request path
+//	.Time        when the error happened
+//
+// and the request ID is sent back as X-Request-Id. Error responses of
+// scripts, and of admin endpoints, are left alone.
+
+var errorPages *template.Template
+
+// errorPage is the data of error page templates
+type errorPage struct {
+	Status     int
+	StatusText string
+	Message    string
+	RequestID  string
+	Path       string
+	Time       time.Time
+}
+
+// validRequestID matches the request IDs taken from clients
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// loadErrorPages parses the error page templates
+func loadErrorPages(dir string) (*template.Template, error) {
+	return template.ParseGlob(filepath.Join(dir, "*.html"))
+}
+
+// errorTemplate returns the template for a status, or nil
+func errorTemplate(status int) *template.Template {
+	for _, name := range []string{strconv.Itoa(status), strconv.Itoa(status/100) + "xx", "error"} {
+		if t := errorPages.Lookup(name + ".html"); t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// requestID returns the ID a client gave a request, or a new one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); validRequestID.MatchString(id) {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withErrorPages replaces the server's own error responses with pages made
+// from the templates
+func withErrorPages(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, *adminPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ew := &errorPageWriter{ResponseWriter: w, r: r}
+		next.ServeHTTP(ew, r)
+		ew.finish()
+	})
+}
+
+// errorPageWriter recognizes the responses of http.Error and replaces them
+type errorPageWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	template *template.Template
+	status   int
+	done     bool
+}
+
+// serverError tells whether a response is being made by http.Error rather
+// than a script
+func serverError(h http.Header) bool {
+	return h.Get("Content-Type") == "text/plain; charset=utf-8" && h.Get("X-Content-Type-Options") == "nosniff" && h.Get("Content-Length") == ""
+}
+
+func (ew *errorPageWriter) WriteHeader(status int) {
+	if ew.status == 0 && status >= 400 && serverError(ew.Header()) {
+		if t := errorTemplate(status); t != nil {
+			// Wait for the message to send the page
+			ew.template, ew.status = t, status
+			return
+		}
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *errorPageWriter) Write(p []byte) (int, error) {
+	if ew.template == nil {
+		return ew.ResponseWriter.Write(p)
+	}
+	if !ew.done {
+		ew.render(strings.TrimSpace(string(p)))
+	}
+	return len(p), nil
+}
+
+func (ew *errorPageWriter) ReadFrom(src io.Reader) (int64, error) {
+	if ew.template == nil {
+		return readFrom(ew.ResponseWriter, src)
+	}
+	return io.Copy(struct{ io.Writer }{ew}, src)
+}
+
+// finish sends the page of an error that had no message
+func (ew *errorPageWriter) finish() {
+	if ew.template != nil && !ew.done {
+		ew.render("")
+	}
+}
+
+// render sends the error page
+func (ew *errorPageWriter) render(message string) {
+	ew.done = true
+	page := errorPage{
+		Status:     ew.status,
+		StatusText: http.StatusText(ew.status),
+		Message:    message,
+		RequestID:  requestID(ew.r),
+		Path:       ew.r.URL.Path,
+		Time:       time.Now(),
+	}
+	var buf bytes.Buffer
+	h := ew.Header()
+	h.Set("X-Request-Id", page.RequestID)
+	if err := ew.template.Execute(&buf, page); err != nil {
+		log.Printf("Error page %s failed: %v", ew.template.Name(), err)
+		ew.ResponseWriter.WriteHeader(ew.status)
+		fmt.Fprintln(ew.ResponseWriter, message)
+		return
+	}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	ew.ResponseWriter.WriteHeader(ew.status)
+	ew.ResponseWriter.Write(buf.Bytes())
+}
+
+func (ew *errorPageWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+var fastcgiUpstreams = flag.String("fastcgi", "", "Comma-separated list of extension-or-prefix=address FastCGI upstreams, e.g. .php=unix:/run/php-fpm.sock")
+
+// FastCGI record types and constants, see
+// https://fast-cgi.github.io/spec
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+	fcgiRequestID    = 1
+	fcgiMaxContent   = 65535
+)
+
+// fcgiPadding is written to align records on 8 bytes
+var fcgiPadding [8]byte
+
+// fcgiWriter writes FastCGI records for a single request
+type fcgiWriter struct {
+	w *bufio.Writer
+}
+
+// writeRecord writes one record, which must fit in fcgiMaxContent bytes
+func (fw *fcgiWriter) writeRecord(recType uint8, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	header := [8]byte{fcgiVersion, recType, 0, fcgiRequestID, 0, 0, uint8(padding), 0}
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+	if _, err := fw.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := fw.w.Write(content); err != nil {
+		return err
+	}
+	_, err := fw.w.Write(fcgiPadding[:padding])
+	return err
+}
+
+// writeStream writes data as a stream of records, terminated by an empty one
+func (fw *fcgiWriter) writeStream(recType uint8, data []byte) error {
+	for len(data) > 0 {
+		n := min(len(data), fcgiMaxContent)
+		if err := fw.writeRecord(recType, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return fw.writeRecord(recType, nil)
+}
+
+// fcgiEncodeParams encodes environment variables as FastCGI name-value pairs
+func fcgiEncodeParams(env []string) []byte {
+	var buf []byte
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		for _, n := range []int{len(name), len(value)} {
+			if n < 128 {
+				buf = append(buf, byte(n))
+			} else {
+				buf = binary.BigEndian.AppendUint32(buf, uint32(n)|1<<31)
+			}
+		}
+		buf = append(buf, name...)
+		buf = append(buf, value...)
+	}
+	return buf
+}
+
+// fcgiStdoutReader exposes the FCGI_STDOUT stream of a response as a reader,
+// logging FCGI_STDERR output and stopping at FCGI_END_REQUEST
+type fcgiStdoutReader struct {
+	r         *bufio.Reader
+	remaining int
+	padding   int
+	done      bool
+	stderr    *stderrLog
+}
+
+func (fr *fcgiStdoutReader) Read(p []byte) (int, error) {
+	for fr.remaining == 0 {
+		if fr.done {
+			return 0, io.EOF
+		}
+		if err := fr.next(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := fr.r.Read(p[:min(len(p), fr.remaining)])
+	fr.remaining -= n
+	if fr.remaining == 0 && err == nil {
+		_, err = fr.r.Discard(fr.padding)
+	}
+	return n, err
+}
+
+// next reads record headers until the start of stdout content
+func (fr *fcgiStdoutReader) next() error {
+	var header [8]byte
+	if _, err := io.ReadFull(fr.r, header[:]); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	length := int(binary.BigEndian.Uint16(header[4:6]))
+	padding := int(header[6])
+
+	switch header[1] {
+	case fcgiStdout:
+		fr.remaining, fr.padding = length, padding
+		if length == 0 {
+			_, err := fr.r.Discard(padding)
+			return err
+		}
+		return nil
+	case fcgiStderr:
+		content := make([]byte, length+padding)
+		if _, err := io.ReadFull(fr.r, content); err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(strings.NewReader(string(content[:length])))
+		for scanner.Scan() {
+			fr.stderr.line(scanner.Text())
+		}
+		return nil
+	case fcgiEndRequest:
+		fr.done = true
+		_, err := fr.r.Discard(length + padding)
+		return err
+	default:
+		_, err := fr.r.Discard(length + padding)
+		return err
+	}
+}
+
+// serveFastCGI forwards a request as a FastCGI responder request and
+// translates the response with the same code as for CGI scripts
+func serveFastCGI(conn net.Conn, w http.ResponseWriter, r *http.Request, scriptPath string, env []string) error {
+	// Application servers such as php-fpm locate the script through
+	// SCRIPT_FILENAME
+	if absPath, err := filepath.Abs(scriptPath); err == nil && !hasEnv(env, "SCRIPT_FILENAME") {
+		env = append(env, "SCRIPT_FILENAME="+absPath)
+	}
+
+	// Send the request in a separate goroutine so the application can start
+	// responding before it has consumed the whole body
+	errc := make(chan error, 1)
+	go func() {
+		fw := &fcgiWriter{w: bufio.NewWriter(conn)}
+		errc <- writeFastCGIRequest(fw, r, env)
+	}()
+
+	stderr := newStderrLog("FastCGI stderr")
+	stderr.debug = requestDebugInfo(r.Context())
+	defer stderr.close()
+	var output io.Reader = &fcgiStdoutReader{r: bufio.NewReader(conn), stderr: stderr}
+	if t := requestTrace(r.Context()); t != nil {
+		output = io.TeeReader(output, &t.output)
+	}
+	err := relayCGIResponse(output, w)
+	if err != nil {
+		// Unblock the writer if the application stopped reading
+		conn.Close()
+	}
+	if werr := <-errc; err == nil && werr != nil {
+		err = fmt.Errorf("error sending FastCGI request: %v", werr)
+	}
+	return err
+}
+
+// writeFastCGIRequest sends the begin request, params and stdin records
+func writeFastCGIRequest(fw *fcgiWriter, r *http.Request, env []string) error {
+	// Role responder, and ask the application to close the connection
+	if err := fw.writeRecord(fcgiBeginRequest, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+	if err := fw.writeStream(fcgiParams, fcgiEncodeParams(env)); err != nil {
+		return err
+	}
+
+	if r.Body != nil {
+		buf := copyBuffers.Get().(*[]byte)
+		defer copyBuffers.Put(buf)
+		for {
+			n, err := r.Body.Read(*buf)
+			if n > 0 {
+				if werr := fw.writeRecord(fcgiStdin, (*buf)[:n]); werr != nil {
+					return werr
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := fw.writeRecord(fcgiStdin, nil); err != nil {
+		return err
+	}
+	return fw.w.Flush()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	gitPullInterval  = flag.Duration("git-pull-interval", 0, "How often to pull the CGI directory, a git checkout, from its upstream (0 disables)")
+	gitWebhook       = flag.String("git-webhook", "", "URL path of a webhook that makes the server pull the CGI directory, e.g. /hooks/deploy")
+	gitWebhookSecret = flag.String("git-webhook-secret", "", "Secret authenticating the git webhook, checked against X-Hub-Signature-256 or X-Gitlab-Token")
+)
+
+// gitPullTimeout bounds a single pull
+const gitPullTimeout = 2 * time.Minute
+
+// gitPulls requests a pull; pending requests are coalesced
+var gitPulls = make(chan struct{}, 1)
+
+// git runs a git command in a directory and returns its trimmed output
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// startGitDeploy checks the CGI directory is a git checkout and starts
+// pulling it on schedule and when the webhook is called
+func startGitDeploy() error {
+	if *gitWebhook != "" && *gitWebhookSecret == "" {
+		return fmt.Errorf("-git-webhook requires -git-webhook-secret")
+	}
+	if _, err := git(context.Background(), activeCGIDir(), "rev-parse", "--is-inside-work-tree"); err != nil {
+		return err
+	}
+
+	if *gitWebhook != "" {
+		http.HandleFunc(*gitWebhook, handleGitWebhook)
+	}
+	go func() {
+		var tick <-chan time.Time
+		if *gitPullInterval > 0 {
+			tick = time.Tick(*gitPullInterval)
+		}
+		for {
+			select {
+			case <-tick:
+			case <-gitPulls:
+			}
+			if err := gitPull(activeCGIDir()); err != nil {
+				log.Printf("Git deploy failed: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// gitPull fast-forwards a checkout and, if it changed, refreshes everything
+// derived from the scripts it contains
+func gitPull(dir string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gitPullTimeout)
+	defer cancel()
+
+	before, err := git(ctx, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	if _, err := git(ctx, dir, "pull", "--ff-only", "--quiet"); err != nil {
+		return err
+	}
+	after, err := git(ctx, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	if after == before {
+		return nil
+	}
+	log.Printf("Git deploy: %s updated from %.12s to %.12s", dir, before, after)
+
+	invalidateStat(filepath.Clean(dir))
+	if *integrityManifest != "" {
+		hashes, err := loadIntegrityManifest(*integrityManifest, dir)
+		if err != nil {
+			return fmt.Errorf("failed to reload integrity manifest: %v", err)
+		}
+		unpinHashes(dir)
+		pinHashes(hashes)
+	}
+	if *watchCGIDir {
+		if err := startWatcher(dir); err != nil {
+			return err
+		}
+	}
+	revalidateScripts(dir)
+	return nil
+}
+
+// revalidateScripts logs the scripts of a freshly deployed tree that requests
+// will be refused for
+func revalidateScripts(dir string) {
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !hasAllowedExtension(p) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if !isValidScript(p, info) {
+			log.Printf("Git deploy: %s is not an executable script", p)
+			return nil
+		}
+		if *suexecChecks {
+			if reason, err := suexecViolation(p); err == nil && reason != "" {
+				log.Printf("Git deploy: %s will be refused: %s", p, reason)
+			}
+		}
+		return nil
+	})
+}
+
+// verifyGitWebhook checks a GitHub-style HMAC signature of the body or a
+// GitLab-style token
+func verifyGitWebhook(r *http.Request, body []byte) bool {
+	if sig := r.Header.Get("X-Hub-Signature-256"); sig != "" {
+		return validHubSignature(sig, *gitWebhookSecret, body)
+	}
+	return validGitlabToken(r.Header.Get("X-Gitlab-Token"), *gitWebhookSecret)
+}
+
+// handleGitWebhook schedules a pull when an authenticated push notification
+// arrives
+func handleGitWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !verifyGitWebhook(r, body) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		log.Printf("Rejected unauthenticated git webhook from %s", r.RemoteAddr)
+		auditReject(r, auditAdminAuthFailed, "git webhook")
+		return
+	}
+
+	select {
+	case gitPulls <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Pull scheduled")
+}
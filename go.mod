@@ -0,0 +1,28 @@
+module github.com/fazalmajid/cgiserver
+
+go 1.23.0
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/fsnotify/fsnotify v1.10.1
+	github.com/hashicorp/go-plugin v1.6.3
+	github.com/yuin/gopher-lua v1.1.2
+	golang.org/x/crypto v0.36.0
+	golang.org/x/sys v0.31.0
+	google.golang.org/grpc v1.70.0
+	google.golang.org/protobuf v1.36.11
+)
+
+require (
+	github.com/fatih/color v1.7.0 // indirect
+	github.com/golang/protobuf v1.5.4 // indirect
+	github.com/hashicorp/go-hclog v0.14.1 // indirect
+	github.com/hashicorp/yamux v0.1.1 // indirect
+	github.com/mattn/go-colorable v0.1.4 // indirect
+	github.com/mattn/go-isatty v0.0.17 // indirect
+	github.com/oklog/run v1.0.0 // indirect
+	golang.org/x/net v0.34.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20241202173237-19429a94021a // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	goplugin "plugin"
+	"strings"
+
+	"github.com/fazalmajid/cgiserver/cgiplugin"
+)
+
+var goPlugins = flag.String("go-plugins", "", "Comma-separated Go plugins (.so) to load, adding middleware or routes in process, see the cgiplugin package")
+
+// middlewares wrap the handler of non-admin requests, the first loaded
+// outermost
+var middlewares []func(http.Handler) http.Handler
+
+// loadGoPlugins loads the Go plugins, registering their routes
+func loadGoPlugins(paths string) error {
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		p, err := goplugin.Open(path)
+		if err != nil {
+			return err
+		}
+		var hooks []string
+		if sym, err := p.Lookup(cgiplugin.MiddlewareSymbol); err == nil {
+			middleware, ok := sym.(func(http.Handler) http.Handler)
+			if !ok {
+				return fmt.Errorf("%s: %s is a %T, not a func(http.Handler) http.Handler", path, cgiplugin.MiddlewareSymbol, sym)
+			}
+			middlewares = append(middlewares, middleware)
+			hooks = append(hooks, "middleware")
+		}
+		if sym, err := p.Lookup(cgiplugin.RoutesSymbol); err == nil {
+			routes, ok := sym.(func(*http.ServeMux))
+			if !ok {
+				return fmt.Errorf("%s: %s is a %T, not a func(*http.ServeMux)", path, cgiplugin.RoutesSymbol, sym)
+			}
+			routes(http.DefaultServeMux)
+			hooks = append(hooks, "routes")
+		}
+		if len(hooks) == 0 {
+			return fmt.Errorf("%s: exports neither %s nor %s", path, cgiplugin.MiddlewareSymbol, cgiplugin.RoutesSymbol)
+		}
+		log.Printf("Loaded Go plugin %s: %s", filepath.Base(path), strings.Join(hooks, ", "))
+	}
+	return nil
+}
+
+// withMiddlewares wraps a handler in the middleware of the Go plugins
+func withMiddlewares(next http.Handler) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		next = middlewares[i](next)
+	}
+	return next
+}
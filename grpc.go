@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/fazalmajid/cgiserver/adminpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var grpcSocket = flag.String("grpc-socket", "", "Unix socket to serve the gRPC control plane on, see adminpb/admin.proto; only its owner may connect")
+
+// startGRPC serves the control plane on its Unix socket
+func startGRPC(path string) error {
+	// Remove the socket left behind by a previous run
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	// Create the socket in a directory only the server can enter, and move
+	// it into place once only its owner may connect
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".grpc-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "socket")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0600); err != nil {
+		ln.Close()
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return err
+	}
+	server := grpc.NewServer()
+	adminpb.RegisterAdminServer(server, adminService{})
+	go func() {
+		if err := server.Serve(ln); err != nil {
+			log.Printf("gRPC control plane stopped: %v", err)
+		}
+	}()
+	log.Printf("Serving gRPC control plane on %s", path)
+	return nil
+}
+
+// adminService implements the control plane
+type adminService struct {
+	adminpb.UnimplementedAdminServer
+}
+
+func (adminService) ListProcesses(ctx context.Context, req *adminpb.ListProcessesRequest) (*adminpb.ListProcessesResponse, error) {
+	resp := &adminpb.ListProcessesResponse{}
+	for _, p := range processList() {
+		resp.Processes = append(resp.Processes, &adminpb.Process{
+			Pid:        int32(p.PID),
+			Script:     p.Script,
+			RemoteAddr: p.RemoteAddr,
+			Started:    timestamppb.New(p.Started),
+		})
+	}
+	return resp, nil
+}
+
+func (adminService) Drain(ctx context.Context, req *adminpb.DrainRequest) (*adminpb.DrainResponse, error) {
+	if drainServer == nil {
+		return nil, status.Error(codes.Unavailable, "draining is not available")
+	}
+	log.Printf("Drain requested over gRPC")
+	elapsed, err := drainRequests(ctx)
+	if err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	return &adminpb.DrainResponse{Elapsed: durationpb.New(elapsed)}, nil
+}
+
+func (adminService) ReloadConfig(ctx context.Context, req *adminpb.ReloadConfigRequest) (*adminpb.ReloadConfigResponse, error) {
+	reloaded, err := reloadConfig()
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &adminpb.ReloadConfigResponse{Reloaded: reloaded}, nil
+}
+
+func (adminService) SetScriptEnabled(ctx context.Context, req *adminpb.SetScriptEnabledRequest) (*adminpb.SetScriptEnabledResponse, error) {
+	if req.Script == "" {
+		return nil, status.Error(codes.InvalidArgument, "script is required")
+	}
+	return &adminpb.SetScriptEnabledResponse{DisabledScripts: setScriptEnabled(req.Script, req.Enabled)}, nil
+}
+
+func (adminService) GetStats(ctx context.Context, req *adminpb.GetStatsRequest) (*adminpb.GetStatsResponse, error) {
+	stats := currentStats()
+	return &adminpb.GetStatsResponse{
+		Version:         stats.Version,
+		Started:         timestamppb.New(stats.Started),
+		Requests:        stats.Requests,
+		InFlight:        stats.InFlight,
+		Processes:       int64(stats.Processes),
+		JobsQueued:      int64(stats.JobsQueued),
+		JobsRunning:     int64(stats.JobsRunning),
+		DisabledScripts: stats.DisabledScripts,
+		Draining:        stats.Draining,
+	}, nil
+}
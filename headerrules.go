@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	headerRulesFile        = flag.String("header-rules", "", "File of response header rules setting, adding or removing headers by request path or host")
+	requestHeaderRulesFile = flag.String("request-header-rules", "", "File of request header rules setting, adding or removing headers by request path or host before scripts see them")
+)
+
+// Header rules are read one per line as "pattern action Name [value]", and
+// applied in order to the responses, or with -request-header-rules the
+// requests, whose path matches the pattern, a regular expression. Patterns
+// starting with host: are matched against the host instead. Actions are:
+//
+//	set      replace the header with the value
+//	add      add the value to those of the header
+//	remove   remove the header
+//	default  set the header only if the response lacks it
+//
+// For example:
+//
+//	.                      remove   X-Powered-By
+//	^/cgi-bin/legacy/      default  Content-Type text/html; charset=iso-8859-1
+//	^/cgi-bin/api/         set      Cache-Control no-store
+//
+// Values of request header rules can refer to the request as ${host},
+// ${remote_addr} (without the port) and ${scheme}, for example:
+//
+//	.                      remove   X-Real-IP
+//	host:^shop\.           set      X-Forwarded-Host ${host}
+//
+// Headers set, added or defaulted by request header rules are passed to
+// scripts even if they aren't among those normally passed.
+
+// headerRule is a parsed header rule
+type headerRule struct {
+	pattern *regexp.Regexp
+	host    bool
+	action  string
+	name    string
+	value   string
+}
+
+// loadHeaderRules reads a header rules file
+func loadHeaderRules(path string) ([]headerRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []headerRule
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected pattern action Name [value]", path, line)
+		}
+		expr, host := strings.CutPrefix(fields[0], "host:")
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		rule := headerRule{pattern: pattern, host: host, action: fields[1], name: http.CanonicalHeaderKey(fields[2]), value: strings.Join(fields[3:], " ")}
+		switch rule.action {
+		case "set", "add", "default":
+			if rule.value == "" {
+				return nil, fmt.Errorf("%s:%d: %s requires a value", path, line, rule.action)
+			}
+		case "remove":
+			if rule.value != "" {
+				return nil, fmt.Errorf("%s:%d: remove takes no value", path, line)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown action %q", path, line, rule.action)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// ruleHeadersKey is the context key of the CGI names of the request headers
+// set by header rules
+type ruleHeadersKey struct{}
+
+// matches tells whether a rule applies to a request
+func (rule headerRule) matches(r *http.Request) bool {
+	if rule.host {
+		return rule.pattern.MatchString(r.Host)
+	}
+	return rule.pattern.MatchString(r.URL.Path)
+}
+
+// applyHeaderRules applies rules to a header, expanding their values with
+// expand if it isn't nil
+func applyHeaderRules(h http.Header, rules []headerRule, expand func(string) string) {
+	for _, rule := range rules {
+		value := rule.value
+		if expand != nil {
+			value = os.Expand(value, expand)
+		}
+		switch rule.action {
+		case "set":
+			h.Set(rule.name, value)
+		case "add":
+			h.Add(rule.name, value)
+		case "remove":
+			h.Del(rule.name)
+		case "default":
+			if h.Get(rule.name) == "" {
+				h.Set(rule.name, value)
+			}
+		}
+	}
+}
+
+// withRequestHeaderRules applies the header rules matching a request to it
+func withRequestHeaderRules(rules []headerRule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expand := func(name string) string {
+			switch name {
+			case "host":
+				return r.Host
+			case "remote_addr":
+				ip, _, err := net.SplitHostPort(r.RemoteAddr)
+				if err != nil {
+					return r.RemoteAddr
+				}
+				return ip
+			case "scheme":
+				if r.TLS != nil {
+					return "https"
+				}
+				return "http"
+			}
+			return ""
+		}
+		var matched []headerRule
+		for _, rule := range rules {
+			if rule.matches(r) {
+				matched = append(matched, rule)
+			}
+		}
+		if len(matched) > 0 {
+			names := make(map[string]bool)
+			for _, rule := range matched {
+				if rule.action != "remove" {
+					names[strings.ToUpper(strings.ReplaceAll(rule.name, "-", "_"))] = true
+				}
+			}
+			r = r.Clone(context.WithValue(r.Context(), ruleHeadersKey{}, names))
+			applyHeaderRules(r.Header, matched, expand)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ruleHeader tells whether a request header, by its CGI name, was set by a
+// header rule
+func ruleHeader(r *http.Request, name string) bool {
+	names, _ := r.Context().Value(ruleHeadersKey{}).(map[string]bool)
+	return names[name]
+}
+
+// withHeaderRules applies the header rules matching a request to its
+// response
+func withHeaderRules(rules []headerRule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var matched []headerRule
+		for _, rule := range rules {
+			if rule.matches(r) {
+				matched = append(matched, rule)
+			}
+		}
+		if len(matched) > 0 {
+			w = &headerRewriter{ResponseWriter: w, rules: matched}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headerRewriter applies header rules to a response as its headers are sent
+type headerRewriter struct {
+	http.ResponseWriter
+	rules   []headerRule
+	applied bool
+}
+
+// apply applies the rules, once
+func (hw *headerRewriter) apply() {
+	if hw.applied {
+		return
+	}
+	hw.applied = true
+	applyHeaderRules(hw.Header(), hw.rules, nil)
+}
+
+func (hw *headerRewriter) WriteHeader(status int) {
+	if !isInterim(status) {
+		hw.apply()
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headerRewriter) Write(p []byte) (int, error) {
+	hw.apply()
+	return hw.ResponseWriter.Write(p)
+}
+
+func (hw *headerRewriter) ReadFrom(src io.Reader) (int64, error) {
+	hw.apply()
+	return readFrom(hw.ResponseWriter, src)
+}
+
+func (hw *headerRewriter) Flush() {
+	hw.apply()
+	http.NewResponseController(hw.ResponseWriter).Flush()
+}
+
+func (hw *headerRewriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
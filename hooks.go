@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+var (
+	hooksFile   = flag.String("hooks", "", "Lua file defining an on_request(req) hook run before every request to scripts")
+	hookTimeout = flag.Duration("hook-timeout", 50*time.Millisecond, "Maximum time the request hook may run for, past which the request fails")
+)
+
+// The hooks file is a Lua script defining a function called for every
+// request that isn't an admin one, after rewrite rules, with a table holding
+// its method, path, query, host and remote_addr. It can call:
+//
+//	header(name)            a request header, or nil
+//	rewrite(url)            serve another path and query instead
+//	setenv(name, value)     add a variable to the environment of the script
+//	deny(status, message)   refuse the request once the hook returns
+//	print(...)              write to the server log
+//
+// For example:
+//
+//	function on_request(req)
+//	  if req.path:find("^/cgi%-bin/admin/") and req.remote_addr:sub(1, 4) ~= "10." then
+//	    deny(403, "Forbidden")
+//	  end
+//	  setenv("HOOK_COUNTRY", header("CF-IPCountry") or "")
+//	end
+//
+// Hooks only have the base, string, table and math libraries, without file
+// access, and a fresh interpreter for every request. They are stopped past
+// -hook-timeout and with a bounded stack, and failing hooks fail the request.
+// string.rep is limited to results of 1 MiB, but the interpreter has no
+// memory limit otherwise: what a hook allocates is only bounded by what it
+// can allocate within -hook-timeout, so the hooks file must be trusted. The
+// file is reread by the reload admin operation.
+
+// hookFunction is the name of the function called by the hooks file
+const hookFunction = "on_request"
+
+// hookCallStack and hookRegistry bound the call depth and the number of
+// values on the stack of the hook interpreter, and hookMaxRep the length of
+// the strings string.rep makes
+const (
+	hookCallStack = 64
+	hookRegistry  = 64 * 1024
+	hookMaxRep    = 1 << 20
+)
+
+// hookEnvKey is the context key of the variables set by the request hook
+type hookEnvKey struct{}
+
+var (
+	hooksMu sync.RWMutex
+	hooks   *lua.FunctionProto
+)
+
+// hookResult is what the request hook asked for
+type hookResult struct {
+	rewrite string
+	env     []string
+	status  int
+	message string
+}
+
+// loadHooks compiles a hooks file
+func loadHooks(path string) (*lua.FunctionProto, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunk, err := parse.Parse(f, path)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, path)
+}
+
+// reloadHooks replaces the hooks in effect with those of the hooks file
+func reloadHooks() error {
+	proto, err := loadHooks(*hooksFile)
+	if err != nil {
+		return err
+	}
+	hooksMu.Lock()
+	hooks = proto
+	hooksMu.Unlock()
+	return nil
+}
+
+// newHookState returns an interpreter with only the safe libraries
+func newHookState() *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   hookCallStack,
+		RegistryMaxSize: hookRegistry,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// Leave out the base functions loading code from files or strings
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	// Keep string.rep, also called as s:rep(n), from making huge strings
+	// in one call
+	L.GetGlobal(lua.StringLibName).(*lua.LTable).RawSetString("rep", L.NewFunction(func(L *lua.LState) int {
+		s, n := L.CheckString(1), L.CheckInt(2)
+		if n > 0 && len(s) > hookMaxRep/n {
+			L.RaiseError("string.rep result larger than %d bytes", hookMaxRep)
+		}
+		L.Push(lua.LString(strings.Repeat(s, max(n, 0))))
+		return 1
+	}))
+	return L
+}
+
+// runHook calls the request hook for a request
+func runHook(ctx context.Context, r *http.Request) (*hookResult, error) {
+	hooksMu.RLock()
+	proto := hooks
+	hooksMu.RUnlock()
+
+	L := newHookState()
+	defer L.Close()
+	ctx, cancel := context.WithTimeout(ctx, *hookTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	result := &hookResult{}
+	L.SetGlobal("header", L.NewFunction(func(L *lua.LState) int {
+		if value := r.Header.Get(L.CheckString(1)); value != "" {
+			L.Push(lua.LString(value))
+		} else {
+			L.Push(lua.LNil)
+		}
+		return 1
+	}))
+	L.SetGlobal("rewrite", L.NewFunction(func(L *lua.LState) int {
+		url := L.CheckString(1)
+		if !strings.HasPrefix(url, "/") {
+			L.ArgError(1, "URL must start with /")
+		}
+		result.rewrite = url
+		return 0
+	}))
+	L.SetGlobal("setenv", L.NewFunction(func(L *lua.LState) int {
+		name, value := L.CheckString(1), L.CheckString(2)
+		if name == "" || strings.ContainsAny(name, "=\x00") || strings.Contains(value, "\x00") {
+			L.ArgError(1, "invalid environment variable")
+		}
+		result.env = append(result.env, name+"="+value)
+		return 0
+	}))
+	L.SetGlobal("deny", L.NewFunction(func(L *lua.LState) int {
+		status := L.CheckInt(1)
+		if status < 400 || status > 599 {
+			L.ArgError(1, "status must be 4xx or 5xx")
+		}
+		result.status = status
+		result.message = L.OptString(2, http.StatusText(status))
+		return 0
+	}))
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		args := make([]string, L.GetTop())
+		for i := range args {
+			args[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		log.Printf("Hook: %s", strings.Join(args, " "))
+		return 0
+	}))
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		return nil, err
+	}
+	fn, ok := L.GetGlobal(hookFunction).(*lua.LFunction)
+	if !ok {
+		return nil, fmt.Errorf("%s is not defined", hookFunction)
+	}
+	req := L.NewTable()
+	req.RawSetString("method", lua.LString(r.Method))
+	req.RawSetString("path", lua.LString(r.URL.Path))
+	req.RawSetString("query", lua.LString(r.URL.RawQuery))
+	req.RawSetString("host", lua.LString(r.Host))
+	req.RawSetString("remote_addr", lua.LString(r.RemoteAddr))
+	if err := L.CallByParam(lua.P{Fn: fn, Protect: true}, req); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("exceeded %s", *hookTimeout)
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// withHooks runs the request hook before passing requests on
+func withHooks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, err := runHook(r.Context(), r)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Printf("Request hook failed for %s: %v", r.URL.Path, err)
+			return
+		}
+		if result.status != 0 {
+			http.Error(w, result.message, result.status)
+			log.Printf("Request hook denied %s from %s with %d", r.URL.Path, r.RemoteAddr, result.status)
+			return
+		}
+		if result.rewrite != "" {
+			ctx := r.Context()
+			if _, ok := ctx.Value(originalURIKey{}).(string); !ok {
+				ctx = context.WithValue(ctx, originalURIKey{}, r.RequestURI)
+			}
+			// The handlers around keep seeing the original URL
+			r = r.Clone(ctx)
+			path, query, _ := strings.Cut(result.rewrite, "?")
+			r.URL.Path = path
+			r.URL.RawPath = ""
+			r.URL.RawQuery = query
+			r.RequestURI = r.URL.RequestURI()
+		}
+		if len(result.env) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), hookEnvKey{}, result.env))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hookEnv returns the variables the request hook set for a request
+func hookEnv(r *http.Request) []string {
+	env, _ := r.Context().Value(hookEnvKey{}).([]string)
+	return env
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var integrityManifest = flag.String("integrity-manifest", "", "File of SHA-256 checksums in sha256sum format, with paths relative to the CGI directory or absolute; only listed scripts with matching hashes may run")
+
+// pinnedHashes maps cleaned script paths to their expected SHA-256, and is
+// nil when no manifest is configured
+var (
+	pinnedMu     sync.RWMutex
+	pinnedHashes map[string]string
+)
+
+// hashEntry caches the hash of a script for a given modification time and size
+type hashEntry struct {
+	modTime time.Time
+	size    int64
+	sum     string
+}
+
+var (
+	hashCacheMu sync.Mutex
+	hashCache   = make(map[string]hashEntry)
+)
+
+// loadIntegrityManifest reads a manifest in the format produced by
+// "sha256sum" run from the CGI directory dir, or with absolute paths for
+// scripts in aliased directories, checking its signature if signatures are
+// required
+func loadIntegrityManifest(manifest, dir string) (map[string]string, error) {
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	// A signed manifest vouches for every script it lists
+	if trustedKeys != nil {
+		if err := verifyFileSignature(manifest, data); err != nil {
+			return nil, fmt.Errorf("%s: signature verification failed: %v", manifest, err)
+		}
+	}
+
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		sum, name, ok := strings.Cut(text, " ")
+		name = strings.TrimPrefix(strings.TrimSpace(name), "*")
+		if _, err := hex.DecodeString(sum); !ok || err != nil || len(sum) != sha256.Size*2 || name == "" {
+			return nil, fmt.Errorf("%s:%d: invalid checksum line", manifest, line)
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		hashes[filepath.Clean(name)] = strings.ToLower(sum)
+	}
+	return hashes, scanner.Err()
+}
+
+// pinHashes adds hashes to the pinned ones
+func pinHashes(hashes map[string]string) {
+	pinnedMu.Lock()
+	defer pinnedMu.Unlock()
+	if pinnedHashes == nil {
+		pinnedHashes = make(map[string]string)
+	}
+	for name, sum := range hashes {
+		pinnedHashes[name] = sum
+	}
+}
+
+// unpinHashes forgets the hashes of the scripts under a directory
+func unpinHashes(dir string) {
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+	pinnedMu.Lock()
+	defer pinnedMu.Unlock()
+	for name := range pinnedHashes {
+		if strings.HasPrefix(name, prefix) {
+			delete(pinnedHashes, name)
+		}
+	}
+}
+
+// scriptHash returns the SHA-256 of a script, recomputing it only when the
+// file's modification time or size changes. These come from the open file
+// rather than the stat cache, which may not have seen the change yet.
+func scriptHash(scriptPath string) (string, error) {
+	f, err := os.Open(scriptPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	hashCacheMu.Lock()
+	entry, ok := hashCache[scriptPath]
+	hashCacheMu.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.sum, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	hashCacheMu.Lock()
+	hashCache[scriptPath] = hashEntry{modTime: info.ModTime(), size: info.Size(), sum: sum}
+	hashCacheMu.Unlock()
+	return sum, nil
+}
+
+// checkIntegrity refuses scripts that are missing from the manifest or whose
+// content doesn't match their pinned hash
+func checkIntegrity(w http.ResponseWriter, r *http.Request, scriptPath string) bool {
+	pinnedMu.RLock()
+	enabled := pinnedHashes != nil
+	expected, ok := pinnedHashes[filepath.Clean(scriptPath)]
+	pinnedMu.RUnlock()
+	if !enabled {
+		return true
+	}
+	if !ok {
+		http.Error(w, "Script not allowed", http.StatusForbidden)
+		log.Printf("Refused script missing from integrity manifest: %s", scriptPath)
+		auditReject(r, auditIntegrity, "missing from manifest")
+		return false
+	}
+
+	sum, err := scriptHash(scriptPath)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Error hashing script %s: %v", scriptPath, err)
+		return false
+	}
+	if sum != expected {
+		http.Error(w, "Script not allowed", http.StatusForbidden)
+		log.Printf("Refused tampered script %s: SHA-256 %s, expected %s", scriptPath, sum, expected)
+		auditReject(r, auditIntegrity, "SHA-256 "+sum+", expected "+expected)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var interpreters = flag.String("interpreters", "", "Comma-separated list of .ext=interpreter rules running scripts through an interpreter, for platforms that ignore #! lines, e.g. .py=python,.pl=perl")
+
+// interpreterFor returns the interpreter configured for a script's
+// extension, or ""
+func interpreterFor(scriptPath string) string {
+	ext := filepath.Ext(scriptPath)
+	for _, rule := range strings.Split(*interpreters, ",") {
+		e, interpreter, ok := strings.Cut(strings.TrimSpace(rule), "=")
+		if ok && strings.EqualFold(e, ext) {
+			return interpreter
+		}
+	}
+	return ""
+}
+
+// scriptCommand returns the command running a script from its directory,
+// through its interpreter if one is configured, or through the one on its #!
+// line if the platform can't run it directly
+func scriptCommand(ctx context.Context, scriptPath string) *exec.Cmd {
+	// bypass exec.LookPath() and force using the executable in the cgi-bin dir
+	executable := "." + string(filepath.Separator) + filepath.Base(scriptPath)
+	var cmd *exec.Cmd
+	if interpreter := interpreterFor(scriptPath); interpreter != "" {
+		cmd = exec.CommandContext(ctx, interpreter, executable)
+	} else if argv := shebangCommand(scriptPath); argv != nil {
+		cmd = exec.CommandContext(ctx, argv[0], append(argv[1:], executable)...)
+	} else {
+		cmd = exec.CommandContext(ctx, executable)
+	}
+	cmd.Dir = filepath.Dir(scriptPath)
+	return cmd
+}
+
+// shebangCommand returns the #! interpreter of a script the platform can't
+// run directly, or nil
+func shebangCommand(scriptPath string) []string {
+	info, err := statScript(scriptPath)
+	if err != nil || runsDirectly(scriptPath, info) {
+		return nil
+	}
+	return scriptShebang(scriptPath)
+}
+
+// validateInterpreters checks the -interpreters flag
+func validateInterpreters() error {
+	for _, rule := range strings.Split(*interpreters, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		ext, interpreter, ok := strings.Cut(rule, "=")
+		if !ok || !strings.HasPrefix(ext, ".") || interpreter == "" {
+			return fmt.Errorf("invalid interpreter rule %q, expected .ext=interpreter", rule)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	commands["list"] = listCommand
+	adminEndpoints["scripts"] = handleScriptInventory
+}
+
+// scriptInfo describes a script and the settings that apply to it
+type scriptInfo struct {
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mtime"`
+	Owner       string    `json:"owner"`
+	Mode        string    `json:"mode"`
+	Timeout     string    `json:"timeout"`
+	Concurrency int       `json:"concurrency,omitempty"`
+	Methods     []string  `json:"methods,omitempty"`
+	AuthRealm   string    `json:"auth_realm,omitempty"`
+	Trusted     bool      `json:"trusted,omitempty"`
+	Debug       bool      `json:"debug,omitempty"`
+	Webhook     string    `json:"webhook,omitempty"`
+	Async       bool      `json:"async,omitempty"`
+	Queue       string    `json:"queue,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// fileOwner returns the name of a file's owner, or its uid
+func fileOwner(info fs.FileInfo) string {
+	id, ok := fileOwnerID(info)
+	if !ok {
+		return ""
+	}
+	uid := strconv.FormatUint(uint64(id), 10)
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+	return uid
+}
+
+// scriptInventory lists the files of a CGI directory that have an allowed
+// extension, with their effective configuration
+func scriptInventory(dir string) ([]scriptInfo, error) {
+	var scripts []scriptInfo
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !hasAllowedExtension(p) {
+			return nil
+		}
+		info, err := os.Stat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(dir, p)
+		script := scriptInfo{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Owner:   fileOwner(info),
+			Mode:    info.Mode().String(),
+		}
+		cfg, err := loadScriptConfig(dir, p)
+		if err != nil {
+			script.Error = err.Error()
+		} else {
+			script.Timeout = cfg.timeout.String()
+			script.Concurrency = cfg.concurrency
+			script.Methods = cfg.methods
+			script.AuthRealm = cfg.authRealm
+			script.Trusted = cfg.trusted
+			script.Debug = cfg.debug
+			script.Webhook = cfg.webhookProvider
+			script.Async = cfg.async
+			script.Queue = cfg.queue
+		}
+		scripts = append(scripts, script)
+		return nil
+	})
+	return scripts, err
+}
+
+// handleScriptInventory lists the scripts of the active CGI directory as JSON
+func handleScriptInventory(w http.ResponseWriter, r *http.Request) {
+	scripts, err := scriptInventory(activeCGIDir())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scripts)
+}
+
+// listCommand prints the scripts of the CGI directory:
+//
+//	cgiserver [flags] list [-json]
+func listCommand(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print the list as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: cgiserver [flags] list [-json]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	scripts, err := scriptInventory(*cgiDir)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(scripts)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCRIPT\tSIZE\tMODIFIED\tOWNER\tMODE\tTIMEOUT\tCONCURRENCY\tMETHODS\tAUTH")
+	for _, s := range scripts {
+		if s.Error != "" {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\terror: %s\n", s.Path, s.Size, s.ModTime.Format(time.DateTime), s.Owner, s.Mode, s.Error)
+			continue
+		}
+		concurrency := "-"
+		if s.Concurrency > 0 {
+			concurrency = strconv.Itoa(s.Concurrency)
+		}
+		methods := "any"
+		if len(s.Methods) > 0 {
+			methods = strings.Join(s.Methods, ",")
+		}
+		auth := "-"
+		if s.AuthRealm != "" {
+			auth = s.AuthRealm
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Path, s.Size, s.ModTime.Format(time.DateTime), s.Owner, s.Mode, s.Timeout, concurrency, methods, auth)
+	}
+	return tw.Flush()
+}
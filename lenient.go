@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var lenientCGI = flag.Bool("lenient-cgi", false, "Tolerate sloppy script output from old scripts: banner or blank lines before the headers, and headers not followed by a blank line")
+
+// maxBannerLines is how many lines before the first header lenient parsing
+// skips, beyond which the output is taken to have no headers at all
+const maxBannerLines = 5
+
+// isHeaderLine checks whether a line looks like a header
+func isHeaderLine(line string) bool {
+	if strings.HasPrefix(line, "HTTP/") {
+		return true
+	}
+	name, _, ok := strings.Cut(line, ":")
+	return ok && isToken(name)
+}
+
+// readLenientHead locates the header block of sloppy output. Banner lines
+// before the first header are dropped, and the first line that isn't a
+// header ends the block when no blank line does. It returns the normalized
+// header block in head and the bytes read beyond it, which start the body;
+// if no header is found, head is left empty and everything read is body.
+func readLenientHead(reader *bufio.Reader, head *bytes.Buffer) ([]byte, error) {
+	var skipped bytes.Buffer
+	banners, sawText := 0, false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		text := strings.TrimSpace(line)
+
+		switch {
+		case head.Len() == 0 && isHeaderLine(text):
+			if banners > 0 {
+				log.Printf("Skipped %d lines before the headers of script output", banners)
+			}
+			head.WriteString(text + "\n")
+		case head.Len() == 0 && line != "" && banners < maxBannerLines && (text != "" || !sawText):
+			// Blank lines may precede a banner, but not separate it from
+			// the headers, or it was a headerless body
+			skipped.WriteString(line)
+			banners++
+			sawText = sawText || text != ""
+		case head.Len() == 0:
+			skipped.WriteString(line)
+			return skipped.Bytes(), nil
+		case text == "":
+			// The blank line, or the end of headers-only output
+			head.WriteString("\n")
+			return nil, nil
+		case isHeaderLine(text):
+			head.WriteString(text + "\n")
+		default:
+			head.WriteString("\n")
+			return []byte(line), nil
+		}
+		if err == io.EOF {
+			if head.Len() == 0 {
+				return skipped.Bytes(), nil
+			}
+			head.WriteString("\n")
+			return nil, nil
+		}
+	}
+}
+
+// relayHeaderless sends output in which no header was found as the body of a
+// 200 response, letting the server sniff its content type
+func relayHeaderless(w http.ResponseWriter, body []byte, rest io.Reader) error {
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	_, err := copyBuffered(w, rest)
+	return err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	commands["lint"] = lintCommand
+}
+
+// lintSidecars are the suffixes of files that accompany scripts
+var lintSidecars = []string{scriptMetaSuffix, ".minisig", ".sig"}
+
+// lintShebang returns the problems with a script's #! line
+func lintShebang(p string) []string {
+	f, err := os.Open(p)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadSlice('\n')
+	if err != nil && len(line) == 0 {
+		return []string{"file is empty"}
+	}
+
+	if bytes.HasPrefix(line, []byte("\x7fELF")) {
+		return nil
+	}
+	if !bytes.HasPrefix(line, []byte("#!")) {
+		return []string{"no #! line"}
+	}
+	var problems []string
+	if bytes.HasSuffix(line, []byte("\r\n")) {
+		problems = append(problems, "#! line ends with CRLF, the interpreter name will include a carriage return")
+	}
+	fields := strings.Fields(string(line[2:]))
+	if len(fields) == 0 {
+		return append(problems, "#! line names no interpreter")
+	}
+
+	interpreter := fields[0]
+	if filepath.Base(interpreter) == "env" && len(fields) > 1 {
+		if _, err := exec.LookPath(fields[1]); err != nil {
+			problems = append(problems, fmt.Sprintf("interpreter %s not found in PATH", fields[1]))
+		}
+	}
+	info, err := os.Stat(interpreter)
+	switch {
+	case !filepath.IsAbs(interpreter):
+		problems = append(problems, fmt.Sprintf("interpreter %s is not an absolute path", interpreter))
+	case err != nil:
+		problems = append(problems, fmt.Sprintf("interpreter %s does not exist", interpreter))
+	case !info.Mode().IsRegular() || info.Mode()&0111 == 0:
+		problems = append(problems, fmt.Sprintf("interpreter %s is not executable", interpreter))
+	}
+	return problems
+}
+
+// lintFile returns the problems with a file in the CGI directory
+func lintFile(p string, info fs.FileInfo) []string {
+	for _, suffix := range lintSidecars {
+		if strings.HasSuffix(p, suffix) {
+			return nil
+		}
+	}
+	if filepath.Base(p) == dirConfigName {
+		return nil
+	}
+
+	var problems []string
+	if info.Mode().Perm()&0002 != 0 {
+		problems = append(problems, fmt.Sprintf("world-writable (mode %s)", info.Mode().Perm()))
+	}
+	if !info.Mode().IsRegular() {
+		return problems
+	}
+	if !hasAllowedExtension(p) {
+		return append(problems, "extension not in -allowed-extensions, it can't be run")
+	}
+	if !isExecutable(p, info) {
+		problems = append(problems, "not executable")
+	}
+	problems = append(problems, lintShebang(p)...)
+	if *suexecChecks {
+		if reason, err := suexecViolation(p); err == nil && reason != "" {
+			problems = append(problems, reason)
+		}
+	}
+	return problems
+}
+
+// lintCommand reports problems with the scripts of the CGI directory, and
+// fails if there are any, so it can gate deploys:
+//
+//	cgiserver [flags] lint [dir]
+func lintCommand(args []string) error {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: cgiserver [flags] lint [dir]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	dir := *cgiDir
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		dir = flags.Arg(0)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	count := 0
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			fmt.Printf("%s: %v\n", p, err)
+			count++
+			return nil
+		}
+		if d.IsDir() && p != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		var problems []string
+		if d.IsDir() {
+			if info.Mode().Perm()&0002 != 0 {
+				problems = append(problems, fmt.Sprintf("directory is world-writable (mode %s)", info.Mode().Perm()))
+			}
+		} else {
+			if info.Mode()&os.ModeSymlink != 0 {
+				if info, err = os.Stat(p); err != nil {
+					problems = append(problems, "dangling symlink")
+				}
+			}
+			if len(problems) == 0 {
+				problems = lintFile(p, info)
+			}
+		}
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", p, problem)
+		}
+		count += len(problems)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%d problems found", count)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	listenAddr    = flag.String("listen", "", "Address to listen on as host:port, e.g. 127.0.0.1:8080 or [::1]:8080; an empty host listens on all interfaces (default \":8080\", or the -port flag)")
+	listenNetwork = flag.String("listen-network", "tcp", "Address families to listen on: tcp for dual-stack IPv4 and IPv6, tcp4 for IPv4 only, or tcp6 for IPv6 only")
+	tcpKeepAlive  = flag.Duration("tcp-keepalive", 15*time.Second, "Interval between TCP keepalive probes on client connections, or 0 to disable them")
+	tcpNoDelay    = flag.Bool("tcp-nodelay", true, "Set TCP_NODELAY on client connections, sending small writes immediately instead of coalescing them")
+	maxConns      = flag.Int("max-conns", 0, "Maximum number of simultaneous client connections, further ones are reset immediately, or 0 for no limit")
+	listenBacklog = flag.Int("listen-backlog", 0, "Length of the queue of connections waiting to be accepted, or 0 for the system default")
+	reusePort     = flag.Bool("reuseport", false, "Set SO_REUSEPORT so several servers can listen on the same address, the kernel balancing connections between them")
+)
+
+// serverAddr returns the address to listen on, accepting a bare port number
+// and falling back to the deprecated -port flag
+func serverAddr() string {
+	if *listenAddr == "" {
+		return fmt.Sprintf(":%d", *port)
+	}
+	if _, err := strconv.Atoi(*listenAddr); err == nil {
+		return ":" + *listenAddr
+	}
+	return *listenAddr
+}
+
+// serverHost returns a host:port at which the server can be reached locally
+func serverHost() string {
+	host, port, err := net.SplitHostPort(serverAddr())
+	if err != nil {
+		return serverAddr()
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// listen opens the server's listening socket
+func listen() (net.Listener, error) {
+	switch *listenNetwork {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("invalid -listen-network %q, expected tcp, tcp4 or tcp6", *listenNetwork)
+	}
+	addr := serverAddr()
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid -listen address %q: %v", addr, err)
+	}
+	lc := net.ListenConfig{KeepAlive: *tcpKeepAlive}
+	if *tcpKeepAlive <= 0 {
+		lc.KeepAlive = -1
+	}
+	if *reusePort {
+		lc.Control = setReusePort
+	}
+	ln, err := lc.Listen(context.Background(), *listenNetwork, addr)
+	if err != nil {
+		return nil, err
+	}
+	if *listenBacklog > 0 {
+		if err := setBacklog(ln.(*net.TCPListener), *listenBacklog); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("cannot set listen backlog: %v", err)
+		}
+	}
+	if !*tcpNoDelay {
+		ln = delayedListener{ln.(*net.TCPListener)}
+	}
+	// The overall limit comes first, as it resets TCP connections
+	if *maxConns > 0 {
+		ln = &limitListener{Listener: ln, max: int64(*maxConns)}
+	}
+	if *maxConnsPerIP > 0 {
+		ln = newPerIPListener(ln, *maxConnsPerIP)
+	}
+	return ln, nil
+}
+
+// limitListener resets connections beyond the maximum rather than leaving
+// them queued, so clients and load balancers learn at once that the server
+// is full, and the server's file descriptors are bounded
+type limitListener struct {
+	net.Listener
+	max    int64
+	active atomic.Int64
+	reset  atomic.Int64
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.active.Add(1) <= l.max {
+			return &releasingConn{Conn: conn, release: func() { l.active.Add(-1) }}, nil
+		}
+		l.active.Add(-1)
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		}
+		conn.Close()
+		if n := l.reset.Add(1); n&(n-1) == 0 {
+			log.Printf("Connection limit of %d reached, %d connections reset so far", l.max, n)
+		}
+	}
+}
+
+// releasingConn releases its slot in a limiting listener once closed
+type releasingConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *releasingConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// ReadFrom lets responses use the sendfile and splice of the TCP connection
+func (c *releasingConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(c.Conn, r)
+}
+
+// delayedListener turns TCP_NODELAY off on accepted connections, which Go
+// turns on by default
+type delayedListener struct {
+	*net.TCPListener
+}
+
+func (l delayedListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetNoDelay(false)
+	return conn, nil
+}
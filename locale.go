@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+var (
+	scriptTZ    = flag.String("tz", os.Getenv("TZ"), "Value of TZ for scripts, by default that of the server")
+	scriptLang  = flag.String("lang", os.Getenv("LANG"), "Value of LANG for scripts, by default that of the server")
+	scriptLCAll = flag.String("lc-all", os.Getenv("LC_ALL"), "Value of LC_ALL for scripts, by default that of the server")
+)
+
+// localeEnv returns the timezone and locale variables for child processes,
+// leaving out those that are empty
+func localeEnv() []string {
+	var env []string
+	for _, v := range [][2]string{{"TZ", *scriptTZ}, {"LANG", *scriptLang}, {"LC_ALL", *scriptLCAll}} {
+		if v[1] != "" {
+			env = append(env, v[0]+"="+v[1])
+		}
+	}
+	return env
+}
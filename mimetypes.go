@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"mime"
+	"os"
+	"strings"
+)
+
+var mimeTypesFile = flag.String("mime-types", "", "File in mime.types format (\"type ext...\" lines) of Content-Types of static files, adding to the built-in ones")
+
+// staticTypes are the Content-Types of common static files, which minimal
+// systems without /etc/mime.types would otherwise get from sniffing
+var staticTypes = map[string]string{
+	".txt":         "text/plain; charset=utf-8",
+	".csv":         "text/csv; charset=utf-8",
+	".md":          "text/markdown; charset=utf-8",
+	".ico":         "image/x-icon",
+	".map":         "application/json",
+	".webmanifest": "application/manifest+json",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".ttf":         "font/ttf",
+	".otf":         "font/otf",
+	".mp3":         "audio/mpeg",
+	".ogg":         "audio/ogg",
+	".mp4":         "video/mp4",
+	".webm":        "video/webm",
+	".zip":         "application/zip",
+	".gz":          "application/gzip",
+	".tar":         "application/x-tar",
+}
+
+// registerMimeTypes adds the static file types, and those of the
+// -mime-types file
+func registerMimeTypes() error {
+	for ext, typ := range staticTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, typ)
+		}
+	}
+	if *mimeTypesFile == "" {
+		return nil
+	}
+
+	f, err := os.Open(*mimeTypesFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			if err := mime.AddExtensionType("."+strings.TrimPrefix(ext, "."), fields[0]); err != nil {
+				return fmt.Errorf("%s:%d: %v", *mimeTypesFile, line, err)
+			}
+		}
+	}
+	return scanner.Err()
+}
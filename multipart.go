@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+var (
+	multipartMaxParts    = flag.Int("multipart-max-parts", 0, "Maximum number of parts in a multipart/form-data upload, or 0 for no limit")
+	multipartMaxPartSize = flag.Int64("multipart-max-part-size", 0, "Maximum size of a part of a multipart/form-data upload, or 0 for no limit")
+	multipartTypes       = flag.String("multipart-types", "", "Comma-separated list of content types allowed for uploaded files in multipart/form-data requests, with type/* wildcards, or empty to allow any")
+)
+
+// uploadRejectedError reports an upload breaking the multipart limits
+type uploadRejectedError struct {
+	reason string
+}
+
+func (e *uploadRejectedError) Error() string {
+	return "upload rejected: " + e.reason
+}
+
+// multipartGuard checks a multipart/form-data body against the limits as it
+// is read: the bytes are passed to a parser running alongside, and reading
+// fails as soon as the parser finds a violation
+type multipartGuard struct {
+	body io.ReadCloser
+	pw   *io.PipeWriter
+	done chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// guardMultipart wraps the body of multipart/form-data requests when limits
+// are configured
+func guardMultipart(r *http.Request) {
+	if *multipartMaxParts <= 0 && *multipartMaxPartSize <= 0 && *multipartTypes == "" {
+		return
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return
+	}
+
+	pr, pw := io.Pipe()
+	g := &multipartGuard{body: r.Body, pw: pw, done: make(chan struct{})}
+	go g.inspect(multipart.NewReader(pr, params["boundary"]), pr)
+	r.Body = g
+}
+
+// inspect parses the parts, stopping the upload at the first violation
+func (g *multipartGuard) inspect(mr *multipart.Reader, pr *io.PipeReader) {
+	defer close(g.done)
+	// Keep consuming so reads don't block once inspection is over
+	defer io.Copy(io.Discard, pr)
+
+	for count := 1; ; count++ {
+		part, err := mr.NextRawPart()
+		if err != nil {
+			// The end of the upload, or a malformed one left to the script
+			return
+		}
+		if *multipartMaxParts > 0 && count > *multipartMaxParts {
+			g.reject(pr, "more than %d parts", *multipartMaxParts)
+			return
+		}
+		if part.FileName() != "" && !allowedUploadType(part.Header.Get("Content-Type")) {
+			g.reject(pr, "file %q has disallowed type %q", part.FileName(), part.Header.Get("Content-Type"))
+			return
+		}
+		limit := int64(math.MaxInt64)
+		if *multipartMaxPartSize > 0 {
+			limit = *multipartMaxPartSize + 1
+		}
+		n, err := io.Copy(io.Discard, io.LimitReader(part, limit))
+		if *multipartMaxPartSize > 0 && n > *multipartMaxPartSize {
+			g.reject(pr, "part %q larger than %d bytes", part.FormName(), *multipartMaxPartSize)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// reject records a violation and fails the pending and future reads
+func (g *multipartGuard) reject(pr *io.PipeReader, format string, args ...any) {
+	err := &uploadRejectedError{reason: fmt.Sprintf(format, args...)}
+	g.mu.Lock()
+	g.err = err
+	g.mu.Unlock()
+	pr.CloseWithError(err)
+}
+
+func (g *multipartGuard) Read(p []byte) (int, error) {
+	g.mu.Lock()
+	err := g.err
+	g.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := g.body.Read(p)
+	if n > 0 {
+		if _, werr := g.pw.Write(p[:n]); werr != nil {
+			var rejected *uploadRejectedError
+			if errors.As(werr, &rejected) {
+				return 0, werr
+			}
+		}
+	}
+	if err != nil {
+		// Let the parser finish with the end of the body, so a violation
+		// in its last bytes is reported instead of the end
+		g.pw.CloseWithError(err)
+		<-g.done
+		g.mu.Lock()
+		if g.err != nil {
+			err = g.err
+		}
+		g.mu.Unlock()
+	}
+	return n, err
+}
+
+func (g *multipartGuard) Close() error {
+	g.pw.Close()
+	return g.body.Close()
+}
+
+// allowedUploadType checks the content type of an uploaded file against
+// -multipart-types
+func allowedUploadType(contentType string) bool {
+	if *multipartTypes == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range strings.Split(*multipartTypes, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if ok, _ := path.Match(allowed, mediaType); ok && allowed != "" {
+			return true
+		}
+	}
+	return false
+}
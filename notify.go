@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	notifyURL       = flag.String("notify-url", "", "URL to POST a JSON notification to when security or failure events exceed their thresholds")
+	notifyWindow    = flag.Duration("notify-window", time.Minute, "Window over which events are counted against the notification thresholds")
+	notifyTraversal = flag.Int("notify-traversal", 5, "Notify when a client makes this many unsafe path or traversal attempts within the window, or 0 never to")
+	notifyTimeouts  = flag.Int("notify-timeouts", 3, "Notify when a script times out this many times within the window, or 0 never to")
+)
+
+// notification is the JSON body posted to the notification webhook
+type notification struct {
+	Event  string    `json:"event"`
+	Key    string    `json:"key"`
+	Count  int       `json:"count"`
+	Window string    `json:"window"`
+	Detail string    `json:"detail,omitempty"`
+	Server string    `json:"server"`
+	Time   time.Time `json:"time"`
+}
+
+// eventCount counts the events of a kind for a key since the window started
+type eventCount struct {
+	start time.Time
+	count int
+}
+
+var (
+	eventCountsMu sync.Mutex
+	eventCounts   = make(map[string]*eventCount)
+
+	// notifications queues the notifications being sent
+	notifications     chan notification
+	notificationsOnce sync.Once
+)
+
+// countEvent counts an event, for instance a timeout of a given script, and
+// sends a notification when there have been threshold of them in the window.
+// Each window notifies at most once.
+func countEvent(event, key string, threshold int, detail string) {
+	if *notifyURL == "" || threshold <= 0 {
+		return
+	}
+	now := time.Now()
+	eventCountsMu.Lock()
+	if len(eventCounts) > 1024 {
+		for k, c := range eventCounts {
+			if now.Sub(c.start) > *notifyWindow {
+				delete(eventCounts, k)
+			}
+		}
+	}
+	c := eventCounts[event+" "+key]
+	if c == nil || now.Sub(c.start) > *notifyWindow {
+		c = &eventCount{start: now}
+		eventCounts[event+" "+key] = c
+	}
+	c.count++
+	count := c.count
+	eventCountsMu.Unlock()
+
+	if count == threshold {
+		notify(notification{Event: event, Key: key, Count: count, Window: notifyWindow.String(), Detail: detail})
+	}
+}
+
+// notify queues a notification, dropping it if the webhook is backed up
+func notify(n notification) {
+	notificationsOnce.Do(func() {
+		notifications = make(chan notification, 100)
+		go sendNotifications()
+	})
+	n.Server, _ = os.Hostname()
+	n.Time = time.Now().UTC()
+	select {
+	case notifications <- n:
+	default:
+		log.Printf("Dropped %s notification for %s: webhook backed up", n.Event, n.Key)
+	}
+}
+
+// sendNotifications posts the queued notifications to the webhook
+func sendNotifications() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for n := range notifications {
+		data, err := json.Marshal(n)
+		if err != nil {
+			continue
+		}
+		resp, err := client.Post(*notifyURL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Printf("Failed to send %s notification: %v", n.Event, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Failed to send %s notification: %s", n.Event, resp.Status)
+		}
+	}
+}
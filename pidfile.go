@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var pidFile = flag.String("pidfile", "", "Write the server's process ID to this file and hold an exclusive lock on it, refusing to start if another server holds it")
+
+// pidFileHandle stays open, and locked, for the life of the server
+var pidFileHandle *os.File
+
+// writePidFile locks the pidfile and records the process ID in it. The file
+// is left behind at exit: the lock, not its existence, tells whether the
+// server is running.
+func writePidFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f); err != nil {
+		data, _ := os.ReadFile(path)
+		f.Close()
+		if pid := strings.TrimSpace(string(data)); pid != "" {
+			return fmt.Errorf("another cgiserver (PID %s) is already running with pidfile %s", pid, path)
+		}
+		return fmt.Errorf("another cgiserver is already running with pidfile %s: %v", path, err)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return err
+	}
+	pidFileHandle = f
+	return nil
+}
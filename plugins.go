@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/fazalmajid/cgiserver/cgiplugin"
+	"github.com/hashicorp/go-plugin"
+)
+
+var (
+	pluginsFile         = flag.String("plugins", "", "File of \"interface program [args...]\" lines starting out-of-process plugins, see the cgiplugin package")
+	maxFilteredResponse = flag.Int("max-filtered-response", 64<<20, "Maximum size of a response buffered for the response filters, larger ones fail with 502")
+)
+
+// Plugin lines name the interface a plugin is used for, one of
+// request-filter, auth, env and response-filter, then its program and
+// arguments. Plugins of each interface are consulted in the order they are
+// listed. For example:
+//
+//	request-filter /usr/local/libexec/cgiserver/geoblock
+//	auth           /usr/local/libexec/cgiserver/oidc -issuer https://id.example.com
+//	response-filter /usr/local/libexec/cgiserver/minify
+//
+// Response filters get whole responses, so with any configured, responses
+// are buffered rather than streamed, up to -max-filtered-response.
+
+// namedPlugin is a plugin with the name of its program, for logging
+type namedPlugin[T any] struct {
+	name string
+	impl T
+}
+
+var (
+	requestFilters  []namedPlugin[cgiplugin.RequestFilter]
+	authProviders   []namedPlugin[cgiplugin.AuthProvider]
+	envMutators     []namedPlugin[cgiplugin.EnvMutator]
+	responseFilters []namedPlugin[cgiplugin.ResponseFilter]
+)
+
+// loadPlugins starts the plugins listed in a file
+func loadPlugins(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("%s:%d: expected interface program [args...]", path, line)
+		}
+		kind := fields[0]
+		if _, ok := cgiplugin.PluginSet[kind]; !ok {
+			return fmt.Errorf("%s:%d: unknown plugin interface %q", path, line, kind)
+		}
+		impl, err := startPlugin(kind, fields[1], fields[2:])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		name := filepath.Base(fields[1])
+		switch p := impl.(type) {
+		case cgiplugin.RequestFilter:
+			requestFilters = append(requestFilters, namedPlugin[cgiplugin.RequestFilter]{name, p})
+		case cgiplugin.AuthProvider:
+			authProviders = append(authProviders, namedPlugin[cgiplugin.AuthProvider]{name, p})
+		case cgiplugin.EnvMutator:
+			envMutators = append(envMutators, namedPlugin[cgiplugin.EnvMutator]{name, p})
+		case cgiplugin.ResponseFilter:
+			responseFilters = append(responseFilters, namedPlugin[cgiplugin.ResponseFilter]{name, p})
+		}
+		log.Printf("Started %s plugin %s", kind, name)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// startPlugin starts a plugin program and returns its implementation of an
+// interface
+func startPlugin(kind, program string, args []string) (interface{}, error) {
+	client := plugin.NewClient(&plugin.ClientConfig{
+		HandshakeConfig:  cgiplugin.Handshake,
+		Plugins:          cgiplugin.PluginSet,
+		Cmd:              exec.Command(program, args...),
+		AllowedProtocols: []plugin.Protocol{plugin.ProtocolNetRPC},
+		Managed:          true,
+	})
+	rpcClient, err := client.Client()
+	if err != nil {
+		client.Kill()
+		return nil, err
+	}
+	impl, err := rpcClient.Dispense(kind)
+	if err != nil {
+		client.Kill()
+		return nil, err
+	}
+	return impl, nil
+}
+
+// stopPlugins stops the plugin processes
+func stopPlugins() {
+	plugin.CleanupClients()
+}
+
+// pluginRequest describes a request to plugins
+func pluginRequest(r *http.Request, scriptPath string) cgiplugin.Request {
+	return cgiplugin.Request{
+		Method:     r.Method,
+		URL:        originalRequestURI(r),
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Script:     scriptPath,
+		Header:     r.Header,
+	}
+}
+
+// filterRequest passes a request through the request filters, answering it
+// and returning false when one of them rejects it
+func filterRequest(w http.ResponseWriter, r *http.Request, req cgiplugin.Request) bool {
+	for _, p := range requestFilters {
+		resp, err := p.impl.FilterRequest(req)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Printf("Request filter %s failed for %s: %v", p.name, req.Script, err)
+			return false
+		}
+		if resp != nil {
+			writePluginResponse(w, *resp)
+			log.Printf("Request filter %s answered %s for %s from %s", p.name, req.Script, http.StatusText(resp.Status), r.RemoteAddr)
+			return false
+		}
+	}
+	return true
+}
+
+// pluginAuthenticate asks the auth providers whether a request may proceed,
+// returning the user the last one to name one authenticated
+func pluginAuthenticate(req cgiplugin.Request) (string, string, error) {
+	var user, provider string
+	for _, p := range authProviders {
+		u, ok, err := p.impl.Authenticate(req)
+		if err != nil {
+			return "", p.name, err
+		}
+		if !ok {
+			return "", p.name, fmt.Errorf("refused by %s", p.name)
+		}
+		if u != "" {
+			user, provider = u, p.name
+		}
+	}
+	return user, provider, nil
+}
+
+// mutateEnv passes the environment of a script through the env mutators
+func mutateEnv(req cgiplugin.Request, env []string) ([]string, error) {
+	for _, p := range envMutators {
+		var err error
+		if env, err = p.impl.MutateEnv(req, env); err != nil {
+			return nil, fmt.Errorf("%s: %v", p.name, err)
+		}
+	}
+	return env, nil
+}
+
+// errFilteredTooLarge reports a response over -max-filtered-response
+var errFilteredTooLarge = errors.New("response too large for the response filters")
+
+// filteredWriter buffers a response for the response filters
+type filteredWriter struct {
+	*bufferedResponse
+	w        http.ResponseWriter
+	req      cgiplugin.Request
+	tooLarge bool
+}
+
+func (fw *filteredWriter) WriteHeader(status int) {
+	// Early hints go out right away
+	if isInterim(status) {
+		fw.w.WriteHeader(status)
+		return
+	}
+	fw.bufferedResponse.WriteHeader(status)
+}
+
+func (fw *filteredWriter) Write(p []byte) (int, error) {
+	if fw.tooLarge || fw.body.Len()+len(p) > *maxFilteredResponse {
+		fw.tooLarge = true
+		return 0, errFilteredTooLarge
+	}
+	return fw.bufferedResponse.Write(p)
+}
+
+// flush passes the buffered response through the response filters and sends
+// the result
+func (fw *filteredWriter) flush() {
+	if fw.tooLarge {
+		http.Error(fw.w, "Bad gateway", http.StatusBadGateway)
+		log.Printf("Response of %s over %d bytes, too large to filter", fw.req.Script, *maxFilteredResponse)
+		return
+	}
+	resp := cgiplugin.Response{Status: fw.status, Header: fw.header, Body: fw.body.Bytes()}
+	if resp.Status == 0 {
+		resp.Status = http.StatusOK
+	}
+	for _, p := range responseFilters {
+		filtered, err := p.impl.FilterResponse(fw.req, resp)
+		if err != nil {
+			http.Error(fw.w, "Internal server error", http.StatusInternalServerError)
+			log.Printf("Response filter %s failed for %s: %v", p.name, fw.req.Script, err)
+			return
+		}
+		resp = filtered
+	}
+	writePluginResponse(fw.w, resp)
+}
+
+// writePluginResponse sends a response made or edited by a plugin
+func writePluginResponse(w http.ResponseWriter, resp cgiplugin.Response) {
+	for name, values := range resp.Header {
+		w.Header()[http.CanonicalHeaderKey(name)] = values
+	}
+	w.Header().Del("Content-Length")
+	if resp.Status == 0 {
+		resp.Status = http.StatusOK
+	}
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+}
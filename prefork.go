@@ -0,0 +1,14 @@
+package main
+
+import "flag"
+
+var (
+	execBackend = flag.String("exec-backend", "fork", "How CGI scripts are started: fork, or prefork to exec them from a pool of pre-forked helpers")
+	preforkSize = flag.Int("prefork-size", 8, "Number of idle pre-forked helpers kept ready by the prefork backend")
+)
+
+// spawnHelperEnv marks a process started as a pre-forked helper
+const spawnHelperEnv = "CGISERVER_SPAWN_HELPER"
+
+// spawnPool is set when the prefork backend is selected
+var spawnPool *preforkPool
@@ -0,0 +1,26 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+)
+
+// preforkPool is unavailable without fork and socketpair
+type preforkPool struct{}
+
+func newPreforkPool(size int) *preforkPool {
+	log.Fatalf("The prefork exec backend is not supported on %s", runtime.GOOS)
+	return nil
+}
+
+func (p *preforkPool) start(scriptPath string, env []string) (*scriptProcess, error) {
+	return nil, fmt.Errorf("prefork is not supported on %s", runtime.GOOS)
+}
+
+func runSpawnHelper() {
+	os.Exit(1)
+}
@@ -0,0 +1,190 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// spawnHelperFd is the helper's end of its control socket
+const spawnHelperFd = 3
+
+// spawnRequest tells a helper which script to exec
+type spawnRequest struct {
+	Dir        string
+	Executable string
+	Args       []string
+	Env        []string
+}
+
+// spawnHelper is an idle copy of this program, already forked with the
+// standard streams the script will inherit, waiting for a spawnRequest on
+// its control socket
+type spawnHelper struct {
+	cmd    *exec.Cmd
+	ctrl   *os.File
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+}
+
+// preforkPool keeps a number of helpers ready to exec scripts immediately
+type preforkPool struct {
+	idle chan *spawnHelper
+}
+
+// newPreforkPool creates a pool and starts filling it in the background
+func newPreforkPool(size int) *preforkPool {
+	p := &preforkPool{idle: make(chan *spawnHelper, size)}
+	go p.fill()
+	return p
+}
+
+// fill replaces helpers as they are used
+func (p *preforkPool) fill() {
+	for {
+		h, err := startSpawnHelper()
+		if err != nil {
+			log.Printf("Failed to start spawn helper: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		p.idle <- h
+	}
+}
+
+// startSpawnHelper forks a new helper connected by a socketpair
+func startSpawnHelper() (*spawnHelper, error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socketpair: %v", err)
+	}
+	ctrl := os.NewFile(uintptr(fds[0]), "spawn-control")
+	child := os.NewFile(uintptr(fds[1]), "spawn-control-child")
+	defer child.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	cmd := exec.Command(exe)
+	cmd.Env = []string{spawnHelperEnv + "=1"}
+	cmd.ExtraFiles = []*os.File{child}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	h := &spawnHelper{cmd: cmd, ctrl: ctrl}
+	if h.stdin, err = cmd.StdinPipe(); err == nil {
+		if h.stdout, err = cmd.StdoutPipe(); err == nil {
+			if h.stderr, err = cmd.StderrPipe(); err == nil {
+				err = cmd.Start()
+			}
+		}
+	}
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// start has an idle helper exec a script, forking a new helper if none is
+// ready or the idle one has died
+func (p *preforkPool) start(scriptPath string, env []string) (*scriptProcess, error) {
+	cmd := scriptCommand(context.Background(), scriptPath)
+	if cmd.Err != nil {
+		return nil, fmt.Errorf("failed to start script: %v", cmd.Err)
+	}
+	req, err := json.Marshal(spawnRequest{
+		Dir:        cmd.Dir,
+		Executable: cmd.Path,
+		Args:       cmd.Args,
+		Env:        env,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var h *spawnHelper
+	select {
+	case h = <-p.idle:
+		if err := writeFrame(h.ctrl, req); err != nil {
+			h.discard()
+			h = nil
+		}
+	default:
+	}
+	if h == nil {
+		if h, err = startSpawnHelper(); err != nil {
+			return nil, fmt.Errorf("failed to start script: %v", err)
+		}
+		if err := writeFrame(h.ctrl, req); err != nil {
+			h.discard()
+			return nil, fmt.Errorf("failed to start script: %v", err)
+		}
+	}
+
+	// The control socket is closed on exec, so anything read from it is an
+	// error message from the helper
+	msg, err := io.ReadAll(h.ctrl)
+	h.ctrl.Close()
+	if err == nil && len(msg) > 0 {
+		err = fmt.Errorf("%s", msg)
+	}
+	if err != nil {
+		h.discard()
+		return nil, fmt.Errorf("failed to start script: %v", err)
+	}
+
+	return &scriptProcess{
+		pid:    h.cmd.Process.Pid,
+		stdin:  h.stdin,
+		stdout: h.stdout,
+		stderr: h.stderr,
+		wait:   h.cmd.Wait,
+	}, nil
+}
+
+// discard kills an unusable helper and reaps it
+func (h *spawnHelper) discard() {
+	h.ctrl.Close()
+	h.cmd.Process.Kill()
+	go h.cmd.Wait()
+}
+
+// runSpawnHelper is the main function of a pre-forked helper. It waits for a
+// single spawnRequest and replaces itself with the script.
+func runSpawnHelper() {
+	ctrl := os.NewFile(spawnHelperFd, "spawn-control")
+	data, err := readFrame(ctrl, 16<<20)
+	if err != nil {
+		// The server went away
+		os.Exit(1)
+	}
+
+	var req spawnRequest
+	if err = json.Unmarshal(data, &req); err == nil {
+		syscall.CloseOnExec(spawnHelperFd)
+		if err = os.Chdir(req.Dir); err == nil {
+			err = syscall.Exec(req.Executable, req.Args, req.Env)
+		}
+	}
+
+	// Exec only returns on failure
+	fmt.Fprintf(ctrl, "%v", err)
+	os.Exit(127)
+}
@@ -0,0 +1,69 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes a command start in a new process group, so that it
+// can be killed together with any children it starts
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// processGroup is the process group of a started script
+type processGroup struct {
+	pgid int
+}
+
+// newProcessGroup returns the process group of a process started with
+// setProcessGroup
+func newProcessGroup(pid int) *processGroup {
+	pgid, err := syscall.Getpgid(pid)
+	if err != nil {
+		pgid = pid
+	}
+	return &processGroup{pgid: pgid}
+}
+
+// kill sends SIGKILL to the entire process group
+func (g *processGroup) kill() error {
+	return syscall.Kill(-g.pgid, syscall.SIGKILL)
+}
+
+// close releases the group once its leader has been reaped
+func (g *processGroup) close() {}
+
+func (g *processGroup) String() string {
+	return fmt.Sprintf("process group %d", g.pgid)
+}
+
+// runsDirectly checks the execute permission bits of a script
+func runsDirectly(p string, info fs.FileInfo) bool {
+	return info.Mode()&0111 != 0
+}
+
+// isExecutable checks whether a script can be run, either directly or, with
+// -allow-nonexec, through the interpreter on its #! line
+func isExecutable(p string, info fs.FileInfo) bool {
+	return runsDirectly(p, info) || *allowNonexec && scriptShebang(p) != nil
+}
+
+// resolveShebang returns a #! command line unchanged, since the interpreter
+// paths are native
+func resolveShebang(argv []string) []string {
+	return argv
+}
+
+// fileOwnerID returns the uid owning a file
+func fileOwnerID(info fs.FileInfo) (uint32, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return st.Uid, true
+}
@@ -0,0 +1,135 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// setProcessGroup makes a command start in a new process group, so that
+// console signals meant for the server don't reach it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: windows.CREATE_NEW_PROCESS_GROUP}
+}
+
+// processGroup is a Job Object holding a started script and, since child
+// processes inherit their parent's job, everything it starts
+type processGroup struct {
+	pid int
+	job windows.Handle
+}
+
+// newProcessGroup creates a job for a process. The job kills all of its
+// processes when its handle is closed, so nothing outlives the request.
+func newProcessGroup(pid int) *processGroup {
+	g := &processGroup{pid: pid}
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		log.Printf("Failed to create job object for PID %d: %v", pid, err)
+		return g
+	}
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{
+		BasicLimitInformation: windows.JOBOBJECT_BASIC_LIMIT_INFORMATION{
+			LimitFlags: windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE,
+		},
+	}
+	_, err = windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+	if err == nil {
+		var process windows.Handle
+		process, err = windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(pid))
+		if err == nil {
+			err = windows.AssignProcessToJobObject(job, process)
+			windows.CloseHandle(process)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to assign PID %d to a job object: %v", pid, err)
+		windows.CloseHandle(job)
+		return g
+	}
+	g.job = job
+	return g
+}
+
+// kill terminates every process in the job
+func (g *processGroup) kill() error {
+	if g.job == 0 {
+		p, err := os.FindProcess(g.pid)
+		if err != nil {
+			return err
+		}
+		return p.Kill()
+	}
+	return windows.TerminateJobObject(g.job, 1)
+}
+
+// close releases the job, killing any processes the script left behind
+func (g *processGroup) close() {
+	if g.job != 0 {
+		windows.CloseHandle(g.job)
+	}
+}
+
+func (g *processGroup) String() string {
+	return fmt.Sprintf("job object of PID %d", g.pid)
+}
+
+// runsDirectly checks whether Windows can run a script itself, going by its
+// extension since files have no execute permission
+func runsDirectly(p string, info fs.FileInfo) bool {
+	ext := strings.ToLower(filepath.Ext(p))
+	pathext := os.Getenv("PATHEXT")
+	if pathext == "" {
+		pathext = ".com;.exe;.bat;.cmd"
+	}
+	for _, e := range strings.Split(strings.ToLower(pathext), ";") {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// isExecutable checks whether a script can be run directly, through a
+// configured interpreter, or through the interpreter on its #! line, which
+// Windows ignores
+func isExecutable(p string, info fs.FileInfo) bool {
+	return runsDirectly(p, info) || interpreterFor(p) != "" || scriptShebang(p) != nil
+}
+
+// resolveShebang maps a #! command line written for Unix to an interpreter
+// found in the PATH, so "#!/usr/bin/env python3" and "#!/usr/bin/python3"
+// both run python3.exe
+func resolveShebang(argv []string) []string {
+	if strings.TrimSuffix(strings.ToLower(filepath.Base(argv[0])), ".exe") == "env" {
+		if len(argv) < 2 {
+			return nil
+		}
+		argv = strings.Fields(argv[1])
+	}
+	if info, err := os.Stat(argv[0]); err == nil && info.Mode().IsRegular() {
+		return argv
+	}
+	path, err := exec.LookPath(filepath.Base(filepath.FromSlash(argv[0])))
+	if err != nil {
+		log.Printf("Interpreter %s not found in PATH", argv[0])
+		return nil
+	}
+	return append([]string{path}, argv[1:]...)
+}
+
+// fileOwnerID is unavailable, file ownership on Windows isn't a uid
+func fileOwnerID(info fs.FileInfo) (uint32, bool) {
+	return 0, false
+}
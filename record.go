@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	recordDir     = flag.String("record-dir", "", "Directory to record every request to, one JSON file each, for the replay command")
+	recordMaxBody = flag.Int64("record-max-body", 1<<20, "Largest request body recorded; requests with larger bodies aren't recorded")
+)
+
+func init() {
+	commands["replay"] = replayCommand
+}
+
+// recordedRequest is a request saved to the recording directory, with the
+// outcome it had
+type recordedRequest struct {
+	Time       time.Time   `json:"time"`
+	Method     string      `json:"method"`
+	URI        string      `json:"uri"`
+	Host       string      `json:"host"`
+	Proto      string      `json:"proto"`
+	RemoteAddr string      `json:"remote_addr"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body,omitempty"`
+	Env        []string    `json:"env,omitempty"`
+	Status     int         `json:"status"`
+	BodySHA256 string      `json:"response_sha256"`
+}
+
+// recordingKey is the context key of the recordedRequest of a request
+type recordingKey struct{}
+
+// recordSeq numbers recordings made within the same microsecond
+var recordSeq atomic.Uint64
+
+// recordEnvironment saves the environment built for a request being recorded
+func recordEnvironment(r *http.Request, env []string) {
+	if rec, ok := r.Context().Value(recordingKey{}).(*recordedRequest); ok {
+		rec.Env = env
+	}
+}
+
+// outcomeRecorder notes the status of a response and hashes its body
+type outcomeRecorder struct {
+	http.ResponseWriter
+	status int
+	hash   hash.Hash
+}
+
+func (rec *outcomeRecorder) WriteHeader(status int) {
+	if rec.status == 0 && !isInterim(status) {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *outcomeRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.hash.Write(p)
+	return rec.ResponseWriter.Write(p)
+}
+
+func (rec *outcomeRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// withRecording saves each request and its outcome to the recording directory
+func withRecording(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, *recordMaxBody+1))
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		if int64(len(body)) > *recordMaxBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &recordedRequest{
+			Time:       time.Now(),
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Host:       r.Host,
+			Proto:      r.Proto,
+			RemoteAddr: r.RemoteAddr,
+			Header:     r.Header.Clone(),
+			Body:       body,
+		}
+		out := &outcomeRecorder{ResponseWriter: w, hash: sha256.New()}
+		next.ServeHTTP(out, r.WithContext(context.WithValue(r.Context(), recordingKey{}, rec)))
+		rec.Status = out.status
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		rec.BodySHA256 = hex.EncodeToString(out.hash.Sum(nil))
+
+		data, err := json.MarshalIndent(rec, "", "  ")
+		if err == nil {
+			name := fmt.Sprintf("%s-%06d.json", rec.Time.UTC().Format("20060102T150405.000000"), recordSeq.Add(1))
+			err = os.WriteFile(filepath.Join(*recordDir, name), data, 0600)
+		}
+		if err != nil {
+			log.Printf("Failed to record request %s: %v", r.RequestURI, err)
+		}
+	})
+}
+
+// replayCommand re-issues recorded requests through the server's handlers and
+// reports those whose status or response body changed:
+//
+//	cgiserver [flags] replay [-v] dir|file...
+func replayCommand(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	verbose := flags.Bool("v", false, "Report every request, not only the changed ones")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: cgiserver [flags] replay [-v] dir|file...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var files []string
+	for _, arg := range flags.Args() {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*.json"))
+		if err != nil {
+			return err
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+
+	handler := setupServer()
+	changed := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var rec recordedRequest
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+
+		r, err := http.NewRequest(rec.Method, rec.URI, bytes.NewReader(rec.Body))
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		r.RequestURI = rec.URI
+		r.Host = rec.Host
+		r.RemoteAddr = rec.RemoteAddr
+		r.Header = rec.Header
+		if r.Header == nil {
+			r.Header = make(http.Header)
+		}
+		r.ContentLength = int64(len(rec.Body))
+
+		resp := newBufferedResponse()
+		handler.ServeHTTP(resp, r)
+		if resp.status == 0 {
+			resp.status = http.StatusOK
+		}
+		sum := sha256.Sum256(resp.body.Bytes())
+
+		var diffs []string
+		if resp.status != rec.Status {
+			diffs = append(diffs, fmt.Sprintf("status %d, recorded %d", resp.status, rec.Status))
+		}
+		if hex.EncodeToString(sum[:]) != rec.BodySHA256 {
+			diffs = append(diffs, "response body differs")
+		}
+		if len(diffs) > 0 {
+			changed++
+			fmt.Printf("%s: %s %s: %s\n", file, rec.Method, rec.URI, strings.Join(diffs, ", "))
+		} else if *verbose {
+			fmt.Printf("%s: %s %s: unchanged\n", file, rec.Method, rec.URI)
+		}
+	}
+
+	fmt.Printf("Replayed %d requests, %d changed\n", len(files), changed)
+	if changed > 0 {
+		return fmt.Errorf("%d responses changed", changed)
+	}
+	return nil
+}
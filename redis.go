@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	redisAddr     = flag.String("redis", "", "Address (host:port) of a Redis server to share the response cache between instances")
+	redisPassword = flag.String("redis-password", "", "Password for the Redis server")
+	redisDB       = flag.Int("redis-db", 0, "Redis database number")
+	redisPrefix   = flag.String("redis-prefix", "cgiserver:", "Prefix for keys stored in Redis")
+)
+
+// redisPoolSize is the number of idle connections kept open to Redis
+const redisPoolSize = 8
+
+// redisClient is a minimal Redis client speaking the RESP protocol, with a
+// small pool of idle connections
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+// redisConn is a single connection to the Redis server
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newRedisClient creates a client; connections are established lazily
+func newRedisClient(addr, password string, db int) *redisClient {
+	return &redisClient{
+		addr:     addr,
+		password: password,
+		db:       db,
+		idle:     make(chan *redisConn, redisPoolSize),
+	}
+}
+
+// dial opens and authenticates a new connection
+func (c *redisClient) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if c.password != "" {
+		if _, err := rc.do("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do runs a command on a pooled connection and returns its reply
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-c.idle:
+	default:
+		var err error
+		if rc, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rc.do(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// The connection is in an unknown state, discard it
+		rc.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// do sends a command and reads the reply
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return rc.readReply()
+}
+
+// readReply parses a single RESP reply. Bulk strings are returned as
+// []byte, with nil for a null reply.
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = rc.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// redisEntry is the serialized form of a cached response
+type redisEntry struct {
+	Host         string
+	URI          string
+	Status       int
+	Header       http.Header
+	Body         []byte
+	Stored       time.Time
+	Expires      time.Time
+	ETag         string
+	LastModified time.Time
+	Vary         []string
+}
+
+// redisCache is a cacheStore shared between instances through Redis. Expiry
+// is delegated to Redis, and eviction to its maxmemory policy.
+type redisCache struct {
+	client *redisClient
+}
+
+func newRedisCache(client *redisClient) *redisCache {
+	return &redisCache{client: client}
+}
+
+func (c *redisCache) key(key string) string {
+	return *redisPrefix + "cache:" + key
+}
+
+func (c *redisCache) get(key string) *cachedResponse {
+	reply, err := c.client.do("GET", c.key(key))
+	if err != nil {
+		log.Printf("Redis cache GET failed: %v", err)
+		return nil
+	}
+	data, ok := reply.([]byte)
+	if !ok || data == nil {
+		return nil
+	}
+
+	var e redisEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		log.Printf("Invalid redis cache entry %s: %v", key, err)
+		return nil
+	}
+	return &cachedResponse{
+		key:          key,
+		host:         e.Host,
+		uri:          e.URI,
+		status:       e.Status,
+		header:       e.Header,
+		body:         e.Body,
+		stored:       e.Stored,
+		expires:      e.Expires,
+		etag:         e.ETag,
+		lastModified: e.LastModified,
+		vary:         e.Vary,
+	}
+}
+
+func (c *redisCache) put(entry *cachedResponse) {
+	if entry.size() > *cacheMaxEntry {
+		return
+	}
+	ttl := time.Until(entry.expires).Milliseconds()
+	if ttl <= 0 {
+		return
+	}
+
+	data, err := json.Marshal(redisEntry{
+		Host:         entry.host,
+		URI:          entry.uri,
+		Status:       entry.status,
+		Header:       entry.header,
+		Body:         entry.body,
+		Stored:       entry.stored,
+		Expires:      entry.expires,
+		ETag:         entry.etag,
+		LastModified: entry.lastModified,
+		Vary:         entry.vary,
+	})
+	if err != nil {
+		log.Printf("Error encoding redis cache entry %s: %v", entry.key, err)
+		return
+	}
+	if _, err := c.client.do("SET", c.key(entry.key), string(data), "PX", strconv.FormatInt(ttl, 10)); err != nil {
+		log.Printf("Redis cache SET failed: %v", err)
+	}
+}
+
+// purge deletes matching entries and their variants
+func (c *redisCache) purge(host, uri string, prefix bool) int {
+	pattern := redisGlobEscape(c.key(http.MethodGet + " " + host + " " + uri))
+	if prefix {
+		return c.deleteMatching(pattern + "*")
+	}
+	return c.deleteMatching(pattern) + c.deleteMatching(pattern+"#*")
+}
+
+// deleteMatching deletes the keys matching a glob pattern, using SCAN to find
+// them so as not to block the server
+func (c *redisCache) deleteMatching(pattern string) int {
+	n := 0
+	cursor := "0"
+	for {
+		reply, err := c.client.do("SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			log.Printf("Redis cache SCAN failed: %v", err)
+			return n
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			log.Printf("Redis cache SCAN returned an unexpected reply")
+			return n
+		}
+		next, _ := items[0].([]byte)
+		keys, _ := items[1].([]interface{})
+		for _, k := range keys {
+			key, _ := k.([]byte)
+			if reply, err := c.client.do("DEL", string(key)); err != nil {
+				log.Printf("Redis cache DEL failed: %v", err)
+			} else if deleted, _ := reply.(int64); deleted > 0 {
+				n++
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return n
+		}
+	}
+}
+
+// redisGlobEscape escapes the glob metacharacters understood by SCAN MATCH
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,14 @@
+//go:build !unix || solaris
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// setReusePort fails, as SO_REUSEPORT load balancing is unavailable
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("-reuseport is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var rewriteRules = flag.String("rewrite-rules", "", "File of URL rewrite rules applied before scripts are resolved")
+
+// Rewrite rules are read one per line as "pattern replacement [flags]", and
+// applied in order to the request path. The pattern is a regular expression,
+// and the replacement may refer to its groups as $1 or ${name}. A query
+// string in the replacement is merged with the request's own query string.
+// Flags are comma-separated:
+//
+//	L          stop processing rules after this one
+//	R, R=code  redirect the client instead of rewriting, by default with 302
+//	PT         pass the request through unchanged and stop processing rules;
+//	           the replacement is ignored and is usually written as "-"
+//
+// For example:
+//
+//	^/static/                 -                                  [PT]
+//	^/blog/(\d+)/([\w-]+)$    /cgi-bin/blog.cgi?year=$1&slug=$2  [L]
+//	^/old/(.*)$               /new/$1                            [R=301]
+
+// rewriteRule is a parsed rewrite rule
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	last        bool
+	redirect    int
+	passThrough bool
+}
+
+// loadRewriteRules reads a rewrite rules file
+func loadRewriteRules(path string) ([]rewriteRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []rewriteRule
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected pattern replacement [flags]", path, line)
+		}
+		pattern, err := regexp.Compile(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		rule := rewriteRule{pattern: pattern, replacement: fields[1]}
+		if len(fields) == 3 {
+			if err := rule.parseFlags(fields[2]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// parseFlags parses the bracketed flags of a rule
+func (rule *rewriteRule) parseFlags(spec string) error {
+	if !strings.HasPrefix(spec, "[") || !strings.HasSuffix(spec, "]") {
+		return fmt.Errorf("invalid flags %q", spec)
+	}
+	for _, item := range strings.Split(spec[1:len(spec)-1], ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+		switch strings.ToUpper(name) {
+		case "L":
+			rule.last = true
+		case "R":
+			rule.redirect = http.StatusFound
+			if value != "" {
+				code, err := strconv.Atoi(value)
+				if err != nil || code < 300 || code > 399 {
+					return fmt.Errorf("invalid redirect status %q", value)
+				}
+				rule.redirect = code
+			}
+		case "PT":
+			rule.passThrough = true
+		default:
+			return fmt.Errorf("unknown flag %q", name)
+		}
+	}
+	return nil
+}
+
+// originalURIKey is the context key of the request target before rewriting
+type originalURIKey struct{}
+
+// originalRequestURI returns the request target as received from the client
+func originalRequestURI(r *http.Request) string {
+	if uri, ok := r.Context().Value(originalURIKey{}).(string); ok {
+		return uri
+	}
+	return r.RequestURI
+}
+
+// withRewrites applies the rewrite rules to requests before passing them to
+// the next handler
+func withRewrites(rules []rewriteRule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, query := r.URL.Path, r.URL.RawQuery
+		rewritten := false
+		for _, rule := range rules {
+			match := rule.pattern.FindStringSubmatchIndex(path)
+			if match == nil {
+				continue
+			}
+			if rule.passThrough {
+				break
+			}
+
+			target := string(rule.pattern.ExpandString(nil, rule.replacement, path, match))
+			target, targetQuery, _ := strings.Cut(target, "?")
+			if targetQuery != "" && query != "" {
+				query = targetQuery + "&" + query
+			} else if targetQuery != "" {
+				query = targetQuery
+			}
+
+			if rule.redirect != 0 {
+				if query != "" {
+					target += "?" + query
+				}
+				http.Redirect(w, r, target, rule.redirect)
+				return
+			}
+			path = target
+			rewritten = true
+			if rule.last {
+				break
+			}
+		}
+
+		if rewritten {
+			// The URL is copied, so the handlers around keep seeing the
+			// original one
+			r = r.WithContext(context.WithValue(r.Context(), originalURIKey{}, r.RequestURI))
+			u := *r.URL
+			r.URL = &u
+			r.URL.Path = path
+			r.URL.RawPath = ""
+			r.URL.RawQuery = query
+			r.RequestURI = r.URL.RequestURI()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	frontControllers = flag.String("front-controller", "", "Comma-separated list of prefix=script rules sending every request under a URL prefix to one script, with the rest of the path in PATH_INFO, e.g. /app/=app/dispatch.py")
+	notFoundScript   = flag.String("not-found-script", "", "Script, relative to the CGI directory, run instead of returning 404 when no script matches; it gets the original path in PATH_INFO and REDIRECT_URL")
+	methodRoutes     = flag.String("method-routes", "", "File of \"path method script\" lines routing a URL path to different scripts by request method")
+	aliases          = flag.String("alias", "", "Comma-separated list of prefix=directory rules serving scripts under a URL prefix from another directory, e.g. /tools/=/opt/tools/cgi")
+)
+
+// parseFrontControllers parses the front controller rules into handlers
+// keyed by URL prefix
+func parseFrontControllers(spec string) (map[string]http.Handler, error) {
+	handlers := make(map[string]http.Handler)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, script, ok := strings.Cut(item, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") {
+			return nil, fmt.Errorf("invalid front controller %q, expected /prefix/=script", item)
+		}
+		if !isPathSafe(script) {
+			return nil, fmt.Errorf("invalid front controller script %q", script)
+		}
+		handlers[prefix] = frontController(prefix, script)
+		log.Printf("Front controller: %s* handled by %s", prefix, script)
+	}
+	return handlers, nil
+}
+
+// frontController sends every request under a prefix to a single script,
+// relative to the CGI directory
+func frontController(prefix, script string) http.Handler {
+	scriptName := strings.TrimSuffix(prefix, "/")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reject traversal attempts before they reach the application
+		if !isPathSafe(strings.TrimPrefix(r.URL.Path, "/")) {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			log.Printf("Rejected unsafe path: %s", r.URL.Path)
+			auditReject(r, auditUnsafePath, r.URL.Path)
+			return
+		}
+
+		root := cgiRoot(r)
+		serveScript(w, r, cgiTarget{
+			root:       root,
+			scriptPath: filepath.Join(root, script),
+			scriptName: scriptName,
+			pathInfo:   strings.TrimPrefix(r.URL.Path, scriptName),
+		})
+	})
+}
+
+// parseAliases parses the alias rules and adds their handlers to those keyed
+// by URL prefix
+func parseAliases(spec string, handlers map[string]http.Handler) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, dir, ok := strings.Cut(item, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") || dir == "" {
+			return fmt.Errorf("invalid alias %q, expected /prefix/=directory", item)
+		}
+		if _, exists := handlers[prefix]; exists || prefix == *cgiPrefix {
+			return fmt.Errorf("alias prefix %s is already routed", prefix)
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("alias target %s is not a directory", dir)
+		}
+
+		root := filepath.Clean(dir)
+		handlers[prefix] = http.StripPrefix(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveFromDir(w, r, prefix, root)
+		}))
+		log.Printf("Alias: %s* served from %s", prefix, root)
+	}
+	return nil
+}
+
+// notFoundTarget returns the not-found script as the target of a request
+// whose script doesn't exist
+func notFoundTarget(r *http.Request, target cgiTarget) (cgiTarget, bool) {
+	if *notFoundScript == "" || target.redirectURL != "" {
+		return cgiTarget{}, false
+	}
+	if _, err := statScript(target.scriptPath); !os.IsNotExist(err) {
+		return cgiTarget{}, false
+	}
+	return notFound(r), true
+}
+
+// notFound returns the not-found script as the target of a request
+func notFound(r *http.Request) cgiTarget {
+	// r.URL.Path may have had its prefix stripped
+	original, _, _ := strings.Cut(r.RequestURI, "?")
+	if p, err := url.PathUnescape(original); err == nil {
+		original = p
+	}
+	root := cgiRoot(r)
+	return cgiTarget{
+		root:        root,
+		scriptPath:  filepath.Join(root, *notFoundScript),
+		scriptName:  *cgiPrefix + strings.TrimPrefix(filepath.ToSlash(*notFoundScript), "/"),
+		pathInfo:    original,
+		redirectURL: original,
+	}
+}
+
+// handleNotFound runs the not-found script for requests outside every route
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	serveScript(w, r, notFound(r))
+}
+
+// loadMethodRoutes reads the method routing file and adds a handler for each
+// routed path to those keyed by URL prefix. Each line is "path method script",
+// where the script is relative to the CGI directory and the method "*"
+// matches any method without a script of its own:
+//
+//	/guestbook  GET   guestbook/view.cgi
+//	/guestbook  POST  guestbook/sign.cgi
+func loadMethodRoutes(routesFile string, handlers map[string]http.Handler) error {
+	f, err := os.Open(routesFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var paths []string
+	scripts := make(map[string]map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 3 || !strings.HasPrefix(fields[0], "/") {
+			return fmt.Errorf("%s:%d: expected path method script", routesFile, line)
+		}
+		path, method, script := fields[0], strings.ToUpper(fields[1]), fields[2]
+		if !isPathSafe(script) {
+			return fmt.Errorf("%s:%d: invalid script %q", routesFile, line, script)
+		}
+		if scripts[path] == nil {
+			if _, exists := handlers[path]; exists {
+				return fmt.Errorf("%s:%d: path %s is already routed", routesFile, line, path)
+			}
+			scripts[path] = make(map[string]string)
+			paths = append(paths, path)
+		}
+		scripts[path][method] = script
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		handlers[path] = methodRouter(path, scripts[path])
+		log.Printf("Method routes: %s has %d scripts", path, len(scripts[path]))
+	}
+	return nil
+}
+
+// methodRouter sends requests for a path to the script for their method,
+// relative to the CGI directory
+func methodRouter(path string, scripts map[string]string) http.Handler {
+	var allowed []string
+	for method := range scripts {
+		if method != "*" {
+			allowed = append(allowed, method)
+		}
+	}
+	sort.Strings(allowed)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		script, ok := scripts[r.Method]
+		if !ok && r.Method == http.MethodHead {
+			script, ok = scripts[http.MethodGet]
+		}
+		if !ok {
+			script, ok = scripts["*"]
+		}
+		if !ok {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		root := cgiRoot(r)
+		serveScript(w, r, cgiTarget{
+			root:       root,
+			scriptPath: filepath.Join(root, script),
+			scriptName: path,
+		})
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+func init() {
+	commands["run"] = runScriptCommand
+}
+
+// runScriptCommand serves a single request given on the command line through
+// the same handlers as the server, and prints the response:
+//
+//	cgiserver run [-method M] [-data D] [-header "Name: value"]... script|/path
+func runScriptCommand(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	var rf requestFlags
+	rf.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: cgiserver [flags] run [-method M] [-data D] [-header \"Name: value\"]... script|/path")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	r, err := rf.build(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	handler := setupServer()
+	resp := newBufferedResponse()
+	handler.ServeHTTP(resp, r)
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+
+	fmt.Printf("%s %d %s\r\n", r.Proto, resp.status, http.StatusText(resp.status))
+	resp.header.Write(os.Stdout)
+	fmt.Print("\r\n")
+	_, err = os.Stdout.Write(resp.body.Bytes())
+	return err
+}
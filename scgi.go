@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var scgiUpstreams = flag.String("scgi", "", "Comma-separated list of extension-or-prefix=address SCGI upstreams, e.g. /cgi-bin/app/=127.0.0.1:4000")
+
+// serveSCGI forwards a request using the SCGI protocol, see
+// https://python.ca/scgi/protocol.txt
+func serveSCGI(conn net.Conn, w http.ResponseWriter, r *http.Request, scriptPath string, env []string) error {
+	body, length, err := sizedBody(r)
+	if err != nil {
+		return err
+	}
+
+	// The headers are a netstring of NUL-terminated names and values, which
+	// must start with CONTENT_LENGTH and include SCGI=1
+	var headers strings.Builder
+	for _, kv := range append(withContentLength(env, length), "SCGI=1") {
+		name, value, _ := strings.Cut(kv, "=")
+		headers.WriteString(name)
+		headers.WriteByte(0)
+		headers.WriteString(value)
+		headers.WriteByte(0)
+	}
+
+	bw := bufio.NewWriter(conn)
+	fmt.Fprintf(bw, "%d:%s,", headers.Len(), headers.String())
+	if _, err := io.Copy(bw, body); err != nil {
+		return fmt.Errorf("error sending SCGI request: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error sending SCGI request: %v", err)
+	}
+
+	// The response is in the same format as CGI script output
+	return relayCGIResponse(conn, w)
+}
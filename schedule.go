@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var scheduleFile = flag.String("schedule", "", "File of cron-style \"minute hour day month weekday script\" lines running scripts periodically")
+
+func init() {
+	adminEndpoints["schedule"] = handleSchedule
+}
+
+// Schedule lines have the five time fields of crontab(5), with lists,
+// ranges and steps, followed by a script relative to the CGI directory or a
+// URL path, with an optional query string. The script is run through the
+// server's handlers as a GET request from 127.0.0.1, and its response status,
+// exit status and duration are logged. @hourly, @daily, @weekly, @monthly and
+// @yearly may replace the time fields. For example:
+//
+//	*/15 * * * *  cleanup.cgi
+//	30 2 * * 1-5  reports/nightly.cgi?format=pdf
+//	@daily        /cgi-bin/rotate.cgi
+
+// cronMacros are the shorthands for common schedules
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// cronSchedule has a bit set for each minute, hour, day of the month, month
+// and day of the week it fires at
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Days match on either field when both are restricted, as in cron
+	domStar, dowStar bool
+}
+
+// jobStats describes how the runs of a scheduled job went
+type jobStats struct {
+	Running      bool       `json:"running"`
+	Runs         int        `json:"runs"`
+	Failures     int        `json:"failures"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastStatus   int        `json:"last_status,omitempty"`
+	LastExit     string     `json:"last_exit,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+}
+
+// scheduledJob is a script run on a schedule
+type scheduledJob struct {
+	spec     string
+	target   string
+	schedule cronSchedule
+
+	mu    sync.Mutex
+	stats jobStats
+}
+
+var scheduledJobs []*scheduledJob
+
+// parseCronField parses a field of a schedule into a bit set of the values
+// it matches between min and max
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			loText, hiText, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(loText); err != nil {
+				return 0, fmt.Errorf("invalid value %q", loText)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiText); err != nil {
+					return 0, fmt.Errorf("invalid value %q", hiText)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// parseCronSchedule parses the five time fields of a schedule
+func parseCronSchedule(fields []string) (cronSchedule, error) {
+	var s cronSchedule
+	limits := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := [5]*uint64{&s.minute, &s.hour, &s.dom, &s.month, &s.dow}
+	for i, field := range fields {
+		set, err := parseCronField(field, limits[i][0], limits[i][1])
+		if err != nil {
+			return s, err
+		}
+		*sets[i] = set
+	}
+	// Sunday is either 0 or 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// matches tells whether a schedule fires at a given minute
+func (s *cronSchedule) matches(t time.Time) bool {
+	if s.minute&(1<<t.Minute()) == 0 || s.hour&(1<<t.Hour()) == 0 || s.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<int(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// loadSchedule reads a schedule file
+func loadSchedule(path string) ([]*scheduledJob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var jobs []*scheduledJob
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if macro, ok := cronMacros[fields[0]]; ok {
+			fields = append(strings.Fields(macro), fields[1:]...)
+		}
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("%s:%d: expected minute hour day month weekday script", path, line)
+		}
+		schedule, err := parseCronSchedule(fields[:5])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		jobs = append(jobs, &scheduledJob{spec: strings.Join(fields[:5], " "), target: fields[5], schedule: schedule})
+	}
+	return jobs, scanner.Err()
+}
+
+// startScheduler runs the scheduled jobs through the server's handler at the
+// start of every minute they are due
+func startScheduler(jobs []*scheduledJob, handler http.Handler) {
+	scheduledJobs = jobs
+	go func() {
+		for {
+			now := time.Now()
+			next := now.Truncate(time.Minute).Add(time.Minute)
+			time.Sleep(next.Sub(now))
+			for _, job := range jobs {
+				if job.schedule.matches(next) {
+					go job.run(handler)
+				}
+			}
+		}
+	}()
+}
+
+// run runs a job once, unless its previous run is still going
+func (job *scheduledJob) run(handler http.Handler) {
+	job.mu.Lock()
+	if job.stats.Running {
+		job.mu.Unlock()
+		log.Printf("Skipped scheduled run of %s: previous run still going", job.target)
+		return
+	}
+	job.stats.Running = true
+	job.mu.Unlock()
+
+	start := time.Now()
+	status, exit, output := job.serve(handler)
+	elapsed := time.Since(start)
+	log.Printf("Scheduled run of %s: status %d, %s, in %s", job.target, status, exit, elapsed.Round(time.Millisecond))
+	if status >= 400 && output != "" {
+		log.Printf("Scheduled run of %s output: %s", job.target, truncate(output, 1024))
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.stats.Running = false
+	job.stats.Runs++
+	if status >= 500 {
+		job.stats.Failures++
+	}
+	job.stats.LastRun = &start
+	job.stats.LastStatus = status
+	job.stats.LastExit = exit
+	job.stats.LastDuration = elapsed.Round(time.Millisecond).String()
+}
+
+// serve sends the synthetic request of a job to the handler
+func (job *scheduledJob) serve(handler http.Handler) (int, string, string) {
+	rf := requestFlags{remoteAddr: "127.0.0.1:0"}
+	r, err := rf.request(job.target, nil)
+	if err != nil {
+		return http.StatusBadRequest, err.Error(), ""
+	}
+	// Collect the exit status of the script
+	info := &debugInfo{}
+	r = r.WithContext(context.WithValue(r.Context(), debugKey{}, info))
+	resp := newBufferedResponse()
+	handler.ServeHTTP(resp, r)
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	exit := info.exit
+	if exit == "" {
+		exit = "not run"
+	}
+	return resp.status, exit, resp.body.String()
+}
+
+// handleSchedule lists the scheduled jobs and how their runs went
+func handleSchedule(w http.ResponseWriter, r *http.Request) {
+	type jobStatus struct {
+		Schedule string `json:"schedule"`
+		Script   string `json:"script"`
+		jobStats
+	}
+	jobs := make([]jobStatus, len(scheduledJobs))
+	for i, job := range scheduledJobs {
+		job.mu.Lock()
+		jobs[i] = jobStatus{job.spec, job.target, job.stats}
+		job.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// scriptMetaSuffix names the optional TOML sidecar file next to a script,
+// e.g. report.cgi.meta:
+//
+//	timeout = "2m"
+//	concurrency = 2
+//	methods = ["GET", "HEAD"]
+//	content_type = "text/html; charset=utf-8"
+//	trusted = true
+//	debug = true
+//	webhook = "stripe:whsec_..."
+//	async = true
+//	queue = "reports"
+//
+//	[env]
+//	REPORT_DB = "/var/db/reports.sqlite"
+//
+// Its settings take precedence over the per-directory configuration.
+const scriptMetaSuffix = ".meta"
+
+// scriptMeta is the content of a sidecar file
+type scriptMeta struct {
+	Timeout     string            `toml:"timeout"`
+	Concurrency int               `toml:"concurrency"`
+	Methods     []string          `toml:"methods"`
+	ContentType string            `toml:"content_type"`
+	Trusted     *bool             `toml:"trusted"`
+	Debug       *bool             `toml:"debug"`
+	Webhook     string            `toml:"webhook"`
+	Async       *bool             `toml:"async"`
+	Queue       string            `toml:"queue"`
+	Env         map[string]string `toml:"env"`
+}
+
+// scriptMetaEntry caches a parsed sidecar file
+type scriptMetaEntry struct {
+	modTime time.Time
+	size    int64
+	meta    *scriptMeta
+}
+
+var (
+	scriptMetaMu    sync.Mutex
+	scriptMetaCache = make(map[string]scriptMetaEntry)
+)
+
+// readScriptMeta returns the parsed sidecar file of a script, or nil if it
+// has none, reusing the parsed content until the file changes
+func readScriptMeta(scriptPath string) (*scriptMeta, error) {
+	metaPath := scriptPath + scriptMetaSuffix
+	info, err := os.Stat(metaPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scriptMetaMu.Lock()
+	entry, ok := scriptMetaCache[metaPath]
+	scriptMetaMu.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.meta, nil
+	}
+
+	meta := &scriptMeta{}
+	md, err := toml.DecodeFile(metaPath, meta)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("%s: unknown setting %q", metaPath, undecoded[0].String())
+	}
+
+	scriptMetaMu.Lock()
+	scriptMetaCache[metaPath] = scriptMetaEntry{modTime: info.ModTime(), size: info.Size(), meta: meta}
+	scriptMetaMu.Unlock()
+	return meta, nil
+}
+
+// applyMeta merges sidecar settings into a configuration
+func (cfg *scriptConfig) applyMeta(source string, meta *scriptMeta) error {
+	if meta.Timeout != "" {
+		d, err := time.ParseDuration(meta.Timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("%s: invalid timeout %q", source, meta.Timeout)
+		}
+		cfg.timeout = d
+	}
+	if meta.Concurrency < 0 {
+		return fmt.Errorf("%s: invalid concurrency %d", source, meta.Concurrency)
+	}
+	cfg.concurrency = meta.Concurrency
+	if meta.Methods != nil {
+		cfg.methods = nil
+		for _, m := range meta.Methods {
+			cfg.methods = append(cfg.methods, strings.ToUpper(strings.TrimSpace(m)))
+		}
+	}
+	cfg.contentType = meta.ContentType
+	if meta.Trusted != nil {
+		cfg.trusted = *meta.Trusted
+	}
+	if meta.Debug != nil {
+		cfg.debug = *meta.Debug
+	}
+	if meta.Webhook != "" {
+		provider, secret, err := parseWebhook(meta.Webhook)
+		if err != nil {
+			return fmt.Errorf("%s: %v", source, err)
+		}
+		cfg.webhookProvider, cfg.webhookSecret = provider, secret
+	}
+	if meta.Async != nil {
+		cfg.async = *meta.Async
+	}
+	if meta.Queue != "" {
+		if err := validQueue(meta.Queue); err != nil {
+			return fmt.Errorf("%s: %v", source, err)
+		}
+		cfg.queue = meta.Queue
+	}
+	for name, value := range meta.Env {
+		if name == "" || strings.Contains(name, "=") {
+			return fmt.Errorf("%s: invalid env variable name %q", source, name)
+		}
+		cfg.env = append(cfg.env, name+"="+value)
+	}
+	return nil
+}
+
+// scriptSlots limits the number of concurrent executions of scripts whose
+// sidecar sets a concurrency limit
+var (
+	scriptSlotsMu sync.Mutex
+	scriptSlots   = make(map[string]chan struct{})
+)
+
+// acquireScriptSlot reserves one of a script's execution slots, and returns
+// a function releasing it, or false if all slots are busy
+func acquireScriptSlot(scriptPath string, limit int) (func(), bool) {
+	if limit <= 0 {
+		return func() {}, true
+	}
+
+	scriptSlotsMu.Lock()
+	slots, ok := scriptSlots[scriptPath]
+	if !ok || cap(slots) != limit {
+		slots = make(chan struct{}, limit)
+		scriptSlots[scriptPath] = slots
+	}
+	scriptSlotsMu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	readHeaderTimeout = flag.Duration("read-header-timeout", 10*time.Second, "Maximum time to read a request's headers, or 0 for no limit")
+	readTimeout       = flag.Duration("read-timeout", 0, "Maximum time to read a whole request including its body, or 0 for no limit beyond -read-header-timeout and -body-idle-timeout")
+	writeTimeout      = flag.Duration("write-timeout", 0, "Maximum time from the end of the request headers to the end of the response, or 0 for no limit beyond the script timeout")
+	idleTimeout       = flag.Duration("idle-timeout", 2*time.Minute, "Maximum time to wait for the next request on a keep-alive connection, or 0 to use the read timeout")
+	maxHeaderBytes    = flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of a request's header, larger requests are rejected with 431 (Go allows 4096 bytes of slack)")
+	maxHeaderCount    = flag.Int("max-headers", 100, "Maximum number of request header lines, more are rejected with 431, or 0 for no limit")
+	maxURLLength      = flag.Int("max-url-length", 8192, "Maximum length of a request URL, longer ones are rejected with 414, or 0 for no limit")
+	maxQueryLength    = flag.Int("max-query-length", 4096, "Maximum length of a query string, which scripts receive unsanitized, longer ones are rejected with 414, or 0 for no limit")
+	disableKeepAlive  = flag.Bool("disable-keepalive", false, "Close every connection after one request, so load balancers can rebalance clients freely")
+	maxConnRequests   = flag.Int("max-requests-per-conn", 0, "Close keep-alive connections with \"Connection: close\" after this many requests, or 0 for no limit")
+	requestTimeout    = flag.Duration("request-timeout", 0, "Maximum time to handle a request, from reading its body through running the script to writing the response, or 0 for no limit beyond the script timeout")
+)
+
+// connRequestsKey is the context key of a connection's request counter
+type connRequestsKey struct{}
+
+// newServer creates the HTTP server with the configured limits
+func newServer(handler http.Handler) *http.Server {
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    *maxHeaderBytes,
+	}
+	if *disableKeepAlive {
+		server.SetKeepAlivesEnabled(false)
+	} else if *maxConnRequests > 0 {
+		server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connRequestsKey{}, new(atomic.Int64))
+		}
+		server.Handler = withConnRequestLimit(handler)
+	}
+	return server
+}
+
+// serve serves HTTP, or HTTPS when the server has a TLS configuration
+func serve(server *http.Server, ln net.Listener) error {
+	if server.TLSConfig != nil {
+		return server.ServeTLS(ln, "", "")
+	}
+	return server.Serve(ln)
+}
+
+// withConnRequestLimit asks the client to close its connection once it has
+// made the maximum number of requests on it
+func withConnRequestLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count, ok := r.Context().Value(connRequestsKey{}).(*atomic.Int64); ok && count.Add(1) >= int64(*maxConnRequests) {
+			w.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withHeaderLimits rejects requests with too many header lines before any
+// other handling; oversized headers are already refused by the server
+func withHeaderLimits(next http.Handler) http.Handler {
+	if *maxHeaderCount <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := 0
+		for _, values := range r.Header {
+			count += len(values)
+		}
+		if count > *maxHeaderCount {
+			http.Error(w, "Too many request headers", http.StatusRequestHeaderFieldsTooLarge)
+			log.Printf("Refused request from %s with %d header lines", r.RemoteAddr, count)
+			auditReject(r, auditTooManyHeaders, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withURLLimits rejects requests with overlong URLs or query strings
+func withURLLimits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *maxURLLength > 0 && len(r.RequestURI) > *maxURLLength {
+			http.Error(w, "URL too long", http.StatusRequestURITooLong)
+			log.Printf("Refused request from %s with a %d byte URL", r.RemoteAddr, len(r.RequestURI))
+			auditReject(r, auditURLTooLong, "")
+			return
+		}
+		if *maxQueryLength > 0 && len(r.URL.RawQuery) > *maxQueryLength {
+			http.Error(w, "Query string too long", http.StatusRequestURITooLong)
+			log.Printf("Refused request from %s with a %d byte query string", r.RemoteAddr, len(r.URL.RawQuery))
+			auditReject(r, auditURLTooLong, "query string")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withRequestTimeout bounds the handling of each request with a deadline
+// covering the connection as well as the scripts run for it, so a slow client
+// cannot stretch a script's time budget
+func withRequestTimeout(next http.Handler) http.Handler {
+	if *requestTimeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline := time.Now().Add(*requestTimeout)
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(deadline)
+		rc.SetWriteDeadline(deadline)
+		// The server only resets the write deadline itself with -write-timeout
+		defer rc.SetWriteDeadline(time.Time{})
+
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// startedAsService reports whether the server was started by a service
+// manager that expects a handshake, which only Windows has
+func startedAsService() bool {
+	return false
+}
+
+// runService serves until the server fails
+func runService(server *http.Server, ln net.Listener) error {
+	return serve(server, ln)
+}
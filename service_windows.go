@@ -0,0 +1,220 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+var serviceName = flag.String("service-name", "cgiserver", "Name of the Windows service, used by the service command and as the event log source")
+
+func init() {
+	commands["service"] = serviceCommand
+}
+
+// eventLogWriter sends log output to the Windows event log
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	var err error
+	if strings.Contains(msg, "failed") || strings.Contains(msg, "Error") {
+		err = w.elog.Error(1, msg)
+	} else {
+		err = w.elog.Info(1, msg)
+	}
+	return len(p), err
+}
+
+// startedAsService reports whether the server was started by the service
+// control manager, and if so sends the log to the event log
+func startedAsService() bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false
+	}
+	if elog, err := eventlog.Open(*serviceName); err == nil {
+		log.SetFlags(0)
+		log.SetOutput(eventLogWriter{elog})
+	}
+	return true
+}
+
+// cgiService runs the server under the service control manager
+type cgiService struct {
+	server *http.Server
+	ln     net.Listener
+}
+
+func (s *cgiService) Execute(args []string, changes <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- serve(s.server, s.ln)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-errc:
+			if err == http.ErrServerClosed {
+				waitDrained()
+				log.Printf("Service drained, stopping")
+				return false, 0
+			}
+			log.Printf("Server failed: %v", err)
+			return true, 1
+		case c := <-changes:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+				if err := s.server.Shutdown(ctx); err != nil {
+					log.Printf("Error stopping server: %v", err)
+				}
+				cancel()
+				log.Printf("Service stopped")
+				return false, 0
+			}
+		}
+	}
+}
+
+// runService serves under the service control manager until the service is
+// stopped
+func runService(server *http.Server, ln net.Listener) error {
+	return svc.Run(*serviceName, &cgiService{server: server, ln: ln})
+}
+
+// serviceCommand installs, removes, starts or stops the Windows service. The
+// server flags given before the command are recorded in the service's
+// command line.
+func serviceCommand(args []string) error {
+	flags := flag.NewFlagSet("service", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: cgiserver [flags] service install|remove|start|stop\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	switch action := flags.Arg(0); action {
+	case "install":
+		return installService(m)
+	case "remove":
+		s, err := m.OpenService(*serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s is not installed: %v", *serviceName, err)
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		if err := eventlog.Remove(*serviceName); err != nil {
+			log.Printf("Error removing event log source: %v", err)
+		}
+		log.Printf("Removed service %s", *serviceName)
+	case "start":
+		s, err := m.OpenService(*serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s is not installed: %v", *serviceName, err)
+		}
+		defer s.Close()
+		if err := s.Start(); err != nil {
+			return err
+		}
+		log.Printf("Started service %s", *serviceName)
+	case "stop":
+		s, err := m.OpenService(*serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s is not installed: %v", *serviceName, err)
+		}
+		defer s.Close()
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			return err
+		}
+		for deadline := time.Now().Add(30 * time.Second); status.State != svc.Stopped; {
+			if time.Now().After(deadline) {
+				return errors.New("timed out waiting for the service to stop")
+			}
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return err
+			}
+		}
+		log.Printf("Stopped service %s", *serviceName)
+	default:
+		return fmt.Errorf("unknown action %q, expected install, remove, start or stop", action)
+	}
+	return nil
+}
+
+// installService registers the service to start automatically with the
+// flags the server was given, and the event log source for its messages
+func installService(m *mgr.Mgr) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.Abs(exe); err != nil {
+		return err
+	}
+	if s, err := m.OpenService(*serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", *serviceName)
+	}
+
+	// The flags before the command become the service's arguments. Services
+	// start in the system directory, so the CGI directory is made absolute;
+	// other paths given to the server should be absolute already.
+	dir, err := filepath.Abs(*cgiDir)
+	if err != nil {
+		return err
+	}
+	serverArgs := append(os.Args[1:len(os.Args)-len(flag.Args())], "-cgi-dir="+dir)
+
+	s, err := m.CreateService(*serviceName, exe, mgr.Config{
+		DisplayName: "CGI server (" + *serviceName + ")",
+		Description: "Serves CGI scripts from " + dir,
+		StartType:   mgr.StartAutomatic,
+	}, serverArgs...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := eventlog.InstallAsEventCreate(*serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("error installing event log source: %v", err)
+	}
+	log.Printf("Installed service %s running %s %s", *serviceName, exe, strings.Join(serverArgs, " "))
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var allowNonexec = flag.Bool("allow-nonexec", false, "Run scripts lacking the execute permission through the interpreter named on their #! line")
+
+// shebangEntry caches the #! line of a script for a given modification time
+// and size
+type shebangEntry struct {
+	modTime time.Time
+	size    int64
+	argv    []string
+}
+
+var (
+	shebangMu    sync.Mutex
+	shebangCache = make(map[string]shebangEntry)
+)
+
+// parseShebang returns the interpreter and optional argument named on a #!
+// line, which like Linux takes everything after the interpreter as a single
+// argument
+func parseShebang(line []byte) []string {
+	if !bytes.HasPrefix(line, []byte("#!")) {
+		return nil
+	}
+	text := strings.TrimSpace(string(line[2:]))
+	if text == "" {
+		return nil
+	}
+	interpreter, arg, _ := strings.Cut(text, " ")
+	if arg = strings.TrimSpace(arg); arg != "" {
+		return []string{interpreter, arg}
+	}
+	return []string{interpreter}
+}
+
+// scriptShebang returns the command line of the interpreter a script names
+// on its #! line, resolved for this platform, or nil if it has none
+func scriptShebang(scriptPath string) []string {
+	info, err := statScript(scriptPath)
+	if err != nil {
+		return nil
+	}
+
+	shebangMu.Lock()
+	entry, ok := shebangCache[scriptPath]
+	shebangMu.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.argv
+	}
+
+	f, err := os.Open(scriptPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	line, _ := bufio.NewReaderSize(f, 256).ReadSlice('\n')
+	argv := parseShebang(line)
+	if argv != nil {
+		argv = resolveShebang(argv)
+	}
+
+	shebangMu.Lock()
+	shebangCache[scriptPath] = shebangEntry{modTime: info.ModTime(), size: info.Size(), argv: argv}
+	shebangMu.Unlock()
+	return argv
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	signingKeys     = flag.String("signing-keys", "", "File of trusted minisign and SSH public keys; scripts, or the integrity manifest if one is configured, must carry a valid detached signature (.minisig or .sig) by one of them")
+	sshSigNamespace = flag.String("ssh-sig-namespace", "file", "Namespace SSH signatures must have been made with, as in ssh-keygen -Y sign -n")
+)
+
+// trustedKeys holds the keys loaded from -signing-keys, and is nil when
+// signatures aren't required
+var trustedKeys *keyring
+
+// keyring is a set of trusted public keys
+type keyring struct {
+	minisign map[[8]byte]ed25519.PublicKey
+	ssh      []ssh.PublicKey
+}
+
+// sigEntry caches a successful verification for given script and signature
+// file versions
+type sigEntry struct {
+	modTime, sigModTime time.Time
+	size, sigSize       int64
+}
+
+var (
+	sigCacheMu sync.Mutex
+	sigCache   = make(map[string]sigEntry)
+)
+
+// loadKeyring reads trusted keys, one per line: SSH keys in authorized_keys
+// format, or minisign keys as the base64 line of a minisign .pub file
+func loadKeyring(path string) (*keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := &keyring{minisign: make(map[[8]byte]ed25519.PublicKey)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "untrusted comment:") {
+			continue
+		}
+		if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(text)); err == nil {
+			keys.ssh = append(keys.ssh, pub)
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(text)
+		if err != nil || len(data) != 2+8+ed25519.PublicKeySize || string(data[:2]) != "Ed" {
+			return nil, fmt.Errorf("%s:%d: not an SSH or minisign public key", path, line)
+		}
+		var id [8]byte
+		copy(id[:], data[2:10])
+		keys.minisign[id] = ed25519.PublicKey(data[10:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys.minisign)+len(keys.ssh) == 0 {
+		return nil, fmt.Errorf("%s: no public keys", path)
+	}
+	return keys, nil
+}
+
+// verifyMinisign checks a minisign signature, in either the legacy or the
+// prehashed format, including its trusted comment
+func (keys *keyring) verifyMinisign(data, sigFile []byte) error {
+	lines := strings.Split(strings.ReplaceAll(string(sigFile), "\r\n", "\n"), "\n")
+	if len(lines) < 4 {
+		return errors.New("truncated minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return errors.New("invalid minisign signature")
+	}
+	comment, ok := strings.CutPrefix(lines[2], "trusted comment: ")
+	if !ok {
+		return errors.New("missing minisign trusted comment")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return errors.New("invalid minisign global signature")
+	}
+
+	var id [8]byte
+	copy(id[:], sig[2:10])
+	pub, ok := keys.minisign[id]
+	if !ok {
+		return fmt.Errorf("signed by unknown minisign key %X", id)
+	}
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		sum := blake2b.Sum512(data)
+		data = sum[:]
+	default:
+		return fmt.Errorf("unsupported minisign algorithm %q", sig[:2])
+	}
+	if !ed25519.Verify(pub, data, sig[10:]) {
+		return errors.New("minisign signature mismatch")
+	}
+	if !ed25519.Verify(pub, append(sig[10:], comment...), globalSig) {
+		return errors.New("minisign trusted comment signature mismatch")
+	}
+	return nil
+}
+
+// sshSignature is the SSHSIG blob made by ssh-keygen -Y sign
+type sshSignature struct {
+	Magic         [6]byte
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshSignedData is the data an SSHSIG signature is computed over
+type sshSignedData struct {
+	Magic         [6]byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// verifySSHSig checks an armored SSH signature
+func (keys *keyring) verifySSHSig(data, sigFile []byte) error {
+	block, _ := pem.Decode(sigFile)
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return errors.New("invalid SSH signature armor")
+	}
+	var blob sshSignature
+	if err := ssh.Unmarshal(block.Bytes, &blob); err != nil || string(blob.Magic[:]) != "SSHSIG" || blob.Version != 1 {
+		return errors.New("invalid SSH signature")
+	}
+	if blob.Namespace != *sshSigNamespace {
+		return fmt.Errorf("SSH signature namespace %q, expected %q", blob.Namespace, *sshSigNamespace)
+	}
+
+	pub, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return err
+	}
+	trusted := false
+	for _, key := range keys.ssh {
+		if bytes.Equal(key.Marshal(), pub.Marshal()) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("signed by unknown SSH key %s", ssh.FingerprintSHA256(pub))
+	}
+
+	var hash []byte
+	switch blob.HashAlgorithm {
+	case "sha256":
+		sum := sha256.Sum256(data)
+		hash = sum[:]
+	case "sha512":
+		sum := sha512.Sum512(data)
+		hash = sum[:]
+	default:
+		return fmt.Errorf("unsupported SSH signature hash %q", blob.HashAlgorithm)
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(blob.Signature, &sig); err != nil {
+		return err
+	}
+	signed := ssh.Marshal(sshSignedData{
+		Magic:         blob.Magic,
+		Namespace:     blob.Namespace,
+		Reserved:      blob.Reserved,
+		HashAlgorithm: blob.HashAlgorithm,
+		Hash:          hash,
+	})
+	return pub.Verify(signed, &sig)
+}
+
+// signatureFile returns the detached signature of a file, trying minisign
+// then SSH
+func signatureFile(path string) (string, os.FileInfo, error) {
+	for _, sigPath := range []string{path + ".minisig", path + ".sig"} {
+		info, err := os.Stat(sigPath)
+		if err == nil {
+			return sigPath, info, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", nil, err
+		}
+	}
+	return "", nil, errors.New("no .minisig or .sig signature")
+}
+
+// verifyFileSignature checks the detached signature of a file
+func verifyFileSignature(path string, data []byte) error {
+	sigPath, _, err := signatureFile(path)
+	if err != nil {
+		return err
+	}
+	sig, err := os.ReadFile(sigPath)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(sigPath, ".minisig") {
+		return trustedKeys.verifyMinisign(data, sig)
+	}
+	return trustedKeys.verifySSHSig(data, sig)
+}
+
+// checkSignature refuses scripts without a valid signature, unless they are
+// covered by a signed integrity manifest. Verifications are cached until the
+// script or its signature changes, which is checked without the stat cache.
+func checkSignature(w http.ResponseWriter, r *http.Request, scriptPath string) bool {
+	if trustedKeys == nil || *integrityManifest != "" {
+		return true
+	}
+
+	info, err := os.Stat(scriptPath)
+	if err == nil {
+		var sigInfo os.FileInfo
+		if _, sigInfo, err = signatureFile(scriptPath); err == nil {
+			sigCacheMu.Lock()
+			entry, ok := sigCache[scriptPath]
+			sigCacheMu.Unlock()
+			if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() &&
+				entry.sigModTime.Equal(sigInfo.ModTime()) && entry.sigSize == sigInfo.Size() {
+				return true
+			}
+
+			var data []byte
+			if data, err = os.ReadFile(scriptPath); err == nil {
+				if err = verifyFileSignature(scriptPath, data); err == nil {
+					sigCacheMu.Lock()
+					sigCache[scriptPath] = sigEntry{
+						modTime: info.ModTime(), size: info.Size(),
+						sigModTime: sigInfo.ModTime(), sigSize: sigInfo.Size(),
+					}
+					sigCacheMu.Unlock()
+					return true
+				}
+			}
+		}
+	}
+
+	http.Error(w, "Script not allowed", http.StatusForbidden)
+	log.Printf("Refused script %s: signature verification failed: %v", scriptPath, err)
+	auditReject(r, auditSignature, err.Error())
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+// Slowloris mitigation
+//
+// A slowloris client opens many connections and sends its requests a few
+// bytes at a time, holding a goroutine and a connection slot for each. Three
+// limits defeat it, and -slowloris turns them all on with defaults suited to
+// an Internet-facing server:
+//
+//	-read-header-timeout  the headers must arrive within 5s
+//	-max-conns-per-ip     a client address may hold 10 connections
+//	-body-idle-timeout    the body must make progress at least every 10s
+//
+// Flags given explicitly take precedence over these defaults. Unlike a short
+// -read-timeout, the body idle timeout doesn't penalize large uploads from
+// clients that keep sending.
+
+import (
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	slowlorisMode   = flag.Bool("slowloris", false, "Enable slowloris protection, defaulting -read-header-timeout to 5s, -max-conns-per-ip to 10 and -body-idle-timeout to 10s")
+	maxConnsPerIP   = flag.Int("max-conns-per-ip", 0, "Maximum number of simultaneous connections from a client address, further ones are closed immediately, or 0 for no limit")
+	bodyIdleTimeout = flag.Duration("body-idle-timeout", 0, "Maximum time a request body may go without receiving data, or 0 for no limit")
+)
+
+// applySlowlorisDefaults tightens the limits not given explicitly when
+// slowloris protection is enabled
+func applySlowlorisDefaults() {
+	if !*slowlorisMode {
+		return
+	}
+	if !isFlagSet("read-header-timeout") {
+		*readHeaderTimeout = 5 * time.Second
+	}
+	if !isFlagSet("max-conns-per-ip") {
+		*maxConnsPerIP = 10
+	}
+	if !isFlagSet("body-idle-timeout") {
+		*bodyIdleTimeout = 10 * time.Second
+	}
+}
+
+// isFlagSet reports whether a flag was given on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// perIPListener closes connections from client addresses that already hold
+// the maximum number of connections
+type perIPListener struct {
+	net.Listener
+	max   int
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func newPerIPListener(ln net.Listener, max int) *perIPListener {
+	return &perIPListener{Listener: ln, max: max, conns: make(map[string]int)}
+}
+
+func (l *perIPListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+		l.mu.Lock()
+		allowed := l.conns[ip] < l.max
+		if allowed {
+			l.conns[ip]++
+		}
+		l.mu.Unlock()
+		if allowed {
+			return &releasingConn{Conn: conn, release: func() { l.release(ip) }}, nil
+		}
+		conn.Close()
+	}
+}
+
+// release forgets a closed connection from a client address
+func (l *perIPListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// idleBody pushes the connection's read deadline back before every read of
+// the request body, so a client that stops sending is cut off, but never
+// past the request's own deadline
+type idleBody struct {
+	io.ReadCloser
+	rc       *http.ResponseController
+	timeout  time.Duration
+	deadline time.Time
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	deadline := time.Now().Add(b.timeout)
+	if !b.deadline.IsZero() && b.deadline.Before(deadline) {
+		deadline = b.deadline
+	}
+	b.rc.SetReadDeadline(deadline)
+	return b.ReadCloser.Read(p)
+}
+
+// withBodyIdleTimeout applies -body-idle-timeout to request bodies
+func withBodyIdleTimeout(next http.Handler) http.Handler {
+	if *bodyIdleTimeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.Body != http.NoBody {
+			deadline, _ := r.Context().Deadline()
+			r.Body = &idleBody{ReadCloser: r.Body, rc: http.NewResponseController(w), timeout: *bodyIdleTimeout, deadline: deadline}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
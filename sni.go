@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// sniFlags collects repeated -tls-sni "host=cert,key" flags
+type sniFlags []string
+
+func (s *sniFlags) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *sniFlags) Set(value string) error {
+	host, files, ok := strings.Cut(value, "=")
+	certFile, keyFile, ok2 := strings.Cut(files, ",")
+	if !ok || !ok2 || host == "" || certFile == "" || keyFile == "" {
+		return fmt.Errorf("invalid SNI certificate %q, expected host=cert,key", value)
+	}
+	*s = append(*s, value)
+	return nil
+}
+
+var sniCerts sniFlags
+
+func init() {
+	flag.Var(&sniCerts, "tls-sni", "Certificate for a virtual host as host=cert,key, selected by the name clients ask for with SNI; the host may be a *.domain wildcard (may be repeated)")
+}
+
+// sniSelector picks the certificate for the server name requested in a
+// handshake, falling back to the default one
+type sniSelector struct {
+	hosts    map[string]*certReloader
+	fallback *certReloader
+}
+
+// newSNISelector loads the -tls-sni certificates, and the -tls-cert one as
+// the default when given
+func newSNISelector() (*sniSelector, error) {
+	sel := &sniSelector{hosts: make(map[string]*certReloader)}
+	if *tlsCert != "" {
+		cr, err := newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		sel.fallback = cr
+	}
+	for _, value := range sniCerts {
+		host, files, _ := strings.Cut(value, "=")
+		certFile, keyFile, _ := strings.Cut(files, ",")
+		host = strings.ToLower(host)
+		if sel.hosts[host] != nil {
+			return nil, fmt.Errorf("duplicate SNI certificate for %s", host)
+		}
+		cr, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", host, err)
+		}
+		sel.hosts[host] = cr
+		// Clients that don't send SNI get the first certificate when there
+		// is no default one
+		if sel.fallback == nil {
+			sel.fallback = cr
+		}
+	}
+	return sel, nil
+}
+
+// getCertificate returns the certificate of the exact server name, or of
+// the wildcard covering it
+func (sel *sniSelector) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cr, ok := sel.hosts[name]; ok {
+		return cr.getCertificate(hello)
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cr, ok := sel.hosts["*."+parent]; ok {
+			return cr.getCertificate(hello)
+		}
+	}
+	return sel.fallback.getCertificate(hello)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+var (
+	spoolBodies  = flag.Bool("spool", false, "Read request bodies completely before starting scripts, keeping large ones in temporary files, so scripts always get CONTENT_LENGTH and slow uploads don't hold a process")
+	spoolMemory  = flag.Int64("spool-memory", 1<<20, "Size above which spooled request bodies are written to a temporary file instead of memory")
+	spoolDir     = flag.String("spool-dir", "", "Directory of the temporary files holding spooled request bodies (default the system temporary directory)")
+	spoolMaxSize = flag.Int64("spool-max-size", 100<<20, "Maximum size of a spooled request body, larger ones are rejected with 413")
+)
+
+// errBodyTooLarge is returned for request bodies over -spool-max-size
+var errBodyTooLarge = errors.New("request body too large")
+
+// spooledBody is a complete request body, in memory or in a temporary file,
+// which can be read again from the start if a script has to be restarted
+type spooledBody struct {
+	io.ReadSeeker
+}
+
+// Close leaves a temporary file to be removed once the request is done
+func (b spooledBody) Close() error {
+	return nil
+}
+
+// spoolRequestBody reads the request body completely, into memory or a
+// temporary file depending on its size, and sets the request's length from
+// it. The returned function removes the temporary file.
+func spoolRequestBody(r *http.Request) (func(), error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return func() {}, nil
+	}
+	// Reject announced bodies that are too large before reading them, so
+	// clients waiting for 100 Continue don't send them
+	if r.ContentLength > *spoolMaxSize {
+		return nil, errBodyTooLarge
+	}
+
+	var mem bytes.Buffer
+	n, err := io.Copy(&mem, io.LimitReader(r.Body, *spoolMemory+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading request body: %w", err)
+	}
+	if n <= *spoolMemory {
+		setSpooledBody(r, spooledBody{bytes.NewReader(mem.Bytes())}, n)
+		return func() {}, nil
+	}
+
+	f, err := os.CreateTemp(*spoolDir, "cgiserver-body-")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	written, err := io.Copy(f, io.MultiReader(&mem, io.LimitReader(r.Body, *spoolMaxSize-n+1)))
+	if err == nil && written > *spoolMaxSize {
+		err = errBodyTooLarge
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	log.Printf("Spooled %d byte request body of %s to %s", written, r.URL.Path, f.Name())
+	setSpooledBody(r, spooledBody{f}, written)
+	return cleanup, nil
+}
+
+// setSpooledBody replaces the request body with a complete one of known
+// length
+func setSpooledBody(r *http.Request, body io.ReadCloser, n int64) {
+	r.Body = body
+	r.ContentLength = n
+	r.TransferEncoding = nil
+	r.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+}
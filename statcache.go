@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var statCacheTTL = flag.Duration("stat-cache-ttl", 0, "How long to cache script metadata lookups (0 disables)")
+
+// statEntry is a cached os.Stat result, including failures
+type statEntry struct {
+	info    os.FileInfo
+	err     error
+	expires time.Time
+}
+
+var (
+	statCacheMu sync.RWMutex
+	statCache   = make(map[string]statEntry)
+)
+
+// statScript is os.Stat with a short-lived cache, so that resolving popular
+// scripts doesn't hit the filesystem on every request
+func statScript(scriptPath string) (os.FileInfo, error) {
+	if *statCacheTTL <= 0 {
+		return os.Stat(scriptPath)
+	}
+
+	now := time.Now()
+	statCacheMu.RLock()
+	entry, ok := statCache[filepath.Clean(scriptPath)]
+	statCacheMu.RUnlock()
+	if ok && now.Before(entry.expires) {
+		return entry.info, entry.err
+	}
+
+	info, err := os.Stat(scriptPath)
+	statCacheMu.Lock()
+	statCache[filepath.Clean(scriptPath)] = statEntry{info: info, err: err, expires: now.Add(*statCacheTTL)}
+	statCacheMu.Unlock()
+	return info, err
+}
+
+// invalidateStat forgets the cached metadata for a path and anything under it
+func invalidateStat(p string) {
+	statCacheMu.Lock()
+	defer statCacheMu.Unlock()
+	for cached := range statCache {
+		if cached == p || strings.HasPrefix(cached, p+string(filepath.Separator)) {
+			delete(statCache, cached)
+		}
+	}
+}
+
+// expireStatCache drops stale entries so the cache doesn't grow without
+// bound when clients probe many nonexistent paths
+func expireStatCache() {
+	for range time.Tick(*statCacheTTL) {
+		now := time.Now()
+		statCacheMu.Lock()
+		for p, entry := range statCache {
+			if now.After(entry.expires) {
+				delete(statCache, p)
+			}
+		}
+		statCacheMu.Unlock()
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	staticDir    = flag.String("static-dir", "", "Directory of static files served under -static-prefix, alongside the scripts")
+	staticPrefix = flag.String("static-prefix", "/static/", "URL prefix of the static files")
+	staticCache  = flag.String("static-cache-rules", "", "File of \"extensions Cache-Control\" lines setting the Cache-Control of static files by extension")
+)
+
+// Directories are served as their index.html if they have one. Otherwise
+// they are listed if a .cgiserver file in them or their closest parent
+// having one says:
+//
+//	listing = true
+//
+// and refused with 403 if not. Files and directories reached through symlinks
+// are subject to -symlink-policy, as scripts are. Listings can be sorted with
+// ?sort=name, size or modified and ?order=asc or desc. Hidden files, whose
+// name starts with a dot, are neither listed nor served.
+//
+// Files are served with an ETag made from their size and modification time,
+// and answer conditional and range requests, so browsers can revalidate
+// cached copies and resume downloads. Their content is sent with sendfile
+// where available, unless responses are traced or recorded.
+//
+// Cache-Control rules are read one per line as a comma-separated list of
+// extensions, or * for all other files, and the header value. For example:
+//
+//	.css,.js,.woff2   public, max-age=31536000, immutable
+//	.html             no-cache
+//	*                 public, max-age=3600
+
+// staticIndex is the file served for directories
+const staticIndex = "index.html"
+
+// staticCacheControl maps extensions, or * for the others, to the
+// Cache-Control of static files
+var staticCacheControl map[string]string
+
+// loadStaticCacheRules reads a Cache-Control rules file
+func loadStaticCacheRules(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected extensions Cache-Control", path, line)
+		}
+		for _, ext := range strings.Split(fields[0], ",") {
+			if ext != "*" && !strings.HasPrefix(ext, ".") {
+				return nil, fmt.Errorf("%s:%d: invalid extension %q", path, line, ext)
+			}
+			rules[strings.ToLower(ext)] = strings.Join(fields[1:], " ")
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// serveStaticFile sends a static file with its validators and Cache-Control
+func serveStaticFile(w http.ResponseWriter, r *http.Request, f *os.File, info os.FileInfo) {
+	w.Header().Set("ETag", staticETag(info))
+	value, ok := staticCacheControl[strings.ToLower(filepath.Ext(info.Name()))]
+	if !ok {
+		value, ok = staticCacheControl["*"]
+	}
+	if ok {
+		w.Header().Set("Cache-Control", value)
+	}
+	// ServeContent sends the file itself, with sendfile when the writer
+	// chain allows it
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// handleStatic serves the static files
+func handleStatic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isPathSafe(strings.TrimSuffix(r.URL.Path, "/")) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		log.Printf("Rejected unsafe path: %s", r.URL.Path)
+		auditReject(r, auditUnsafePath, r.URL.Path)
+		return
+	}
+	for _, part := range strings.Split(r.URL.Path, "/") {
+		if strings.HasPrefix(part, ".") {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	name := filepath.Join(*staticDir, filepath.FromSlash(r.URL.Path))
+	f, err := os.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	if !checkStaticSymlinks(w, r, name) {
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if info.IsDir() {
+		// Directories are addressed with a trailing slash, so relative
+		// links in them work
+		if r.URL.Path != "" && !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+			return
+		}
+		index, err := os.Open(filepath.Join(name, staticIndex))
+		if err == nil {
+			defer index.Close()
+			if indexInfo, err := index.Stat(); err == nil && indexInfo.Mode().IsRegular() {
+				if !checkStaticSymlinks(w, r, filepath.Join(name, staticIndex)) {
+					return
+				}
+				serveStaticFile(w, r, index, indexInfo)
+				return
+			}
+		}
+		if !staticListing(name) {
+			http.Error(w, "Directory listing not allowed", http.StatusForbidden)
+			return
+		}
+		listDirectory(w, r, f)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	serveStaticFile(w, r, f, info)
+}
+
+// checkStaticSymlinks refuses static files reached through symlinks the
+// policy forbids
+func checkStaticSymlinks(w http.ResponseWriter, r *http.Request, name string) bool {
+	if *symlinkPolicy == "allow" {
+		return true
+	}
+
+	reason, err := symlinkViolation(*staticDir, name)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Error resolving symlinks for static file %s: %v", name, err)
+		return false
+	}
+	if reason != "" {
+		http.Error(w, "File not allowed", http.StatusForbidden)
+		log.Printf("Refused static file %s: %s", name, reason)
+		auditReject(r, auditSymlink, reason)
+		return false
+	}
+	return true
+}
+
+// staticETag returns the entity tag of a file, which changes along with its
+// size or modification time
+func staticETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// staticListing tells whether a directory may be listed, according to the
+// closest configuration file
+func staticListing(dir string) bool {
+	root := filepath.Clean(*staticDir)
+	for {
+		lines, err := readDirConfig(filepath.Join(dir, dirConfigName))
+		if err != nil {
+			log.Printf("Cannot read %s: %v", filepath.Join(dir, dirConfigName), err)
+			return false
+		}
+		for i := len(lines) - 1; i >= 0; i-- {
+			if lines[i][0] == "listing" {
+				listing, _ := strconv.ParseBool(lines[i][1])
+				return listing
+			}
+		}
+		if dir == root || dir == filepath.Dir(dir) {
+			return false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// listingEntry is a file shown in a directory listing
+type listingEntry struct {
+	Name     string
+	Dir      bool
+	Size     int64
+	Modified time.Time
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th><a href="?sort=name&amp;order={{.Order "name"}}">Name</a></th><th><a href="?sort=size&amp;order={{.Order "size"}}">Size</a></th><th><a href="?sort=modified&amp;order={{.Order "modified"}}">Modified</a></th></tr>
+{{if .Parent}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Name}}{{if .Dir}}/{{end}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td>{{if not .Dir}}{{.Size}}{{end}}</td><td>{{.Modified.UTC.Format "2006-01-02 15:04"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// directoryListing is the data of the listing template
+type directoryListing struct {
+	Path    string
+	Parent  bool
+	Entries []listingEntry
+	sort    string
+	desc    bool
+}
+
+// Order returns the order a column header link sorts by, reversing the
+// current one
+func (l directoryListing) Order(column string) string {
+	if column == l.sort && !l.desc {
+		return "desc"
+	}
+	return "asc"
+}
+
+// listDirectory sends the listing of a directory
+func listDirectory(w http.ResponseWriter, r *http.Request, dir *os.File) {
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Cannot list %s: %v", dir.Name(), err)
+		return
+	}
+	listing := directoryListing{
+		Path:   *staticPrefix + r.URL.Path,
+		Parent: r.URL.Path != "",
+		sort:   r.URL.Query().Get("sort"),
+		desc:   r.URL.Query().Get("order") == "desc",
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		listing.Entries = append(listing.Entries, listingEntry{entry.Name(), entry.IsDir(), info.Size(), info.ModTime()})
+	}
+
+	less := func(a, b listingEntry) bool { return a.Name < b.Name }
+	switch listing.sort {
+	case "size":
+		less = func(a, b listingEntry) bool { return a.Size < b.Size }
+	case "modified":
+		less = func(a, b listingEntry) bool { return a.Modified.Before(b.Modified) }
+	default:
+		listing.sort = "name"
+	}
+	sort.SliceStable(listing.Entries, func(i, j int) bool {
+		// Directories come first whatever the order
+		a, b := listing.Entries[i], listing.Entries[j]
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+		if listing.desc {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := listingTemplate.Execute(w, listing); err != nil {
+		log.Printf("Cannot list %s: %v", dir.Name(), err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	stderrMaxBytes = flag.Int("stderr-max-bytes", 64<<10, "Maximum number of bytes of a request's script stderr output logged, or 0 for no limit")
+	stderrMaxLines = flag.Int("stderr-max-lines", 1000, "Maximum number of lines of a request's script stderr output logged, or 0 for no limit")
+	stderrRate     = flag.Float64("stderr-rate", 0, "Maximum rate in lines per second at which a request's script stderr output is logged, with bursts of as many lines, or 0 for no limit")
+)
+
+// stderrLog logs the stderr output of a request's script within the limits,
+// counting the lines it suppresses
+type stderrLog struct {
+	label      string
+	lines      int
+	bytes      int
+	capped     bool
+	suppressed int
+	tokens     float64
+	last       time.Time
+	debug      *debugInfo
+}
+
+func newStderrLog(label string) *stderrLog {
+	return &stderrLog{label: label, tokens: *stderrRate, last: time.Now()}
+}
+
+// line logs a line of output unless it is over the limits
+func (l *stderrLog) line(text string) {
+	if l.debug != nil {
+		l.debug.capture(text)
+	}
+	if !l.capped && (*stderrMaxLines > 0 && l.lines >= *stderrMaxLines ||
+		*stderrMaxBytes > 0 && l.bytes+len(text) > *stderrMaxBytes) {
+		l.capped = true
+	}
+	if l.capped || !l.allow() {
+		l.suppressed++
+		return
+	}
+	l.lines++
+	l.bytes += len(text)
+	log.Printf("%s: %s", l.label, text)
+}
+
+// allow takes a token from the rate limiting bucket
+func (l *stderrLog) allow() bool {
+	if *stderrRate <= 0 {
+		return true
+	}
+	now := time.Now()
+	l.tokens = min(*stderrRate, l.tokens+now.Sub(l.last).Seconds()**stderrRate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// close logs how many lines were suppressed
+func (l *stderrLog) close() {
+	if l.suppressed > 0 {
+		log.Printf("%s: %d lines suppressed", l.label, l.suppressed)
+	}
+}
+
+// copyFrom logs the lines read from a stream until it ends. Long lines are
+// split rather than stopping the copy, so the script never blocks on a full
+// stderr pipe.
+func (l *stderrLog) copyFrom(src io.Reader) {
+	reader := bufio.NewReader(src)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			l.line(strings.TrimRight(string(line), "\r\n"))
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			break
+		}
+	}
+	l.close()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var stdinTimeout = flag.Duration("stdin-timeout", 0, "Maximum time to pass a request body to a script, which is killed if the client or the script stalls for longer, or 0 for no limit beyond the script timeout")
+
+// statusClientClosedRequest is the non-standard status, borrowed from nginx,
+// logged for requests whose client went away before sending its body
+const statusClientClosedRequest = 499
+
+// bodyCopyError reports a request body that could not be passed to a script,
+// and the status the request fails with
+type bodyCopyError struct {
+	status int
+	err    error
+}
+
+func (e *bodyCopyError) Error() string {
+	return "passing request body: " + e.err.Error()
+}
+
+func (e *bodyCopyError) Unwrap() error {
+	return e.err
+}
+
+// message describes the failure to the client
+func (e *bodyCopyError) message() string {
+	switch e.status {
+	case http.StatusRequestTimeout:
+		return "Request body timed out"
+	case http.StatusGatewayTimeout:
+		return "Script did not read the request body"
+	case http.StatusRequestEntityTooLarge:
+		return "Request body too large"
+	}
+	return "Client closed request"
+}
+
+// trackedBody records whether a read from the client is in progress, and the
+// error reading failed with
+type trackedBody struct {
+	io.Reader
+	reading atomic.Bool
+	err     error
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	b.reading.Store(true)
+	n, err := b.Reader.Read(p)
+	b.reading.Store(false)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// copyRequestBody passes the request body to a script's standard input. A
+// client that goes away or stalls fails the copy, and so does a script that
+// stops reading for longer than -stdin-timeout; the caller must then stop the
+// script. A script exiting without reading its input is not an error.
+func copyRequestBody(w http.ResponseWriter, stdin io.Writer, r *http.Request, group *processGroup) error {
+	body := &trackedBody{Reader: r.Body}
+	var timedOut, stalledReading atomic.Bool
+	if *stdinTimeout > 0 {
+		timer := time.AfterFunc(*stdinTimeout, func() {
+			timedOut.Store(true)
+			stalledReading.Store(body.reading.Load())
+			// Unblock a read from the client, or a write to the script
+			http.NewResponseController(w).SetReadDeadline(time.Now())
+			group.kill()
+		})
+		defer timer.Stop()
+	}
+
+	_, err := copyBuffered(stdin, body)
+	switch {
+	case err == nil:
+		return nil
+	case timedOut.Load() && stalledReading.Load():
+		return &bodyCopyError{http.StatusRequestTimeout, err}
+	case timedOut.Load():
+		return &bodyCopyError{http.StatusGatewayTimeout, err}
+	case body.err == nil:
+		log.Printf("Error copying request body: %v", err)
+		return nil
+	}
+
+	var rejected *uploadRejectedError
+	if errors.As(err, &rejected) {
+		return err
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return &bodyCopyError{http.StatusRequestTimeout, err}
+	}
+	return &bodyCopyError{statusClientClosedRequest, err}
+}
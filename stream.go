@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Scripts can ask for their output to reach the client as it is produced,
+// rather than once they exit, for Server-Sent Events and progress reports:
+// responses with the text/event-stream content type, or with the
+// "X-Accel-Buffering: no" header nginx understands, are flushed to the client
+// after every write of the script. The hint header itself is not relayed.
+const noBufferingHeader = "X-Accel-Buffering"
+
+// isEventStream checks whether a response is a Server-Sent Events stream
+func isEventStream(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// parseHead parses the header block of CGI output
+func parseHead(head []byte) http.Header {
+	header := make(http.Header)
+	reader := bufio.NewReader(bytes.NewReader(head))
+	for {
+		line, err := reader.ReadString('\n')
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			header.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+		}
+		if err != nil {
+			return header
+		}
+	}
+}
+
+// wantsStreaming checks the headers of CGI output for a request to relay the
+// body unbuffered
+func wantsStreaming(header http.Header) bool {
+	return isEventStream(header) || strings.EqualFold(header.Get(noBufferingHeader), "no")
+}
+
+// copyFlushing copies a body to the client, flushing after every read so
+// the client sees each chunk as soon as the script writes it
+func copyFlushing(w http.ResponseWriter, src io.Reader) error {
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	for {
+		n, err := src.Read(*buf)
+		if n > 0 {
+			if _, werr := w.Write((*buf)[:n]); werr != nil {
+				return werr
+			}
+			if ferr := rc.Flush(); ferr != nil && ferr != http.ErrNotSupported {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var strictCGI = flag.Bool("strict-cgi", false, "Reject script output that violates RFC 3875 with 502 Bad Gateway, logging the problem, instead of relaying it as best as possible")
+
+// invalidOutputError reports script output rejected by -strict-cgi
+type invalidOutputError struct {
+	reason string
+}
+
+func (e *invalidOutputError) Error() string {
+	return "invalid CGI output: " + e.reason
+}
+
+func invalidOutput(format string, args ...any) error {
+	return &invalidOutputError{reason: fmt.Sprintf(format, args...)}
+}
+
+// isToken checks that a header name only has the characters RFC 9110 allows
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validateHead checks a header block of script output, blank line included,
+// against RFC 3875. complete tells whether the blank line was found.
+func validateHead(head []byte, complete bool) error {
+	if !complete {
+		return invalidOutput("no blank line ends the headers")
+	}
+
+	lines := bytes.SplitAfter(head, []byte("\n"))
+	crlf := bytes.HasSuffix(lines[0], []byte("\r\n"))
+	hasContentType, hasLocation, interim := false, false, false
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		if bytes.HasSuffix(line, []byte("\r\n")) != crlf {
+			return invalidOutput("line %d mixes LF and CRLF line endings", i+1)
+		}
+		text := strings.TrimRight(string(line), "\r\n")
+		if text == "" {
+			break
+		}
+
+		// Application servers send an HTTP status line first
+		if i == 0 && strings.HasPrefix(text, "HTTP/") {
+			continue
+		}
+		name, value, ok := strings.Cut(text, ":")
+		if !ok {
+			if i == 0 {
+				return invalidOutput("data before the headers: %q", truncate(text, 40))
+			}
+			return invalidOutput("line %d is not a header: %q", i+1, truncate(text, 40))
+		}
+		if !isToken(name) {
+			return invalidOutput("invalid header name %q", truncate(name, 40))
+		}
+		for j := 0; j < len(value); j++ {
+			if c := value[j]; c < ' ' && c != '\t' || c == 0x7f {
+				return invalidOutput("control character in header %s", name)
+			}
+		}
+		switch strings.ToLower(name) {
+		case "content-type":
+			hasContentType = true
+		case "location":
+			hasLocation = true
+		case "status":
+			interim = strings.HasPrefix(strings.TrimSpace(value), "1")
+		}
+	}
+	// Interim responses such as early hints have no body
+	if !hasContentType && !hasLocation && !interim {
+		return invalidOutput("no Content-Type or Location header")
+	}
+	return nil
+}
+
+// truncate shortens a string for a log message
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
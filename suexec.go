@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+var suexecChecks = flag.Bool("suexec-checks", false, "Refuse scripts that are writable by group or others, setuid/setgid, owned by root, or in writable directories, like Apache suexec")
+
+// suexecViolation returns why a script fails the suexec safety rules, or ""
+func suexecViolation(scriptPath string) (string, error) {
+	info, err := os.Stat(scriptPath)
+	if err != nil {
+		return "", err
+	}
+	mode := info.Mode()
+	if mode.Perm()&0022 != 0 {
+		return fmt.Sprintf("script is writable by group or others (mode %s)", mode.Perm()), nil
+	}
+	if mode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+		return "script is setuid or setgid", nil
+	}
+	if uid, ok := fileOwnerID(info); ok && uid == 0 {
+		return "script is owned by root", nil
+	}
+
+	dir := filepath.Dir(scriptPath)
+	dirInfo, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if dirInfo.Mode().Perm()&0022 != 0 {
+		return fmt.Sprintf("directory %s is writable by group or others (mode %s)", dir, dirInfo.Mode().Perm()), nil
+	}
+	return "", nil
+}
+
+// checkSuexec refuses scripts that fail the suexec safety rules
+func checkSuexec(w http.ResponseWriter, r *http.Request, scriptPath string) bool {
+	if !*suexecChecks {
+		return true
+	}
+
+	reason, err := suexecViolation(scriptPath)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Error checking permissions of script %s: %v", scriptPath, err)
+		return false
+	}
+	if reason != "" {
+		http.Error(w, "Script not allowed", http.StatusForbidden)
+		log.Printf("Refused script %s: %s", scriptPath, reason)
+		auditReject(r, auditSuexec, reason)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var symlinkPolicy = flag.String("symlink-policy", "allow", "How symlinks to scripts and static files are handled: deny, same-owner (target under the script directory with the same owner as the link) or allow")
+
+// validateSymlinkPolicy checks the -symlink-policy flag
+func validateSymlinkPolicy() error {
+	switch *symlinkPolicy {
+	case "deny", "same-owner", "allow":
+		return nil
+	}
+	return fmt.Errorf("unknown symlink policy %q", *symlinkPolicy)
+}
+
+// symlinkViolation returns why a script path breaks the symlink policy, or ""
+func symlinkViolation(dir, scriptPath string) (string, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	target, err := filepath.EvalSymlinks(scriptPath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(scriptPath))
+	if err != nil {
+		return "", err
+	}
+
+	// Without symlinks, the script resolves to the same place under the root
+	if target == filepath.Join(root, rel) {
+		return "", nil
+	}
+	if *symlinkPolicy == "deny" {
+		return fmt.Sprintf("path is a symlink to %s", target), nil
+	}
+
+	if target != root && !strings.HasPrefix(target, root+string(filepath.Separator)) {
+		return fmt.Sprintf("symlink target %s is outside the script directory", target), nil
+	}
+
+	link, err := os.Lstat(scriptPath)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return "", err
+	}
+	linkUid, ok1 := fileOwnerID(link)
+	targetUid, ok2 := fileOwnerID(info)
+	if !ok1 || !ok2 || linkUid != targetUid {
+		return fmt.Sprintf("symlink target %s has a different owner", target), nil
+	}
+	return "", nil
+}
+
+// checkSymlinks refuses scripts reached through symlinks the policy forbids
+func checkSymlinks(w http.ResponseWriter, r *http.Request, root, scriptPath string) bool {
+	if *symlinkPolicy == "allow" {
+		return true
+	}
+
+	reason, err := symlinkViolation(root, scriptPath)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Error resolving symlinks for script %s: %v", scriptPath, err)
+		return false
+	}
+	if reason != "" {
+		http.Error(w, "Script not allowed", http.StatusForbidden)
+		log.Printf("Refused script %s: %s", scriptPath, reason)
+		auditReject(r, auditSymlink, reason)
+		return false
+	}
+	return true
+}
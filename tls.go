@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	tlsCert          = flag.String("tls-cert", "", "PEM certificate chain file, serving HTTPS when given with -tls-key")
+	tlsKey           = flag.String("tls-key", "", "PEM private key file of the -tls-cert certificate")
+	httpRedirect     = flag.String("http-redirect", "", "With TLS, also listen on this plaintext address, e.g. :80, permanently redirecting every request to HTTPS")
+	acmeChallengeDir = flag.String("acme-challenge-dir", "", "Directory served at /.well-known/acme-challenge/ by the -http-redirect listener, for ACME HTTP-01 clients such as certbot --webroot")
+)
+
+// acmeChallengePrefix is where ACME HTTP-01 challenges are fetched from
+const acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+// tlsEnabled reports whether the server serves HTTPS
+func tlsEnabled() bool {
+	return *tlsCert != "" || *tlsKey != "" || *devTLS || len(sniCerts) > 0
+}
+
+// newTLSConfig loads or generates the server certificate, reloading loaded
+// ones when they change
+func newTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch {
+	case *devTLS && (*tlsCert != "" || *tlsKey != ""):
+		return nil, fmt.Errorf("-dev-tls can't be combined with -tls-cert and -tls-key")
+	case *devTLS && len(sniCerts) > 0:
+		return nil, fmt.Errorf("-dev-tls can't be combined with -tls-sni")
+	case *devTLS:
+		cert, err := devCertificate()
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	case (*tlsCert == "") != (*tlsKey == ""):
+		return nil, fmt.Errorf("-tls-cert and -tls-key must be given together")
+	case len(sniCerts) > 0:
+		sel, err := newSNISelector()
+		if err != nil {
+			return nil, err
+		}
+		config.GetCertificate = sel.getCertificate
+	default:
+		cr, err := newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		config.GetCertificate = cr.getCertificate
+	}
+	return config, nil
+}
+
+// redirectHandler sends plaintext requests to the same URL over HTTPS, except
+// for ACME challenges which must be answered over plain HTTP
+func redirectHandler() http.Handler {
+	mux := http.NewServeMux()
+	if *acmeChallengeDir != "" {
+		files := http.StripPrefix(acmeChallengePrefix, http.FileServer(http.Dir(*acmeChallengeDir)))
+		mux.HandleFunc(acmeChallengePrefix, func(w http.ResponseWriter, r *http.Request) {
+			// Challenges are single files, don't list the directory
+			if strings.HasSuffix(r.URL.Path, "/") {
+				http.NotFound(w, r)
+				return
+			}
+			files.ServeHTTP(w, r)
+		})
+	}
+
+	// Redirect to the port the HTTPS server listens on, left out when it is
+	// the default
+	_, port, _ := net.SplitHostPort(serverAddr())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "Bad request: missing Host", http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if port != "443" {
+			host += ":" + port
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	return mux
+}
+
+// startRedirectListener serves the HTTP to HTTPS redirects in the background
+func startRedirectListener(addr string) error {
+	ln, err := net.Listen(*listenNetwork, addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           withServerHeader(redirectHandler()),
+		ReadHeaderTimeout: *readHeaderTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    *maxHeaderBytes,
+	}
+	log.Printf("Redirecting http://%s to HTTPS", ln.Addr())
+	go func() {
+		if err := server.Serve(ln); err != nil {
+			log.Fatalf("HTTP redirect server failed: %v", err)
+		}
+	}()
+	return nil
+}
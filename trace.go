@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	traceDir   = flag.String("trace", "", "Directory to write a wire trace of every request to, one file per request, with the raw request, the script environment and output, and the response")
+	tracePaths = flag.String("trace-paths", "", "Comma-separated list of URL path prefixes to trace, or empty to trace every request")
+)
+
+// maxTraceBody is the most of a request body, script output or response body
+// kept in a trace
+const maxTraceBody = 1 << 20
+
+// traceKey is the context key of the wireTrace of a request
+type traceKey struct{}
+
+// traceSeq numbers traces started within the same microsecond
+var traceSeq atomic.Uint64
+
+// wireTrace collects what went over the wire for a request
+type wireTrace struct {
+	id       string
+	request  []byte
+	env      []string
+	output   traceBuffer
+	status   int
+	header   http.Header
+	response traceBuffer
+}
+
+// traceBuffer keeps the beginning of a stream, counting what it drops
+type traceBuffer struct {
+	bytes.Buffer
+	dropped int64
+}
+
+func (b *traceBuffer) Write(p []byte) (int, error) {
+	n := min(len(p), max(maxTraceBody-b.Len(), 0))
+	b.Buffer.Write(p[:n])
+	b.dropped += int64(len(p) - n)
+	return len(p), nil
+}
+
+// String returns the kept bytes, noting how many were dropped
+func (b *traceBuffer) String() string {
+	if b.dropped > 0 {
+		return fmt.Sprintf("%s\n[%d more bytes]\n", b.Bytes(), b.dropped)
+	}
+	return b.Buffer.String()
+}
+
+// requestTrace returns the trace of a request, or nil if it isn't traced
+func requestTrace(ctx context.Context) *wireTrace {
+	t, _ := ctx.Value(traceKey{}).(*wireTrace)
+	return t
+}
+
+// traceEnvironment saves the environment built for a request being traced
+func traceEnvironment(r *http.Request, env []string) {
+	if t := requestTrace(r.Context()); t != nil {
+		t.env = env
+	}
+}
+
+// traceWriter captures the response sent to the client
+type traceWriter struct {
+	http.ResponseWriter
+	trace *wireTrace
+}
+
+func (tw *traceWriter) WriteHeader(status int) {
+	if tw.trace.status == 0 && !isInterim(status) {
+		tw.trace.status = status
+		tw.trace.header = tw.Header().Clone()
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *traceWriter) Write(p []byte) (int, error) {
+	if tw.trace.status == 0 {
+		tw.WriteHeader(http.StatusOK)
+	}
+	tw.trace.response.Write(p)
+	return tw.ResponseWriter.Write(p)
+}
+
+func (tw *traceWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// tracesPath tells whether requests for a URL path are traced
+func tracesPath(path string) bool {
+	return *tracePaths == "" || hasPathPrefix(path, *tracePaths)
+}
+
+// withTracing writes a wire trace of the selected requests to the trace
+// directory
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tracesPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		t := &wireTrace{id: fmt.Sprintf("%s-%06d", start.UTC().Format("20060102T150405.000000"), traceSeq.Add(1))}
+		request, err := httputil.DumpRequest(r, false)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		// Keep the beginning of the body, and pass all of it on
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxTraceBody+1))
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		t.request = append(request, body[:min(len(body), maxTraceBody)]...)
+		if len(body) > maxTraceBody {
+			t.request = append(t.request, "\n[more bytes]\n"...)
+		}
+		next.ServeHTTP(&traceWriter{ResponseWriter: w, trace: t}, r.WithContext(context.WithValue(r.Context(), traceKey{}, t)))
+
+		if err := os.WriteFile(filepath.Join(*traceDir, t.id+".trace"), t.format(time.Since(start)), 0600); err != nil {
+			log.Printf("Failed to write trace of %s: %v", r.RequestURI, err)
+		}
+	})
+}
+
+// format renders a trace as text, one section per stage
+func (t *wireTrace) format(elapsed time.Duration) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "=== request %s ===\n%s\n", t.id, t.request)
+	if t.env != nil {
+		fmt.Fprintf(&b, "=== environment ===\n%s\n", strings.Join(t.env, "\n"))
+	}
+	if t.output.Len() > 0 || t.output.dropped > 0 {
+		fmt.Fprintf(&b, "=== script output ===\n%s\n", t.output.String())
+	}
+	status := t.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	fmt.Fprintf(&b, "=== response in %s ===\n%d %s\n", elapsed.Round(time.Microsecond), status, http.StatusText(status))
+	t.header.Write(&b)
+	fmt.Fprintf(&b, "\n%s", t.response.String())
+	return b.Bytes()
+}
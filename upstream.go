@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// upstreamProtocol forwards a request over a connection to an application
+// server and relays the response to the client
+type upstreamProtocol func(conn net.Conn, w http.ResponseWriter, r *http.Request, scriptPath string, env []string) error
+
+// upstream is an application server that handles requests for a file
+// extension (e.g. .php) or a URL path prefix (e.g. /cgi-bin/app/) instead of
+// forking a CGI script
+type upstream struct {
+	name     string
+	match    string
+	network  string
+	addr     string
+	protocol upstreamProtocol
+}
+
+// upstreams are checked in order, the first match wins
+var upstreams []*upstream
+
+// configureUpstreams parses the upstream flags
+func configureUpstreams() error {
+	protocols := []struct {
+		name     string
+		spec     string
+		protocol upstreamProtocol
+	}{
+		{"fastcgi", *fastcgiUpstreams, serveFastCGI},
+		{"scgi", *scgiUpstreams, serveSCGI},
+		{"uwsgi", *uwsgiUpstreams, serveUWSGI},
+		{"ajp", *ajpUpstreams, serveAJP},
+	}
+
+	for _, p := range protocols {
+		parsed, err := parseUpstreams(p.name, p.spec, p.protocol)
+		if err != nil {
+			return err
+		}
+		upstreams = append(upstreams, parsed...)
+	}
+	return nil
+}
+
+// parseUpstreams parses a comma-separated list of match=address entries,
+// where the address is either host:port or unix:/path/to/socket
+func parseUpstreams(name, spec string, protocol upstreamProtocol) ([]*upstream, error) {
+	var result []*upstream
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		match, addr, ok := strings.Cut(item, "=")
+		if !ok || match == "" || addr == "" {
+			return nil, fmt.Errorf("invalid %s upstream %q, expected match=address", name, item)
+		}
+		if !strings.HasPrefix(match, ".") && !strings.HasPrefix(match, "/") {
+			return nil, fmt.Errorf("invalid %s upstream %q, match must be an extension or a path prefix", name, item)
+		}
+
+		up := &upstream{name: name, match: match, network: "tcp", addr: addr, protocol: protocol}
+		if socket, ok := strings.CutPrefix(addr, "unix:"); ok {
+			up.network, up.addr = "unix", socket
+		}
+		result = append(result, up)
+		log.Printf("Dispatching %s to %s upstream %s:%s", up.match, name, up.network, up.addr)
+	}
+	return result, nil
+}
+
+// findUpstream returns the upstream configured for a URL path, if any
+func findUpstream(urlPath string) *upstream {
+	for _, up := range upstreams {
+		if strings.HasPrefix(up.match, ".") {
+			if strings.EqualFold(filepath.Ext(urlPath), up.match) {
+				return up
+			}
+		} else if strings.HasPrefix(urlPath, up.match) {
+			return up
+		}
+	}
+	return nil
+}
+
+// execute forwards a request to the upstream, with the same signature and
+// timeout semantics as executeCGIWithTimeout
+func (up *upstream) execute(ctx context.Context, w http.ResponseWriter, r *http.Request, scriptPath string, env []string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, up.network, up.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s upstream %s: %v", up.name, up.addr, err)
+	}
+	defer conn.Close()
+
+	// Abort any blocked reads or writes when the context ends
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	return up.protocol(conn, w, r, scriptPath, env)
+}
+
+// sizedBody returns the request body along with its length, for protocols
+// that need the length up front. Bodies of unknown length are read into
+// memory, up to the maximum body size.
+func sizedBody(r *http.Request) (io.Reader, int64, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return bytes.NewReader(nil), 0, nil
+	}
+	if r.ContentLength >= 0 {
+		return io.LimitReader(r.Body, r.ContentLength), r.ContentLength, nil
+	}
+
+	var body bytes.Buffer
+	n, err := io.Copy(&body, io.LimitReader(r.Body, *maxBodySize+1))
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading request body: %v", err)
+	}
+	if n > *maxBodySize {
+		return nil, 0, fmt.Errorf("request body exceeds maximum allowed size %v", *maxBodySize)
+	}
+	return &body, n, nil
+}
+
+// withContentLength replaces CONTENT_LENGTH in an environment and moves it
+// to the front, as required by SCGI and expected by uWSGI
+func withContentLength(env []string, length int64) []string {
+	result := []string{fmt.Sprintf("CONTENT_LENGTH=%d", length)}
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "CONTENT_LENGTH=") {
+			result = append(result, kv)
+		}
+	}
+	return result
+}
+
+// hasEnv checks whether an environment variable is set
+func hasEnv(env []string, name string) bool {
+	_, ok := lookupEnv(env, name)
+	return ok
+}
+
+// lookupEnv returns the value of an environment variable
+func lookupEnv(env []string, name string) (string, bool) {
+	for _, kv := range env {
+		if value, ok := strings.CutPrefix(kv, name+"="); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var uwsgiUpstreams = flag.String("uwsgi", "", "Comma-separated list of extension-or-prefix=address uwsgi upstreams, e.g. .py=unix:/run/uwsgi/app.sock")
+
+// uwsgiModifierWSGI selects the WSGI request handler in uWSGI
+const uwsgiModifierWSGI = 0
+
+// serveUWSGI forwards a request using the uwsgi binary protocol, see
+// https://uwsgi-docs.readthedocs.io/en/latest/Protocol.html
+func serveUWSGI(conn net.Conn, w http.ResponseWriter, r *http.Request, scriptPath string, env []string) error {
+	body, length, err := sizedBody(r)
+	if err != nil {
+		return err
+	}
+
+	// Variables are little-endian 16-bit length-prefixed keys and values
+	var vars []byte
+	for _, kv := range withContentLength(env, length) {
+		name, value, _ := strings.Cut(kv, "=")
+		if len(name) > 0xffff || len(value) > 0xffff {
+			return fmt.Errorf("uwsgi variable %s is too large", name)
+		}
+		vars = binary.LittleEndian.AppendUint16(vars, uint16(len(name)))
+		vars = append(vars, name...)
+		vars = binary.LittleEndian.AppendUint16(vars, uint16(len(value)))
+		vars = append(vars, value...)
+	}
+	if len(vars) > 0xffff {
+		return fmt.Errorf("uwsgi request variables exceed %d bytes", 0xffff)
+	}
+
+	header := [4]byte{uwsgiModifierWSGI, 0, 0, 0}
+	binary.LittleEndian.PutUint16(header[1:3], uint16(len(vars)))
+
+	bw := bufio.NewWriter(conn)
+	bw.Write(header[:])
+	bw.Write(vars)
+	if _, err := io.Copy(bw, body); err != nil {
+		return fmt.Errorf("error sending uwsgi request: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error sending uwsgi request: %v", err)
+	}
+
+	// uWSGI answers with an HTTP status line followed by CGI-style headers
+	return relayCGIResponse(conn, w)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+var (
+	showVersion         = flag.Bool("version", false, "Print the version and build information and exit")
+	serverSoftwareValue = flag.String("server-software", "", "Value of SERVER_SOFTWARE for scripts instead of Go-CGI-Server/<version>, or none to leave it unset")
+	serverHeaderValue   = flag.String("server-header", "", "Value of the Server response header instead of the SERVER_SOFTWARE value, or none to omit it")
+)
+
+// serverSoftware identifies the server in SERVER_SOFTWARE and the Server
+// response header
+var serverSoftware = "Go-CGI-Server/" + buildVersion()
+
+// buildVersion returns the module version, or for development builds the
+// VCS revision they were built from
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+
+	version := "devel"
+	var revision string
+	var modified bool
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if revision != "" {
+		if len(revision) > 12 {
+			revision = revision[:12]
+		}
+		version += "+" + revision
+		if modified {
+			version += "-dirty"
+		}
+	}
+	return version
+}
+
+// printVersion prints the version and the build information
+func printVersion() {
+	fmt.Println("cgiserver", buildVersion())
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	fmt.Println("go", info.GoVersion)
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified", "GOOS", "GOARCH", "CGO_ENABLED", "-tags":
+			fmt.Printf("%s %s\n", s.Key, s.Value)
+		}
+	}
+}
+
+// softwareName returns the value of SERVER_SOFTWARE, or an empty string if
+// it is omitted
+func softwareName() string {
+	switch *serverSoftwareValue {
+	case "":
+		return serverSoftware
+	case "none":
+		return ""
+	}
+	return *serverSoftwareValue
+}
+
+// serverBanner returns the value of the Server header, or an empty string if
+// it is omitted
+func serverBanner() string {
+	switch *serverHeaderValue {
+	case "":
+		return softwareName()
+	case "none":
+		return ""
+	}
+	return *serverHeaderValue
+}
+
+// withServerHeader identifies the server in every response
+func withServerHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if banner := serverBanner(); banner != "" {
+			w.Header().Set("Server", banner)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var watchCGIDir = flag.Bool("watch", false, "Watch the CGI directory for changes, keeping an index of valid scripts")
+
+// scriptIndex is the set of valid scripts, maintained by the watcher
+var scriptIndex struct {
+	sync.RWMutex
+	enabled bool
+	scripts map[string]bool
+	watcher *fsnotify.Watcher
+}
+
+// isIndexedScript reports whether the watcher knows a script to be valid
+func isIndexedScript(scriptPath string) bool {
+	scriptIndex.RLock()
+	defer scriptIndex.RUnlock()
+	return scriptIndex.enabled && scriptIndex.scripts[filepath.Clean(scriptPath)]
+}
+
+// isValidScript checks whether a file would pass checkScript
+func isValidScript(p string, info fs.FileInfo) bool {
+	return info.Mode().IsRegular() && isExecutable(p, info) && hasAllowedExtension(p)
+}
+
+// indexScript adds or removes a path from the index after a change
+func indexScript(p string) {
+	info, err := os.Stat(p)
+	valid := err == nil && isValidScript(p, info)
+
+	scriptIndex.Lock()
+	defer scriptIndex.Unlock()
+	if valid {
+		scriptIndex.scripts[p] = true
+	} else {
+		delete(scriptIndex.scripts, p)
+	}
+}
+
+// unindexTree removes a path and everything under it from the index
+func unindexTree(p string) {
+	scriptIndex.Lock()
+	defer scriptIndex.Unlock()
+	for script := range scriptIndex.scripts {
+		if script == p || strings.HasPrefix(script, p+string(filepath.Separator)) {
+			delete(scriptIndex.scripts, script)
+		}
+	}
+}
+
+// addTree watches a directory and its subdirectories and indexes the
+// scripts they contain
+func addTree(watcher *fsnotify.Watcher, root string) {
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if err := watcher.Add(p); err != nil {
+				log.Printf("Cannot watch %s: %v", p, err)
+			}
+			return nil
+		}
+		indexScript(p)
+		return nil
+	})
+}
+
+// startWatcher indexes a CGI directory and keeps the index and the stat
+// cache up to date as scripts are added, removed or have their mode changed.
+// Any directory watched before is forgotten.
+func startWatcher(dir string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	root := filepath.Clean(dir)
+	scriptIndex.Lock()
+	scriptIndex.enabled = false
+	scriptIndex.scripts = make(map[string]bool)
+	if scriptIndex.watcher != nil {
+		scriptIndex.watcher.Close()
+	}
+	scriptIndex.watcher = watcher
+	scriptIndex.Unlock()
+	addTree(watcher, root)
+	scriptIndex.Lock()
+	scriptIndex.enabled = true
+	count := len(scriptIndex.scripts)
+	scriptIndex.Unlock()
+	log.Printf("Watching %s, %d scripts indexed", root, count)
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				p := filepath.Clean(event.Name)
+				invalidateStat(p)
+
+				switch {
+				case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+					// Watches on removed directories are dropped automatically
+					unindexTree(p)
+				case event.Has(fsnotify.Create):
+					if info, err := os.Stat(p); err == nil && info.IsDir() {
+						addTree(watcher, p)
+					} else {
+						indexScript(p)
+					}
+				default:
+					indexScript(p)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("CGI directory watcher error: %v", err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scripts receiving webhooks can have the signature of every request checked
+// before they run, with the webhook setting of .cgiserver files or sidecars:
+//
+//	webhook = github:<secret>      X-Hub-Signature-256 HMAC of the body
+//	webhook = gitlab:<secret>      X-Gitlab-Token equal to the secret
+//	webhook = stripe:<secret>      Stripe-Signature HMAC of the timestamp and
+//	                               body, made within the last 5 minutes
+//
+// Requests failing verification are refused with 401. Verified requests get
+// WEBHOOK_PROVIDER and WEBHOOK_EVENT, the event type, in their environment.
+
+// webhookProviders are the supported webhook senders
+var webhookProviders = map[string]bool{"github": true, "gitlab": true, "stripe": true}
+
+// stripeTolerance is how old a Stripe signature may be
+const stripeTolerance = 5 * time.Minute
+
+// verifiedWebhookKey is the context key of the event of a webhook request
+// verified before it was queued as a job, which isn't verified again
+type verifiedWebhookKey struct{}
+
+// errWebhookSignature is returned for webhook requests failing verification
+var errWebhookSignature = errors.New("invalid webhook signature")
+
+// parseWebhook parses the value of a webhook setting
+func parseWebhook(value string) (provider, secret string, err error) {
+	provider, secret, ok := strings.Cut(value, ":")
+	if !ok || !webhookProviders[provider] || secret == "" {
+		return "", "", fmt.Errorf("invalid webhook %q, expected github, gitlab or stripe:secret", provider)
+	}
+	return provider, secret, nil
+}
+
+// validHubSignature checks a GitHub style "sha256=<hex HMAC>" signature
+func validHubSignature(header, secret string, body []byte) bool {
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(strings.ToLower(sig)), []byte(expected))
+}
+
+// validGitlabToken checks a GitLab X-Gitlab-Token header
+func validGitlabToken(token, secret string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+// validStripeSignature checks a "t=<timestamp>,v1=<hex HMAC>,..." signature
+func validStripeSignature(header, secret string, body []byte) bool {
+	var timestamp string
+	var sigs []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			sigs = append(sigs, value)
+		}
+	}
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(t, 0)).Abs() > stripeTolerance {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	for _, sig := range sigs {
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyWebhook reads the body of a webhook request and checks its
+// signature, returning the event type. The body is put back for the script.
+func verifyWebhook(r *http.Request, provider, secret string) (string, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, *maxBodySize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(body)) > *maxBodySize {
+		return "", fmt.Errorf("webhook body exceeds %d bytes", *maxBodySize)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	switch provider {
+	case "github":
+		if validHubSignature(r.Header.Get("X-Hub-Signature-256"), secret, body) {
+			return r.Header.Get("X-GitHub-Event"), nil
+		}
+	case "gitlab":
+		if validGitlabToken(r.Header.Get("X-Gitlab-Token"), secret) {
+			return r.Header.Get("X-Gitlab-Event"), nil
+		}
+	case "stripe":
+		if validStripeSignature(r.Header.Get("Stripe-Signature"), secret, body) {
+			var event struct {
+				Type string `json:"type"`
+			}
+			json.Unmarshal(body, &event)
+			return event.Type, nil
+		}
+	}
+	return "", errWebhookSignature
+}
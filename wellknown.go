@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+)
+
+var (
+	robotsTxt = flag.String("robots-txt", "", "File served as /robots.txt instead of one allowing all robots, or none to leave /robots.txt to the scripts")
+	favicon   = flag.String("favicon", "", "File served as /favicon.ico instead of an empty response, or none to leave /favicon.ico to the scripts")
+)
+
+// defaultRobotsTxt allows all robots
+const defaultRobotsTxt = "User-agent: *\nDisallow:\n"
+
+// setupWellKnown answers /robots.txt and /favicon.ico without running
+// scripts, unless a route was configured for them
+func setupWellKnown(routes map[string]http.Handler) {
+	if *robotsTxt != "none" && routes["/robots.txt"] == nil {
+		http.Handle("/robots.txt", staticHandler(*robotsTxt, "text/plain; charset=utf-8", []byte(defaultRobotsTxt)))
+	}
+	if *favicon != "none" && routes["/favicon.ico"] == nil {
+		http.Handle("/favicon.ico", staticHandler(*favicon, "image/x-icon", nil))
+	}
+}
+
+// staticHandler serves a file, or the given content if no file is named,
+// with no content meaning 204
+func staticHandler(path, contentType string, content []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		if path != "" {
+			w.Header().Set("Content-Type", contentType)
+			http.ServeFile(w, r, path)
+			return
+		}
+		if content == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		http.ServeContent(w, r, "", serverStarted, bytes.NewReader(content))
+	})
+}
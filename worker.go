@@ -0,0 +1,334 @@
+package main
+
+// Persistent worker mode
+//
+// Scripts matched by -worker-match are started once with CGISERVER_WORKER=1
+// in their environment, and kept running to serve many requests. Requests
+// are exchanged over the worker's stdin and stdout as frames made of a 4-byte
+// big-endian length followed by that many bytes:
+//
+//	request:  environment frame (NUL-separated NAME=value pairs), body frame
+//	response: a single frame with the usual CGI output (headers, blank line,
+//	          body)
+//
+// A worker serves one request at a time. Whenever a worker cannot be started
+// or fails before receiving the request, the request is served as classic CGI
+// instead. Workers are replaced once their script changes, and stopped once
+// the CGI directory they run from is swapped out and drained.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	workerCount    = flag.Int("workers", 4, "Number of persistent workers per script in worker mode")
+	workerMatch    = flag.String("worker-match", "", "Comma-separated list of extensions or URL path prefixes of scripts run as persistent workers")
+	maxWorkerFrame = flag.Int("max-worker-response", 64<<20, "Maximum size of a response from a persistent worker")
+)
+
+// worker is a long-lived script process
+type worker struct {
+	cmd      *exec.Cmd
+	group    *processGroup
+	stdin    io.WriteCloser
+	stdout   *bufio.Reader
+	killOnce sync.Once
+}
+
+// workerPool holds the workers for one version of a script
+type workerPool struct {
+	scriptPath string
+	info       os.FileInfo
+	idle       chan *worker
+	slots      chan struct{}
+
+	mu      sync.Mutex
+	retired bool
+}
+
+var (
+	workerPoolsMu sync.Mutex
+	workerPools   = make(map[string]*workerPool)
+)
+
+// usesWorkers checks whether a script is configured to run in worker mode
+func usesWorkers(urlPath string) bool {
+	for _, match := range strings.Split(*workerMatch, ",") {
+		match = strings.TrimSpace(match)
+		if match == "" {
+			continue
+		}
+		if strings.HasPrefix(match, ".") {
+			if strings.EqualFold(filepath.Ext(urlPath), match) {
+				return true
+			}
+		} else if strings.HasPrefix(urlPath, match) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameScript tells whether two stats of a script are of the same version,
+// i.e. the same file with the same size and modification time
+func sameScript(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// getWorkerPool returns the pool for a script, pre-spawning its workers the
+// first time it is requested and again whenever it changes. The script is
+// stat'ed without the stat cache, so no request runs old code once the new
+// one is in place.
+func getWorkerPool(scriptPath string) (*workerPool, error) {
+	info, err := os.Stat(scriptPath)
+	if err != nil {
+		return nil, err
+	}
+
+	workerPoolsMu.Lock()
+	defer workerPoolsMu.Unlock()
+
+	if pool, ok := workerPools[scriptPath]; ok {
+		if sameScript(pool.info, info) {
+			return pool, nil
+		}
+		log.Printf("Script %s changed, replacing its workers", scriptPath)
+		pool.retire()
+	}
+	pool := &workerPool{
+		scriptPath: scriptPath,
+		info:       info,
+		idle:       make(chan *worker, *workerCount),
+		slots:      make(chan struct{}, *workerCount),
+	}
+	for i := 0; i < *workerCount; i++ {
+		pool.slots <- struct{}{}
+	}
+	workerPools[scriptPath] = pool
+
+	go func() {
+		for i := 0; i < *workerCount; i++ {
+			<-pool.slots
+			wk, err := startWorker(scriptPath)
+			if err != nil {
+				pool.slots <- struct{}{}
+				log.Printf("Failed to pre-spawn worker for %s: %v", scriptPath, err)
+				return
+			}
+			pool.release(wk)
+		}
+	}()
+	return pool, nil
+}
+
+// stopWorkerPools stops the workers of the scripts in a CGI directory
+func stopWorkerPools(dir string) {
+	workerPoolsMu.Lock()
+	defer workerPoolsMu.Unlock()
+	for scriptPath, pool := range workerPools {
+		if strings.HasPrefix(scriptPath, dir+string(filepath.Separator)) {
+			pool.retire()
+			delete(workerPools, scriptPath)
+		}
+	}
+}
+
+// retire kills the idle workers of a pool that was replaced, and those busy
+// once they are released
+func (pool *workerPool) retire() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.retired = true
+	for {
+		select {
+		case wk := <-pool.idle:
+			wk.kill()
+		default:
+			return
+		}
+	}
+}
+
+// startWorker spawns a worker process for a script
+func startWorker(scriptPath string) (*worker, error) {
+	cmd := scriptCommand(context.Background(), scriptPath)
+	cmd.Env = append([]string{"GATEWAY_INTERFACE=CGI/1.1", "CGISERVER_WORKER=1"}, localeEnv()...)
+	setProcessGroup(cmd)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	go newStderrLog(fmt.Sprintf("Worker %d stderr", cmd.Process.Pid)).copyFrom(stderr)
+
+	log.Printf("Started worker %d for %s", cmd.Process.Pid, scriptPath)
+	return &worker{cmd: cmd, group: newProcessGroup(cmd.Process.Pid), stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// kill terminates a worker and its children
+func (wk *worker) kill() {
+	wk.killOnce.Do(func() {
+		wk.group.kill()
+		wk.stdin.Close()
+		go func() {
+			wk.cmd.Wait()
+			wk.group.close()
+		}()
+	})
+}
+
+// acquire waits for an idle worker, starting a new one if the pool has room
+func (pool *workerPool) acquire(ctx context.Context) (*worker, error) {
+	select {
+	case wk := <-pool.idle:
+		return wk, nil
+	default:
+	}
+
+	select {
+	case wk := <-pool.idle:
+		return wk, nil
+	case <-pool.slots:
+		wk, err := startWorker(pool.scriptPath)
+		if err != nil {
+			pool.slots <- struct{}{}
+			return nil, err
+		}
+		return wk, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release returns a healthy worker to the pool, or kills it if the pool was
+// retired
+func (pool *workerPool) release(wk *worker) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.retired {
+		wk.kill()
+		return
+	}
+	pool.idle <- wk
+}
+
+// discard kills a failed worker and frees its slot
+func (pool *workerPool) discard(wk *worker) {
+	wk.kill()
+	pool.slots <- struct{}{}
+}
+
+// writeFrame writes a length-prefixed frame
+func writeFrame(w io.Writer, data []byte) error {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readFrame reads a length-prefixed frame of at most max bytes
+func readFrame(r io.Reader, max int) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if int64(n) > int64(max) {
+		return nil, fmt.Errorf("frame of %d bytes exceeds maximum %d", n, max)
+	}
+	data := make([]byte, n)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+// roundTrip sends a request to a worker and reads its CGI output, telling
+// whether the worker received the whole request
+func (wk *worker) roundTrip(ctx context.Context, env []string, body []byte) ([]byte, bool, error) {
+	// Kill the worker if the request times out, which unblocks the read
+	stop := context.AfterFunc(ctx, wk.kill)
+	defer stop()
+
+	if err := writeFrame(wk.stdin, []byte(strings.Join(env, "\x00"))); err != nil {
+		return nil, false, err
+	}
+	if err := writeFrame(wk.stdin, body); err != nil {
+		return nil, false, err
+	}
+	output, err := readFrame(wk.stdout, *maxWorkerFrame)
+	return output, true, err
+}
+
+// executeWithWorker serves a request with a persistent worker, falling back
+// to classic CGI if no worker is available. Requests a worker received aren't
+// retried, as running them twice could repeat their effects.
+func executeWithWorker(ctx context.Context, w http.ResponseWriter, r *http.Request, scriptPath string, env []string) error {
+	// Workers get the body in one frame, which is held in memory
+	if r.ContentLength > *maxBodySize {
+		return &bodyCopyError{http.StatusRequestEntityTooLarge, fmt.Errorf("body of %d bytes exceeds %d bytes", r.ContentLength, *maxBodySize)}
+	}
+	body, _, err := sizedBody(r)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("error reading request body: %v", err)
+	}
+
+	pool, err := getWorkerPool(scriptPath)
+	var wk *worker
+	if err == nil {
+		wk, err = pool.acquire(ctx)
+	}
+	if err == nil {
+		var output []byte
+		var sent bool
+		output, sent, err = wk.roundTrip(ctx, env, data)
+		if err == nil {
+			pool.release(wk)
+			return relayCGIResponse(bytes.NewReader(output), w)
+		}
+		pool.discard(wk)
+		if sent {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("worker for %s failed: %v", scriptPath, err)
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	log.Printf("Worker unavailable for %s, falling back to CGI: %v", scriptPath, err)
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	return executeCGIWithTimeout(ctx, w, r, scriptPath, env)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var zeroCopy = flag.Bool("zero-copy", false, "Stream response bodies from scripts and upstreams without buffering, using splice/sendfile where available")
+
+// relayCGIResponse sends CGI-format output to the client. The body is
+// buffered unless zero-copy is enabled or the script asked for it to be
+// streamed.
+func relayCGIResponse(src io.Reader, w http.ResponseWriter) error {
+	reader := bufio.NewReader(src)
+
+	var head bytes.Buffer
+	var header http.Header
+	for {
+		if *lenientCGI {
+			rest, err := readLenientHead(reader, &head)
+			if err != nil {
+				return err
+			}
+			if head.Len() == 0 {
+				return relayHeaderless(w, rest, reader)
+			}
+			if len(rest) > 0 {
+				// The body started without a blank line, put its first line
+				// back in front of it
+				reader = bufio.NewReader(io.MultiReader(bytes.NewReader(rest), reader))
+				src = reader
+			}
+		} else {
+			complete, err := readHead(reader, &head)
+			if err != nil {
+				return err
+			}
+			if *strictCGI {
+				if err := validateHead(head.Bytes(), complete); err != nil {
+					return err
+				}
+			}
+			if !complete {
+				// No header separator, the parser treats it all as body
+				return parseCGIResponse(&head, w, true)
+			}
+		}
+		header = parseHead(head.Bytes())
+		if !isEarlyHints(header) {
+			break
+		}
+		sendEarlyHints(w, header)
+		head.Reset()
+	}
+
+	streaming := wantsStreaming(header)
+	if !*zeroCopy && !streaming {
+		return parseCGIResponse(io.MultiReader(&head, reader), w, true)
+	}
+
+	// Translate the headers with the same code as buffered responses
+	if err := parseCGIResponse(&head, w, false); err != nil {
+		return err
+	}
+	if streaming {
+		return copyFlushing(w, reader)
+	}
+	return copyZero(w, reader, src)
+}
+
+// readHead collects a header block, up to and including the blank line, and
+// reports whether the blank line was found before the end of the output
+func readHead(reader *bufio.Reader, head *bytes.Buffer) (bool, error) {
+	for {
+		line, err := reader.ReadString('\n')
+		head.WriteString(line)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if strings.TrimSpace(line) == "" {
+			return true, nil
+		}
+	}
+}
+
+// readFrom copies to a response through its ReadFrom if it has one, which
+// lets the server send files with sendfile
+func readFrom(w http.ResponseWriter, src io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(w, src)
+}
+
+// copyZero copies a body with io.Copy straight from the source, so that the
+// kernel can move it with splice (from sockets) or sendfile (from files) when
+// the client connection allows it, i.e. for plain HTTP responses with a
+// Content-Length.
+func copyZero(w http.ResponseWriter, reader *bufio.Reader, src io.Reader) error {
+	// Drain what bufio already read, then hand the source to io.Copy
+	if n := reader.Buffered(); n > 0 {
+		if _, err := io.CopyN(w, reader, int64(n)); err != nil {
+			return err
+		}
+	}
+	// Splicing needs the pipe itself
+	if k, ok := src.(*killedReader); ok {
+		src = k.Reader
+	}
+	_, err := io.Copy(w, src)
+	return err
+}